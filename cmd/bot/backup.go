@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ilikeorangutans/jarvis/pkg/database"
+	"github.com/kelseyhightower/envconfig"
+)
+
+// backupCommand writes a snapshot of the database to the data path. It is safe to run while the bot is running.
+func backupCommand() error {
+	var config CommandConfig
+	if err := envconfig.Process("jarvis", &config); err != nil {
+		return err
+	}
+	db, err := openDatabase(config.DataPath, config.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer database.Close(db)
+
+	path, err := database.Backup(context.Background(), db, config.DataPath, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Println(path)
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"github.com/ilikeorangutans/jarvis/pkg/bot/bottest"
+	"gotest.tools/assert"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestStatusHandler(t *testing.T) {
+	h := bottest.New(t, bot.BotConfiguration{})
+	addStatusHandler(h.Bot, time.Now())
+	const direct = id.RoomID("!direct:example.com")
+	h.Join(direct, "@alice:example.com")
+
+	h.Send(direct, "@alice:example.com", "status")
+	bodies := h.Bodies(direct)
+	assert.Equal(t, len(bodies), 1)
+	assert.Assert(t, strings.HasPrefix(bodies[0], "🤖 running since"), bodies[0])
+}
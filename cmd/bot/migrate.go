@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"github.com/ilikeorangutans/jarvis/pkg/database"
+	"github.com/ilikeorangutans/jarvis/pkg/jarvis"
+	"github.com/ilikeorangutans/jarvis/pkg/migrations"
+	"github.com/kelseyhightower/envconfig"
+)
+
+const migrateUsage = `usage: jarvis migrate status|up|down <name>
+
+status      lists the applied and latest version of every set of migrations
+up          applies all pending migrations
+down <name> reverts the last migration of the named set, e.g. core or polls`
+
+// CommandConfig is the configuration commands like migrate need, so they run without the Matrix settings.
+type CommandConfig struct {
+	DataPath    string `split_words:"true" required:"true"`
+	DatabaseURL string `split_words:"true"`
+}
+
+// migrateCommand runs the migrate subcommand with the given arguments.
+func migrateCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	var config CommandConfig
+	if err := envconfig.Process("jarvis", &config); err != nil {
+		return err
+	}
+	db, err := openDatabase(config.DataPath, config.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer database.Close(db)
+
+	// the modules are only asked for their migrations, so they don't need their dependencies
+	sets := migrationSets(db.Dialect, bot.NewModuleRegistry(jarvis.Modules(nil, db, nil, nil, nil)...))
+
+	switch args[0] {
+	case "status":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tVERSION\tLATEST\tPENDING\tDIRTY")
+		for _, set := range sets {
+			status, err := set.Status(db)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%t\n", status.Name, status.Version, status.Latest, status.Pending, status.Dirty)
+		}
+		return w.Flush()
+
+	case "up":
+		return migrations.Up(db, sets...)
+
+	case "down":
+		if len(args) != 2 {
+			return errors.New(migrateUsage)
+		}
+		for _, set := range sets {
+			if set.Name == args[1] {
+				return set.Down(db)
+			}
+		}
+		return fmt.Errorf("unknown migrations %q", args[1])
+
+	default:
+		return errors.New(migrateUsage)
+	}
+}
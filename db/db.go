@@ -0,0 +1,10 @@
+// Package db holds the core database migrations, embedded into the binary.
+package db
+
+import "embed"
+
+// Migrations are the migrations of the bot's own tables in the migrations directory, and their Postgres versions in
+// migrations/postgres.
+//
+//go:embed migrations/*.sql migrations/postgres/*.sql
+var Migrations embed.FS
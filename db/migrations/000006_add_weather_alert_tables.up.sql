@@ -0,0 +1 @@
+-- moved to the alerts module, see pkg/jarvis/migrations/alerts
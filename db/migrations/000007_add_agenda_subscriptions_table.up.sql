@@ -0,0 +1 @@
+-- moved to the agenda module, see pkg/jarvis/migrations/agenda
@@ -0,0 +1 @@
+create table http_cache (url text, status_code integer, body blob, etag text, last_modified text, content_type text, fetched_at datetime, expires_at datetime, primary key(url));
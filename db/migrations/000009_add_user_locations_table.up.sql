@@ -0,0 +1 @@
+-- moved to the locations module, see pkg/jarvis/migrations/locations
@@ -0,0 +1 @@
+-- moved to the dice module, see pkg/jarvis/migrations/dice
@@ -0,0 +1 @@
+-- moved to the polls module, see pkg/jarvis/migrations/polls
@@ -0,0 +1 @@
+create table reaction_watches (event_id text, key text, room text, name text, payload text, created_at datetime, primary key(event_id, key));
@@ -0,0 +1 @@
+create table bot_room_modes (room_id text, mode text, primary key(room_id));
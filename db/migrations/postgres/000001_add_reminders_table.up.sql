@@ -0,0 +1,2 @@
+create table if not exists reminders (id bigserial, recurring boolean, minute text, hour text, day text, message text, room text, "user" text, created_at timestamptz, primary key(id));
+create index if not exists reminders_users on reminders ("user");
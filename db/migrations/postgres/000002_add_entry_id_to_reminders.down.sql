@@ -0,0 +1,2 @@
+drop index if exists reminders_entry_id;
+alter table reminders drop column entry_id;
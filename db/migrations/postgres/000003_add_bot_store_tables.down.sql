@@ -0,0 +1 @@
+drop table bot_batch;
@@ -0,0 +1 @@
+create table bot_batch (user_id text, batch_token text, primary key(user_id));
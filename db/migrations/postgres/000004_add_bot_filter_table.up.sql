@@ -0,0 +1 @@
+create table bot_filters (user_id text, filter_id text, primary key(user_id));
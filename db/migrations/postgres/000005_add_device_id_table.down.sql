@@ -0,0 +1 @@
+drop table device_ids;
@@ -0,0 +1 @@
+create table device_ids (device_id text primary key, created_at timestamptz);
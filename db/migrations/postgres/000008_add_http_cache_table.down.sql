@@ -0,0 +1 @@
+drop table http_cache;
@@ -0,0 +1 @@
+create table http_cache (url text, status_code integer, body bytea, etag text, last_modified text, content_type text, fetched_at timestamptz, expires_at timestamptz, primary key(url));
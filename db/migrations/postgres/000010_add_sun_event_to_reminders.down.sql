@@ -0,0 +1,2 @@
+alter table reminders drop column sun_offset;
+alter table reminders drop column sun_event;
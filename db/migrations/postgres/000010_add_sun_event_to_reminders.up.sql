@@ -0,0 +1,2 @@
+alter table reminders add column sun_event text not null default '';
+alter table reminders add column sun_offset integer not null default 0;
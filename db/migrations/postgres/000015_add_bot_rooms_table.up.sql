@@ -0,0 +1 @@
+create table bot_rooms (room_id text, inviter text, joined_at timestamptz, primary key(room_id));
@@ -0,0 +1 @@
+create table bot_room_state (room_id text, type text, state_key text, sender text, content text, primary key(room_id, type, state_key));
@@ -0,0 +1 @@
+create table settings (scope text, scope_id text, key text, value text, primary key(scope, scope_id, key));
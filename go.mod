@@ -1,6 +1,6 @@
 module github.com/ilikeorangutans/jarvis
 
-go 1.13
+go 1.16
 
 require (
 	github.com/Masterminds/squirrel v1.5.0
@@ -10,6 +10,7 @@ require (
 	github.com/jmoiron/sqlx v1.2.0
 	github.com/joeshaw/myq v0.0.0-20211219033431-d60bd9ba0e43
 	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.9
 	github.com/nathan-osman/go-sunrise v0.0.0-20201029015502-9a83cd1a5746
 	github.com/prometheus/client_golang v1.9.0
@@ -0,0 +1,184 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/ilikeorangutans/jarvis/pkg/predicates"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+// DefaultAdminPowerLevel is the power level of moderators in the default power levels.
+const DefaultAdminPowerLevel = 50
+
+var (
+	configRegex   = regexp.MustCompile(`(?i)\A\s*config\s*\z`)
+	roomModeRegex = regexp.MustCompile(`(?i)\A\s*room\s+mode(\s+(\S+))?\s*\z`)
+	leaveRegex    = regexp.MustCompile(`(?i)\A\s*leave(\s+this)?(\s+room)?\s*\z`)
+	featuresRegex = regexp.MustCompile(`(?i)\A\s*features\s*\z`)
+	featureRegex  = regexp.MustCompile(`(?i)\A\s*(enable|disable)\s+(\S+)\s*\z`)
+)
+
+// adminCommand matches commands reserved for room moderators.
+func adminCommand() predicates.EventPredicate {
+	return predicates.Any(
+		predicates.MessageMatching(leaveRegex),
+		predicates.MessageMatching(featureRegex),
+		predicates.All(
+			predicates.MessageMatching(roomModeRegex),
+			func(source mautrix.EventSource, evt *event.Event) bool {
+				return roomModeRegex.FindStringSubmatch(evt.Content.AsMessage().Body)[2] != ""
+			},
+		),
+	)
+}
+
+// AddAdminHandlers adds commands to inspect and change how the bot behaves in a room. Changes are limited to
+// users with at least the admin power level.
+func AddAdminHandlers(b *Bot) {
+	b.On(
+		func(ctx context.Context, client MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			room := b.RoomState(evt.RoomID)
+			mode, err := b.storage.LoadRoomMode(evt.RoomID)
+			if err != nil {
+				return err
+			}
+
+			var builder strings.Builder
+			builder.WriteString("⚙️ Settings")
+			if name := room.Name(); name != "" {
+				builder.WriteString(" for <strong>")
+				builder.WriteString(html.EscapeString(name))
+				builder.WriteString("</strong>")
+			}
+			builder.WriteString(":<ul>")
+			builder.WriteString(fmt.Sprintf("<li>room mode: %s</li>", mode))
+			builder.WriteString(fmt.Sprintf("<li>direct chat: %s</li>", yesNo(b.IsDirect(evt.RoomID))))
+			builder.WriteString(fmt.Sprintf("<li>encrypted: %s</li>", yesNo(room.Encrypted())))
+			if disabled, err := b.DisabledFeatures(evt.RoomID); err == nil && len(disabled) > 0 {
+				var names []string
+				for _, feature := range b.Features() {
+					if disabled[feature] {
+						names = append(names, feature)
+					}
+				}
+				builder.WriteString(fmt.Sprintf("<li>disabled features: %s</li>", strings.Join(names, ", ")))
+			}
+			builder.WriteString(fmt.Sprintf("<li>your power level: %d, moderators need %d</li>", room.PowerLevel(evt.Sender), b.adminPowerLevel()))
+			builder.WriteString("</ul>Moderators can use <code>room mode auto|open|mention</code>, <code>enable|disable &lt;feature&gt;</code> and <code>leave</code>.")
+			client.SendHTML(evt.RoomID, builder.String())
+			return nil
+		},
+		predicates.MessageMatching(configRegex),
+	)
+
+	b.On(
+		func(ctx context.Context, client MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			mode, err := b.storage.LoadRoomMode(evt.RoomID)
+			if err != nil {
+				return err
+			}
+			client.SendText(evt.RoomID, fmt.Sprintf("This room is in %s mode.", mode))
+			return nil
+		},
+		predicates.MessageMatching(roomModeRegex),
+		predicates.Not(adminCommand()),
+	)
+
+	b.On(
+		func(ctx context.Context, client MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			parts := roomModeRegex.FindStringSubmatch(evt.Content.AsMessage().Body)
+			mode, err := ParseRoomMode(parts[2])
+			if err != nil {
+				client.SendText(evt.RoomID, err.Error())
+				return nil
+			}
+			if err := b.storage.StoreRoomMode(evt.RoomID, mode); err != nil {
+				client.SendText(evt.RoomID, fmt.Sprintf("Terribly sorry, but I couldn't change the room mode: %s", err))
+				return err
+			}
+			client.SendText(evt.RoomID, fmt.Sprintf("Very good, this room is now in %s mode.", mode))
+			return nil
+		},
+		predicates.MessageMatching(roomModeRegex),
+		adminCommand(),
+		b.Admin(),
+	)
+
+	b.On(
+		func(ctx context.Context, client MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			disabled, err := b.DisabledFeatures(evt.RoomID)
+			if err != nil {
+				return err
+			}
+
+			var builder strings.Builder
+			builder.WriteString("Features in this room:<ul>")
+			for _, feature := range b.Features() {
+				status := "✅ enabled"
+				if disabled[feature] {
+					status = "❌ disabled"
+				}
+				builder.WriteString(fmt.Sprintf("<li><code>%s</code>: %s</li>", feature, status))
+			}
+			builder.WriteString("</ul>")
+			client.SendHTML(evt.RoomID, builder.String())
+			return nil
+		},
+		predicates.MessageMatching(featuresRegex),
+	)
+
+	b.On(
+		func(ctx context.Context, client MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			parts := featureRegex.FindStringSubmatch(evt.Content.AsMessage().Body)
+			enable := strings.EqualFold(parts[1], "enable")
+			feature := strings.ToLower(parts[2])
+			if !b.hasFeature(feature) {
+				client.SendText(evt.RoomID, fmt.Sprintf("I don't know a feature called %q. Try one of: %s", feature, strings.Join(b.Features(), ", ")))
+				return nil
+			}
+			if err := b.EnableFeature(evt.RoomID, feature, enable); err != nil {
+				client.SendText(evt.RoomID, fmt.Sprintf("Terribly sorry, but I couldn't change that: %s", err))
+				return err
+			}
+			if enable {
+				client.SendText(evt.RoomID, fmt.Sprintf("Very good, %s is now enabled in this room.", feature))
+			} else {
+				client.SendText(evt.RoomID, fmt.Sprintf("Very good, %s is now disabled in this room.", feature))
+			}
+			return nil
+		},
+		predicates.MessageMatching(featureRegex),
+		b.Admin(),
+	)
+
+	b.On(
+		func(ctx context.Context, client MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			client.SendText(evt.RoomID, "👋 Very well, I'll see myself out.")
+			client.LeaveRoom(evt.RoomID)
+			return b.storage.RemoveJoinedRoom(evt.RoomID)
+		},
+		predicates.MessageMatching(leaveRegex),
+		b.Admin(),
+	)
+
+	b.On(
+		func(ctx context.Context, client MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			client.SendText(evt.RoomID, fmt.Sprintf("I'm afraid only room moderators (power level %d or higher) can do that.", b.adminPowerLevel()))
+			return nil
+		},
+		adminCommand(),
+		predicates.Not(b.Admin()),
+	)
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,30 @@
+package bot
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestAdminCommand(t *testing.T) {
+	isAdminCommand := adminCommand()
+	for body, expected := range map[string]bool{
+		"leave":            true,
+		"Leave this room":  true,
+		"room mode open":   true,
+		"room mode bogus":  true,
+		"room mode":        false,
+		"disable dice":     true,
+		"features":         false,
+		"config":           false,
+		"leave me alone":   false,
+		"weather tomorrow": false,
+	} {
+		evt := &event.Event{
+			Type:    event.EventMessage,
+			Content: event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: body}},
+		}
+		assert.Equal(t, isAdminCommand(0, evt), expected, body)
+	}
+}
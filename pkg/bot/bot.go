@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/ilikeorangutans/jarvis/pkg/predicates"
@@ -17,57 +18,192 @@ import (
 
 type MatrixClient interface {
 	JoinRoomByID(id.RoomID)
+	LeaveRoom(id.RoomID)
 	SendText(id.RoomID, string)
 	SendHTML(id.RoomID, string)
 	SendNotice(id.RoomID, string)
 	SetPresence(event.Presence)
 	SendReaction(roomID id.RoomID, eventID id.EventID, reaction string)
+	// SendMessageEvent sends an event of any type. If sent is not nil it is called with the ID of the new event once
+	// the homeserver accepted it, or with the error if the homeserver refused it.
+	SendMessageEvent(roomID id.RoomID, eventType event.Type, content interface{}, sent func(id.EventID, error))
+	MarkRead(id.RoomID, id.EventID)
+	// JoinedMembers asks the homeserver who joined the room. Unlike the other methods it waits for the answer.
+	JoinedMembers(id.RoomID) ([]id.UserID, error)
+	// Sent returns true if the event is one of the most recent events sent through this client.
+	Sent(id.EventID) bool
 }
 
+// maxSentEvents is how many of the most recently sent event IDs are remembered.
+const maxSentEvents = 1000
+
 func NewAsyncMatrixClient(client *mautrix.Client) *AsyncMatrixClient {
 	return &AsyncMatrixClient{
 		client: client,
 		queue:  make(chan func(context.Context) error, 100),
 		logger: log.With().Str("component", "AsyncMatrixClient").Logger(),
+		sent:   make(map[id.EventID]struct{}),
 	}
 }
 
 type AsyncMatrixClient struct {
-	client *mautrix.Client
-	queue  chan func(context.Context) error
-	logger zerolog.Logger
+	client    *mautrix.Client
+	queue     chan func(context.Context) error
+	logger    zerolog.Logger
+	sentLock  sync.Mutex
+	sent      map[id.EventID]struct{}
+	sentOrder []id.EventID
+	// done is closed once the goroutine started by Start stopped taking requests off the queue
+	done chan struct{}
+	// callbacks counts the sent callbacks still running, see callback
+	callbacks sync.WaitGroup
+}
+
+// Sent returns true if the event is one of the most recent events we sent. This is kept in memory only.
+func (a *AsyncMatrixClient) Sent(eventID id.EventID) bool {
+	a.sentLock.Lock()
+	defer a.sentLock.Unlock()
+	_, ok := a.sent[eventID]
+	return ok
+}
+
+func (a *AsyncMatrixClient) recordSent(resp *mautrix.RespSendEvent) {
+	if resp == nil {
+		return
+	}
+	a.sentLock.Lock()
+	defer a.sentLock.Unlock()
+	a.sent[resp.EventID] = struct{}{}
+	a.sentOrder = append(a.sentOrder, resp.EventID)
+	if len(a.sentOrder) > maxSentEvents {
+		delete(a.sent, a.sentOrder[0])
+		a.sentOrder = a.sentOrder[1:]
+	}
 }
 
+// Start sends queued requests until ctx is done. Whatever is left in the queue then is sent by Drain.
 func (a *AsyncMatrixClient) Start(ctx context.Context) error {
+	a.done = make(chan struct{})
 	go func() {
+		defer close(a.done)
 		for {
 			select {
 			case <-ctx.Done():
-				// TODO persist queue?
 				return
 
 			case f := <-a.queue:
-				ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-				defer cancel()
-
-				err := f(ctx)
-				if errors.Is(err, mautrix.MLimitExceeded) {
-					log.Warn().Msg("limit exceeded, sleeping")
-					time.Sleep(2 * time.Second)
-					continue
-				} else if err != nil {
-					log.Error().Err(err).Msg("handling queue")
-				}
+				a.handle(ctx, f)
 			}
 		}
 	}()
 	return nil
 }
 
+// Drain waits for the queue started by Start to stop, then sends what is left until the queue is empty and no sent
+// callbacks are running, or ctx is done.
+func (a *AsyncMatrixClient) Drain(ctx context.Context) error {
+	if a.done != nil {
+		select {
+		case <-a.done:
+		case <-ctx.Done():
+			return fmt.Errorf("queue did not stop: %w", ctx.Err())
+		}
+	}
+	for {
+		if err := a.sendQueued(ctx); err != nil {
+			return err
+		}
+		// callbacks may queue more requests
+		finished := make(chan struct{})
+		go func() {
+			a.callbacks.Wait()
+			close(finished)
+		}()
+		select {
+		case <-finished:
+		case <-ctx.Done():
+			return fmt.Errorf("sent callbacks did not finish: %w", ctx.Err())
+		}
+		if len(a.queue) == 0 {
+			return nil
+		}
+	}
+}
+
+// sendQueued sends requests until the queue is empty or ctx is done.
+func (a *AsyncMatrixClient) sendQueued(ctx context.Context) error {
+	for {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%d requests left in queue: %w", len(a.queue), ctx.Err())
+		}
+		select {
+		case f := <-a.queue:
+			a.handle(ctx, f)
+		default:
+			return nil
+		}
+	}
+}
+
+// callback runs f without blocking the queue, as sent callbacks commonly send follow up events. Drain waits for it.
+func (a *AsyncMatrixClient) callback(f func()) {
+	a.callbacks.Add(1)
+	go func() {
+		defer a.callbacks.Done()
+		f()
+	}()
+}
+
+func (a *AsyncMatrixClient) handle(ctx context.Context, f func(context.Context) error) {
+	err := retryLimited(ctx, a.logger, func() error {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		return f(ctx)
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("handling queue")
+	}
+}
+
+// defaultRetryAfter is how long to wait before retrying a rate limited request if the homeserver doesn't say.
+const defaultRetryAfter = 2 * time.Second
+
+// retryAfter returns how long the homeserver wants us to wait before retrying, if the error is a rate limit.
+func retryAfter(err error) (time.Duration, bool) {
+	if !errors.Is(err, mautrix.MLimitExceeded) {
+		return 0, false
+	}
+	var respErr mautrix.RespError
+	if errors.As(err, &respErr) {
+		if ms, ok := respErr.ExtraData["retry_after_ms"].(float64); ok {
+			return time.Duration(ms) * time.Millisecond, true
+		}
+	}
+	return defaultRetryAfter, true
+}
+
+// retryLimited calls f again for as long as it gets rate limited and ctx isn't done.
+func retryLimited(ctx context.Context, logger zerolog.Logger, f func() error) error {
+	for {
+		err := f()
+		wait, limited := retryAfter(err)
+		if !limited {
+			return err
+		}
+		logger.Warn().Err(err).Dur("retry-after", wait).Msg("request exceeded limit")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
 func (a *AsyncMatrixClient) SendNotice(roomID id.RoomID, message string) {
 	a.logger.Debug().Str("message", message).Msg("SendNotice")
 	a.queue <- func(ctx context.Context) error {
-		_, err := a.client.SendNotice(roomID, message)
+		resp, err := a.client.SendNotice(roomID, message)
+		a.recordSent(resp)
 		return err
 	}
 }
@@ -75,18 +211,20 @@ func (a *AsyncMatrixClient) SendNotice(roomID id.RoomID, message string) {
 func (a *AsyncMatrixClient) SendHTML(roomID id.RoomID, message string) {
 	a.logger.Debug().Str("message", message).Msg("SendText")
 	a.queue <- func(ctx context.Context) error {
-		_, err := a.client.SendMessageEvent(roomID, event.EventMessage, event.MessageEventContent{
+		resp, err := a.client.SendMessageEvent(roomID, event.EventMessage, event.MessageEventContent{
 			MsgType:       event.MsgText,
 			FormattedBody: message,
 			Format:        event.FormatHTML,
 		})
+		a.recordSent(resp)
 		return err
 	}
 }
 func (a *AsyncMatrixClient) SendText(roomID id.RoomID, message string) {
 	a.logger.Debug().Str("message", message).Msg("SendText")
 	a.queue <- func(ctx context.Context) error {
-		_, err := a.client.SendText(roomID, message)
+		resp, err := a.client.SendText(roomID, message)
+		a.recordSent(resp)
 		return err
 	}
 }
@@ -99,6 +237,14 @@ func (a *AsyncMatrixClient) JoinRoomByID(roomID id.RoomID) {
 	}
 }
 
+func (a *AsyncMatrixClient) LeaveRoom(roomID id.RoomID) {
+	a.logger.Debug().Msg("LeaveRoom")
+	a.queue <- func(ctx context.Context) error {
+		_, err := a.client.LeaveRoom(roomID)
+		return err
+	}
+}
+
 func (a *AsyncMatrixClient) SendReaction(roomID id.RoomID, eventID id.EventID, reaction string) {
 	a.logger.Debug().Str("eventID", eventID.String()).Str("reaction", reaction).Msg("SendReaction")
 	a.queue <- func(ctx context.Context) error {
@@ -111,8 +257,47 @@ func (a *AsyncMatrixClient) SendReaction(roomID id.RoomID, eventID id.EventID, r
 	}
 }
 
+func (a *AsyncMatrixClient) SendMessageEvent(roomID id.RoomID, eventType event.Type, content interface{}, sent func(id.EventID, error)) {
+	a.logger.Debug().Str("type", eventType.Type).Msg("SendMessageEvent")
+	a.queue <- func(ctx context.Context) error {
+		resp, err := a.client.SendMessageEvent(roomID, eventType, content)
+		if err != nil {
+			// rate limited requests are retried, see handle
+			if _, limited := retryAfter(err); !limited && sent != nil {
+				a.callback(func() { sent("", err) })
+			}
+			return err
+		}
+		a.recordSent(resp)
+		if sent != nil {
+			a.callback(func() { sent(resp.EventID, nil) })
+		}
+		return nil
+	}
+}
+
+func (a *AsyncMatrixClient) MarkRead(roomID id.RoomID, eventID id.EventID) {
+	a.queue <- func(ctx context.Context) error {
+		return a.client.MarkRead(roomID, eventID)
+	}
+}
+
+func (a *AsyncMatrixClient) JoinedMembers(roomID id.RoomID) ([]id.UserID, error) {
+	resp, err := a.client.JoinedMembers(roomID)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]id.UserID, 0, len(resp.Joined))
+	for userID := range resp.Joined {
+		members = append(members, userID)
+	}
+	return members, nil
+}
+
 func (a *AsyncMatrixClient) SetPresence(presence event.Presence) {
-	panic("not implemented") // TODO: Implement
+	a.queue <- func(ctx context.Context) error {
+		return a.client.SetPresence(presence)
+	}
 }
 
 type EventHandler func(context.Context, MatrixClient, mautrix.EventSource, *event.Event) error
@@ -121,8 +306,18 @@ type BotConfiguration struct {
 	Username      string
 	Password      string
 	HomeserverURL *url.URL
+	// CommandPrefix addresses the bot without mentioning it, e.g. "!status".
+	CommandPrefix string
+	// AdminPowerLevel is the room power level needed for admin commands, DefaultAdminPowerLevel if zero.
+	AdminPowerLevel int
+	// ShutdownTimeout is how long Run waits for handlers, shutdown hooks and queued requests once its context is
+	// done, DefaultShutdownTimeout if zero.
+	ShutdownTimeout time.Duration
 }
 
+// DefaultShutdownTimeout leaves time to stop the rest of jarvis within Docker's default grace period of ten seconds.
+const DefaultShutdownTimeout = 5 * time.Second
+
 func NewBot(config BotConfiguration, storage BotStorage) (*Bot, error) {
 	logger := log.With().Str("component", "bot").Logger()
 	client, err := mautrix.NewClient(config.HomeserverURL.String(), "", "")
@@ -130,35 +325,170 @@ func NewBot(config BotConfiguration, storage BotStorage) (*Bot, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not create client: %w", err)
 	}
-	client.Store = storage
+	storageFailures := make(chan error, 1)
+	client.Store = &syncStore{BotStorage: storage, failures: storageFailures}
+	async := NewAsyncMatrixClient(client)
 	return &Bot{
-		client:  client,
-		config:  config,
-		logger:  logger,
-		storage: storage,
-		matrix:  NewAsyncMatrixClient(client),
+		client:          client,
+		config:          config,
+		logger:          logger,
+		storage:         storage,
+		storageFailures: storageFailures,
+		async:           async,
+		matrix:          async,
+		direct:          make(map[id.RoomID]bool),
 	}, nil
 }
 
+// NewBotWithClient returns a bot acting as userID that sends through client and never talks to a homeserver itself,
+// so tests can feed it events with Dispatch. Authenticate and Run need a bot from NewBot.
+func NewBotWithClient(config BotConfiguration, storage BotStorage, client MatrixClient, userID id.UserID) *Bot {
+	return &Bot{
+		config:    config,
+		logger:    log.With().Str("component", "bot").Logger(),
+		storage:   storage,
+		matrix:    client,
+		addressee: predicates.NewAddressee(userID, "", config.CommandPrefix),
+		direct:    make(map[id.RoomID]bool),
+		UserID:    userID,
+	}
+}
+
+// syncStore hands the storage to mautrix, whose Storer can't report errors. It passes the first failure to loading or
+// saving sync state on to Run instead, which stops the bot rather than letting mautrix sync from scratch.
+type syncStore struct {
+	BotStorage
+	failures chan<- error
+}
+
+func (s *syncStore) failed(err error) {
+	select {
+	case s.failures <- err:
+	default:
+	}
+}
+
+func (s *syncStore) SaveFilterID(userID id.UserID, filterID string) {
+	if err := s.StoreFilterID(userID, filterID); err != nil {
+		s.failed(err)
+	}
+}
+
+func (s *syncStore) LoadFilterID(userID id.UserID) string {
+	filterID, err := s.FilterID(userID)
+	if err != nil {
+		s.failed(err)
+	}
+	return filterID
+}
+
+func (s *syncStore) SaveNextBatch(userID id.UserID, nextBatchToken string) {
+	if err := s.StoreNextBatch(userID, nextBatchToken); err != nil {
+		s.failed(err)
+	}
+}
+
+func (s *syncStore) LoadNextBatch(userID id.UserID) string {
+	nextBatch, err := s.NextBatch(userID)
+	if err != nil {
+		s.failed(err)
+	}
+	return nextBatch
+}
+
 type Handler struct {
 	Func       EventHandler
 	Predicates []predicates.EventPredicate
+	// Feature is the feature the handler belongs to, if any.
+	Feature string
 }
 
 type Bot struct {
-	client   *mautrix.Client
-	config   BotConfiguration
-	logger   zerolog.Logger
-	storage  BotStorage
-	handlers []Handler
-	matrix   *AsyncMatrixClient
-	UserID   id.UserID
+	client  *mautrix.Client
+	config  BotConfiguration
+	logger  zerolog.Logger
+	storage BotStorage
+	// storageFailures receives the first failure to load or save sync state, see syncStore
+	storageFailures <-chan error
+	handlers        []Handler
+	// async is the client matrix sends through, nil if the bot came from NewBotWithClient
+	async     *AsyncMatrixClient
+	matrix    MatrixClient
+	addressee *predicates.Addressee
+	// direct caches whether rooms are direct chats, see IsDirect
+	directLock sync.Mutex
+	direct     map[id.RoomID]bool
+	settings   *Settings
+	// feature is the feature whose handlers are being registered, see Feature
+	feature  string
+	features []string
+	// shutdownHooks run during shutdown, see OnShutdown
+	shutdownHooks []func(context.Context)
+	UserID        id.UserID
 }
 
 func (b *Bot) Client() MatrixClient {
 	return b.matrix
 }
 
+// AtBot matches messages addressed to the bot.
+func (b *Bot) AtBot() predicates.EventPredicate {
+	return predicates.MentionsBot(b.UserID)
+}
+
+// stripMention returns a copy of messages addressed to the bot with the mention or command prefix removed from the
+// body, so handlers can parse commands without caring how the bot was addressed. The copy lists the bot in
+// m.mentions, so AtBot and AtUser still match it.
+func (b *Bot) stripMention(evt *event.Event) (*event.Event, bool) {
+	if b.addressee == nil {
+		return evt, false
+	}
+	body, ok := b.addressee.Match(evt)
+	if !ok {
+		return evt, false
+	}
+
+	stripped := *evt
+	msg := *evt.Content.AsMessage()
+	msg.Body = body
+	msg.Format = ""
+	msg.FormattedBody = ""
+	stripped.Content.Parsed = &msg
+	stripped.Content.Raw = make(map[string]interface{}, len(evt.Content.Raw)+1)
+	for k, v := range evt.Content.Raw {
+		stripped.Content.Raw[k] = v
+	}
+	userIDs := []interface{}{b.UserID.String()}
+	if mentions, ok := evt.Content.Raw["m.mentions"].(map[string]interface{}); ok {
+		existing, _ := mentions["user_ids"].([]interface{})
+		userIDs = append(userIDs, existing...)
+	}
+	stripped.Content.Raw["m.mentions"] = map[string]interface{}{"user_ids": userIDs}
+	return &stripped, true
+}
+
+// PowerLevel returns the user's power level in the room.
+func (b *Bot) PowerLevel(roomID id.RoomID, userID id.UserID) int {
+	return b.RoomState(roomID).PowerLevel(userID)
+}
+
+func (b *Bot) adminPowerLevel() int {
+	if b.config.AdminPowerLevel == 0 {
+		return DefaultAdminPowerLevel
+	}
+	return b.config.AdminPowerLevel
+}
+
+// Admin matches events sent by room moderators, that is users with at least the admin power level.
+func (b *Bot) Admin() predicates.EventPredicate {
+	return predicates.PowerLevelAtLeast(b.adminPowerLevel(), b.PowerLevel)
+}
+
+// ReactionToOwnMessage matches reactions to messages the bot sent recently.
+func (b *Bot) ReactionToOwnMessage() predicates.EventPredicate {
+	return predicates.ReactionToEvents(b.matrix.Sent)
+}
+
 func (b *Bot) Authenticate(ctx context.Context) error {
 	deviceID, err := b.storage.LoadDeviceID()
 	if err != nil {
@@ -178,6 +508,14 @@ func (b *Bot) Authenticate(ctx context.Context) error {
 
 	b.UserID = loginResp.UserID
 
+	var displayName string
+	if resp, err := b.client.GetOwnDisplayName(); err != nil {
+		b.logger.Warn().Err(err).Msg("could not get display name")
+	} else {
+		displayName = resp.DisplayName
+	}
+	b.addressee = predicates.NewAddressee(b.UserID, displayName, b.config.CommandPrefix)
+
 	if loginResp.DeviceID != deviceID {
 		deviceID = loginResp.DeviceID
 		if err := b.storage.StoreDeviceID(deviceID); err != nil {
@@ -190,84 +528,169 @@ func (b *Bot) Authenticate(ctx context.Context) error {
 	return nil
 }
 
+// Run syncs and passes events to the handlers until ctx is done or storing the sync state fails, then shuts down, see
+// shutdown.
 func (b *Bot) Run(ctx context.Context) error {
-	// TODO do we need a separate cancel context?
-
-	if err := b.respectLimits(b.client.SetPresence(event.PresenceOnline)); err != nil {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	if err := retryLimited(ctx, b.logger, func() error { return b.client.SetPresence(event.PresenceOnline) }); err != nil {
 		return fmt.Errorf("setting presence failed: %w", err)
 	}
+	if err := b.reconcileJoinedRooms(ctx); err != nil {
+		return fmt.Errorf("could not reconcile joined rooms: %w", err)
+	}
 
 	syncer := b.client.Syncer.(*mautrix.DefaultSyncer)
+	// pass on events mautrix doesn't know, like polls; handlers can still read their raw content
+	syncer.ParseErrorHandler = func(evt *event.Event, err error) bool {
+		return errors.Is(err, event.UnsupportedContentType)
+	}
+	// handlers get their own context, so shutting down lets them finish rather than cancelling them
+	handlerCtx, cancelHandlers := context.WithCancel(context.Background())
+	defer cancelHandlers()
 	syncer.OnEvent(func(source mautrix.EventSource, evt *event.Event) {
-		// TODO ignore events that happened _before_ we joined the room
-		ignoredTypes := []event.Type{event.EphemeralEventReceipt, event.EphemeralEventPresence, event.EphemeralEventTyping}
-		for _, t := range ignoredTypes {
-			if evt.Type == t {
-				return
-			}
+		b.Dispatch(handlerCtx, source, evt)
+	})
+
+	b.async.Start(ctx)
+	synced := make(chan struct{})
+	go func() {
+		defer close(synced)
+		b.logger.Info().Msg("beginning sync")
+		// the context also ends the long poll for new events, rather than StopSync waiting for it
+		err := b.client.SyncWithContext(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Error().Err(err).Msg("sync failed")
 		}
+	}()
 
-		if evt.Sender == b.UserID {
-			return
+	select {
+	case <-ctx.Done():
+		return b.shutdown(synced)
+	case err := <-b.storageFailures:
+		b.client.StopSync()
+		stop()
+		// nothing is synced past the failure, but what was already handled still gets sent
+		if shutdownErr := b.shutdown(synced); shutdownErr != nil {
+			b.logger.Error().Err(shutdownErr).Msg("could not shut down")
 		}
+		return fmt.Errorf("sync state storage failed: %w", err)
+	}
+}
 
-		log.Info().Str("source", source.String()).Str("sender", evt.Sender.String()).Str("type", evt.Type.Type).Msg("event")
+// shutdown stops the bot once Run's context is done, which already stopped syncing. mautrix stores the next batch
+// token before handling a sync response, so the events of the last response are handled now or never: shutdown waits
+// for their handlers, runs the OnShutdown hooks, sends what was queued, and sets presence offline. All of that gets
+// ShutdownTimeout together.
+func (b *Bot) shutdown(synced <-chan struct{}) error {
+	b.logger.Info().Msg("shutting down")
+	timeout := b.config.ShutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-		for _, handler := range b.handlers {
-			canHandle := true
-			for _, p := range handler.Predicates {
-				if !p(source, evt) {
-					canHandle = false
-					break
-				}
-			}
-			if !canHandle {
-				continue
-			}
+	select {
+	case <-synced:
+	case <-ctx.Done():
+		b.logger.Warn().Msg("handlers did not finish in time")
+	}
+	for _, hook := range b.shutdownHooks {
+		hook(ctx)
+	}
+	if err := b.async.Drain(ctx); err != nil {
+		b.logger.Warn().Err(err).Msg("could not send all queued requests")
+	}
 
-			ctx, cancel := context.WithTimeout(ctx, time.Second*5)
-			defer cancel()
+	if err := b.respectLimits(b.client.SetPresence(event.PresenceOffline)); err != nil {
+		return fmt.Errorf("setting presence failed: %w", err)
+	}
+	b.logger.Info().Msg("bot stopped")
+	return nil
+}
 
-			err := handler.Func(ctx, b.matrix, source, evt)
-			if err != nil {
-				log.Error().Err(err).Msgf("handler failed")
-			}
+// Dispatch tracks room state from the event and passes it to every handler whose predicates match.
+func (b *Bot) Dispatch(ctx context.Context, source mautrix.EventSource, evt *event.Event) {
+	// TODO ignore events that happened _before_ we joined the room
+	ignoredTypes := []event.Type{event.EphemeralEventReceipt, event.EphemeralEventPresence, event.EphemeralEventTyping}
+	for _, t := range ignoredTypes {
+		if evt.Type == t {
+			return
 		}
+	}
 
-		b.client.MarkRead(evt.RoomID, evt.ID)
-	})
+	// track state before ignoring our own events, our membership is part of it
+	if evt.StateKey != nil {
+		if err := b.storage.UpdateRoomState(evt); err != nil {
+			b.logger.Error().Err(err).Str("type", evt.Type.Type).Msg("could not update room state")
+		}
+	}
 
-	b.matrix.Start(ctx)
-	go func() {
-		b.logger.Info().Msg("beginning sync")
-		err := b.client.Sync()
-		if err != nil {
-			log.Error().Err(err).Msg("sync failed")
+	if evt.Sender == b.UserID {
+		return
+	}
+
+	log.Info().Str("source", source.String()).Str("sender", evt.Sender.String()).Str("type", evt.Type.Type).Msg("event")
+
+	if evt.Type.Type == event.StateMember.Type {
+		b.forgetMembers(evt.RoomID)
+	}
+
+	// in group rooms only messages addressed to us are commands, unless the room mode says otherwise
+	evt, addressed := b.stripMention(evt)
+	if evt.Type == event.EventMessage && !addressed && !b.acceptsUnaddressed(evt.RoomID) {
+		b.matrix.MarkRead(evt.RoomID, evt.ID)
+		return
+	}
+
+	disabled, err := b.DisabledFeatures(evt.RoomID)
+	if err != nil {
+		b.logger.Error().Err(err).Stringer("room-id", evt.RoomID).Msg("could not load disabled features")
+	}
+
+	for _, handler := range b.handlers {
+		if disabled[handler.Feature] {
+			continue
 		}
-	}()
 
-	for {
-		select {
-		case <-ctx.Done():
-			b.logger.Info().Msg("shutting down")
-			b.client.StopSync()
-			if err := b.respectLimits(b.client.SetPresence(event.PresenceOffline)); err != nil {
-				return fmt.Errorf("setting presence failed: %w", err)
+		canHandle := true
+		for _, p := range handler.Predicates {
+			if !p(source, evt) {
+				canHandle = false
+				break
 			}
-			return nil
+		}
+		if !canHandle {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+		defer cancel()
+
+		err := handler.Func(ctx, b.matrix, source, evt)
+		if err != nil {
+			log.Error().Err(err).Msgf("handler failed")
 		}
 	}
 
-	return nil
+	b.matrix.MarkRead(evt.RoomID, evt.ID)
 }
 
 func (b *Bot) On(handler EventHandler, predicates ...predicates.EventPredicate) {
 	b.handlers = append(b.handlers, Handler{
 		Func:       handler,
 		Predicates: predicates,
+		Feature:    b.feature,
 	})
 }
 
+// OnShutdown registers a function that runs while the bot shuts down, after handlers finished and before queued
+// requests are sent, e.g. to stop jobs that send messages. The context ends with ShutdownTimeout.
+func (b *Bot) OnShutdown(hook func(context.Context)) {
+	b.shutdownHooks = append(b.shutdownHooks, hook)
+}
+
 func (b *Bot) respectLimits(err error) error {
 	if errors.Is(err, mautrix.MLimitExceeded) {
 		b.logger.Warn().Err(err).Msg("request exceeded limit")
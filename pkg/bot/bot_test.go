@@ -0,0 +1,48 @@
+package bot
+
+import (
+	"testing"
+
+	"github.com/ilikeorangutans/jarvis/pkg/predicates"
+	"gotest.tools/assert"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestStripMention(t *testing.T) {
+	b := &Bot{UserID: "@jarvis:example.com"}
+	b.addressee = predicates.NewAddressee(b.UserID, "Jarvis", "!")
+
+	evt := &event.Event{
+		ID:   "$1",
+		Type: event.EventMessage,
+		Content: event.Content{
+			Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: "Jarvis: weather"},
+			Raw:    map[string]interface{}{"body": "Jarvis: weather"},
+		},
+	}
+	stripped, addressed := b.stripMention(evt)
+	assert.Assert(t, addressed)
+	assert.Equal(t, stripped.ID, evt.ID)
+	assert.Equal(t, stripped.Content.AsMessage().Body, "weather")
+	assert.Equal(t, evt.Content.AsMessage().Body, "Jarvis: weather")
+	assert.Assert(t, b.AtBot()(0, stripped))
+	_, ok := evt.Content.Raw["m.mentions"]
+	assert.Assert(t, !ok)
+
+	evt.Content.Parsed = &event.MessageEventContent{MsgType: event.MsgText, Body: "weather"}
+	unchanged, addressed := b.stripMention(evt)
+	assert.Assert(t, !addressed)
+	assert.Equal(t, unchanged, evt)
+}
+
+func TestParseRoomMode(t *testing.T) {
+	mode, err := ParseRoomMode("Open")
+	assert.NilError(t, err)
+	assert.Equal(t, mode, RoomModeOpen)
+
+	_, err = ParseRoomMode("loud")
+	assert.ErrorContains(t, err, "unknown room mode")
+
+	assert.Equal(t, roomModeRegex.FindStringSubmatch("room mode mention")[2], "mention")
+	assert.Equal(t, roomModeRegex.FindStringSubmatch("room mode")[2], "")
+}
@@ -0,0 +1,122 @@
+// Package bottest runs a bot without a homeserver: events go straight to its handlers, and whatever it sends is
+// recorded by a fake client, so tests can check how handlers respond.
+package bottest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// BotID is the user the bot acts as.
+	BotID = id.UserID("@jarvis:example.com")
+	// Room is a room for tests that need only one.
+	Room = id.RoomID("!room:example.com")
+)
+
+// Harness is a bot with in-memory storage and a recording client.
+type Harness struct {
+	t       testing.TB
+	Bot     *bot.Bot
+	Client  *Client
+	Storage bot.BotStorage
+	// Source is the part of the sync response events appear to come from, joined rooms' timelines by default.
+	Source mautrix.EventSource
+
+	events int
+}
+
+// New returns a harness for a bot acting as BotID. Register handlers on Bot before sending events.
+func New(t testing.TB, config bot.BotConfiguration) *Harness {
+	client := NewClient()
+	storage := bot.NewMemoryBotStorage()
+	return &Harness{
+		t:       t,
+		Bot:     bot.NewBotWithClient(config, storage, client, BotID),
+		Client:  client,
+		Storage: storage,
+		Source:  mautrix.EventSourceJoin | mautrix.EventSourceTimeline,
+	}
+}
+
+// Event returns an event as it would arrive from the homeserver. Content is serialized and parsed again, so handlers
+// see both the parsed and the raw content.
+func (h *Harness) Event(roomID id.RoomID, sender id.UserID, eventType event.Type, stateKey *string, content interface{}) *event.Event {
+	h.t.Helper()
+	h.events++
+	raw := map[string]interface{}{
+		"room_id":          roomID,
+		"sender":           sender,
+		"type":             eventType.Type,
+		"event_id":         fmt.Sprintf("$event%d", h.events),
+		"origin_server_ts": time.Now().UnixNano() / int64(time.Millisecond),
+		"content":          content,
+	}
+	if stateKey != nil {
+		raw["state_key"] = *stateKey
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	evt := &event.Event{}
+	if err := json.Unmarshal(data, evt); err != nil {
+		h.t.Fatal(err)
+	}
+	evt.Type.Class = eventType.Class
+	if err := evt.Content.ParseRaw(evt.Type); err != nil && !errors.Is(err, event.UnsupportedContentType) {
+		h.t.Fatal(err)
+	}
+	return evt
+}
+
+// Dispatch passes the event to the bot and returns its ID.
+func (h *Harness) Dispatch(evt *event.Event) id.EventID {
+	h.Bot.Dispatch(context.Background(), h.Source, evt)
+	return evt.ID
+}
+
+// Send sends a text message to the room.
+func (h *Harness) Send(roomID id.RoomID, sender id.UserID, body string) id.EventID {
+	h.t.Helper()
+	return h.Dispatch(h.Event(roomID, sender, event.EventMessage, nil, &event.MessageEventContent{MsgType: event.MsgText, Body: body}))
+}
+
+// React reacts to the event with the key, e.g. an emoji.
+func (h *Harness) React(roomID id.RoomID, sender id.UserID, eventID id.EventID, key string) id.EventID {
+	h.t.Helper()
+	return h.Dispatch(h.Event(roomID, sender, event.EventReaction, nil, &event.ReactionEventContent{
+		RelatesTo: event.RelatesTo{Type: event.RelAnnotation, EventID: eventID, Key: key},
+	}))
+}
+
+// SetState sends a state event, e.g. to change power levels.
+func (h *Harness) SetState(roomID id.RoomID, sender id.UserID, eventType event.Type, stateKey string, content interface{}) id.EventID {
+	h.t.Helper()
+	return h.Dispatch(h.Event(roomID, sender, eventType, &stateKey, content))
+}
+
+// Join makes the users, and the bot, members of the room. Rooms with more than one other member are group rooms.
+func (h *Harness) Join(roomID id.RoomID, userIDs ...id.UserID) {
+	h.t.Helper()
+	members := append([]id.UserID{BotID}, userIDs...)
+	h.Client.SetMembers(roomID, members...)
+	for _, userID := range members {
+		h.SetState(roomID, userID, event.StateMember, userID.String(), &event.MemberEventContent{Membership: event.MembershipJoin})
+	}
+}
+
+// Bodies returns the bodies of the messages the bot sent to the room.
+func (h *Harness) Bodies(roomID id.RoomID) []string {
+	return h.Client.Bodies(roomID)
+}
@@ -0,0 +1,64 @@
+package bottest_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"github.com/ilikeorangutans/jarvis/pkg/bot/bottest"
+	"gotest.tools/assert"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	alice = id.UserID("@alice:example.com")
+	bob   = id.UserID("@bob:example.com")
+)
+
+func TestRoomModes(t *testing.T) {
+	h := bottest.New(t, bot.BotConfiguration{})
+	bot.AddAdminHandlers(h.Bot)
+	h.SetState(bottest.Room, alice, event.StateCreate, "", &event.CreateEventContent{Creator: alice})
+	h.Join(bottest.Room, alice, bob)
+
+	// group rooms ignore messages that don't mention the bot
+	eventID := h.Send(bottest.Room, bob, "room mode open")
+	assert.Equal(t, len(h.Client.Messages()), 0)
+	assert.Equal(t, h.Client.ReadMarker(bottest.Room), eventID)
+
+	h.Send(bottest.Room, bob, "jarvis: room mode open")
+	h.Send(bottest.Room, alice, "jarvis room mode open")
+	h.Send(bottest.Room, bob, "room mode")
+	assert.DeepEqual(t, h.Bodies(bottest.Room), []string{
+		"I'm afraid only room moderators (power level 50 or higher) can do that.",
+		"Very good, this room is now in open mode.",
+		"This room is in open mode.",
+	})
+
+	mode, err := h.Storage.LoadRoomMode(bottest.Room)
+	assert.NilError(t, err)
+	assert.Equal(t, mode, bot.RoomModeOpen)
+}
+
+func TestConfigEscapesRoomName(t *testing.T) {
+	h := bottest.New(t, bot.BotConfiguration{})
+	bot.AddAdminHandlers(h.Bot)
+	h.Join(bottest.Room, alice)
+	h.SetState(bottest.Room, alice, event.StateRoomName, "", &event.RoomNameEventContent{Name: "<b>Den</b>"})
+
+	h.Send(bottest.Room, alice, "config")
+	bodies := h.Bodies(bottest.Room)
+	assert.Equal(t, len(bodies), 1)
+	assert.Assert(t, strings.HasPrefix(bodies[0], "⚙️ Settings for <strong>&lt;b&gt;Den&lt;/b&gt;</strong>"), bodies[0])
+}
+
+func TestDirectChat(t *testing.T) {
+	h := bottest.New(t, bot.BotConfiguration{})
+	bot.AddAdminHandlers(h.Bot)
+	const direct = id.RoomID("!direct:example.com")
+	h.Join(direct, alice)
+
+	h.Send(direct, alice, "room mode")
+	assert.DeepEqual(t, h.Bodies(direct), []string{"This room is in auto mode."})
+}
@@ -0,0 +1,186 @@
+package bottest
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var _ bot.MatrixClient = &Client{}
+
+// Message is an event the bot sent.
+type Message struct {
+	RoomID  id.RoomID
+	EventID id.EventID
+	Type    event.Type
+	Content interface{}
+}
+
+// Body returns the text of a message, or its HTML if it has no plain text, or the key of a reaction.
+func (m Message) Body() string {
+	switch content := m.Content.(type) {
+	case *event.MessageEventContent:
+		if content.Body == "" {
+			return content.FormattedBody
+		}
+		return content.Body
+	case *event.ReactionEventContent:
+		return content.RelatesTo.Key
+	}
+	return ""
+}
+
+// NewClient returns a client that records what the bot sends instead of sending it.
+func NewClient() *Client {
+	return &Client{
+		members: make(map[id.RoomID][]id.UserID),
+		read:    make(map[id.RoomID]id.EventID),
+		sent:    make(map[id.EventID]bool),
+	}
+}
+
+// Client is a bot.MatrixClient that records messages, reactions, joins and leaves. Events it sends get IDs like
+// $sent1, and callbacks run before the send method returns.
+type Client struct {
+	lock     sync.Mutex
+	messages []Message
+	joined   []id.RoomID
+	left     []id.RoomID
+	members  map[id.RoomID][]id.UserID
+	read     map[id.RoomID]id.EventID
+	sent     map[id.EventID]bool
+	presence event.Presence
+}
+
+// Messages returns everything sent so far, in order.
+func (c *Client) Messages() []Message {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]Message(nil), c.messages...)
+}
+
+// Bodies returns the bodies of the messages sent to the room, in order.
+func (c *Client) Bodies(roomID id.RoomID) []string {
+	var bodies []string
+	for _, msg := range c.Messages() {
+		if msg.RoomID == roomID {
+			bodies = append(bodies, msg.Body())
+		}
+	}
+	return bodies
+}
+
+// Reset forgets the messages sent so far.
+func (c *Client) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.messages = nil
+}
+
+// Joined returns the rooms the bot joined, in order.
+func (c *Client) Joined() []id.RoomID {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]id.RoomID(nil), c.joined...)
+}
+
+// Left returns the rooms the bot left, in order.
+func (c *Client) Left() []id.RoomID {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]id.RoomID(nil), c.left...)
+}
+
+// ReadMarker returns the last event the bot marked as read in the room.
+func (c *Client) ReadMarker(roomID id.RoomID) id.EventID {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.read[roomID]
+}
+
+// Presence returns the presence the bot set last.
+func (c *Client) Presence() event.Presence {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.presence
+}
+
+// SetMembers sets who JoinedMembers says joined the room. Rooms without members count as direct chats.
+func (c *Client) SetMembers(roomID id.RoomID, members ...id.UserID) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.members[roomID] = members
+}
+
+func (c *Client) record(roomID id.RoomID, eventType event.Type, content interface{}) id.EventID {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	eventID := id.EventID(fmt.Sprintf("$sent%d", len(c.sent)+1))
+	c.sent[eventID] = true
+	c.messages = append(c.messages, Message{RoomID: roomID, EventID: eventID, Type: eventType, Content: content})
+	return eventID
+}
+
+func (c *Client) JoinRoomByID(roomID id.RoomID) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.joined = append(c.joined, roomID)
+}
+
+func (c *Client) LeaveRoom(roomID id.RoomID) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.left = append(c.left, roomID)
+}
+
+func (c *Client) SendText(roomID id.RoomID, message string) {
+	c.record(roomID, event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: message})
+}
+
+func (c *Client) SendHTML(roomID id.RoomID, message string) {
+	c.record(roomID, event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Format: event.FormatHTML, FormattedBody: message})
+}
+
+func (c *Client) SendNotice(roomID id.RoomID, message string) {
+	c.record(roomID, event.EventMessage, &event.MessageEventContent{MsgType: event.MsgNotice, Body: message})
+}
+
+func (c *Client) SetPresence(presence event.Presence) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.presence = presence
+}
+
+func (c *Client) SendReaction(roomID id.RoomID, eventID id.EventID, reaction string) {
+	c.record(roomID, event.EventReaction, &event.ReactionEventContent{
+		RelatesTo: event.RelatesTo{Type: event.RelAnnotation, EventID: eventID, Key: reaction},
+	})
+}
+
+func (c *Client) SendMessageEvent(roomID id.RoomID, eventType event.Type, content interface{}, sent func(id.EventID, error)) {
+	eventID := c.record(roomID, eventType, content)
+	if sent != nil {
+		sent(eventID, nil)
+	}
+}
+
+func (c *Client) MarkRead(roomID id.RoomID, eventID id.EventID) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.read[roomID] = eventID
+}
+
+func (c *Client) JoinedMembers(roomID id.RoomID) ([]id.UserID, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]id.UserID(nil), c.members[roomID]...), nil
+}
+
+func (c *Client) Sent(eventID id.EventID) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.sent[eventID]
+}
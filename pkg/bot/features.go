@@ -0,0 +1,91 @@
+package bot
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// featureKey is the room setting that enables or disables a feature.
+func featureKey(feature string) string {
+	return "feature." + feature
+}
+
+// UseSettings stores settings, including which features are enabled, in the given store. Without settings every
+// feature is enabled everywhere.
+func (b *Bot) UseSettings(settings *Settings) {
+	b.settings = settings
+}
+
+// Settings returns the settings store, or nil if the bot has none.
+func (b *Bot) Settings() *Settings {
+	return b.settings
+}
+
+// Feature registers the handlers added by register as part of the named feature, so rooms can disable them.
+// Features are enabled unless disabled for a room.
+func (b *Bot) Feature(name string, register func()) {
+	name = strings.ToLower(name)
+	b.feature = name
+	defer func() { b.feature = "" }()
+	register()
+
+	for _, f := range b.features {
+		if f == name {
+			return
+		}
+	}
+	b.features = append(b.features, name)
+	sort.Strings(b.features)
+}
+
+// Features returns the names of all registered features.
+func (b *Bot) Features() []string {
+	return b.features
+}
+
+func (b *Bot) hasFeature(name string) bool {
+	for _, f := range b.features {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// EnableFeature enables or disables a feature in the room.
+func (b *Bot) EnableFeature(roomID id.RoomID, feature string, enabled bool) error {
+	feature = strings.ToLower(feature)
+	if !b.hasFeature(feature) {
+		return fmt.Errorf("unknown feature %q", feature)
+	}
+	if b.settings == nil {
+		return fmt.Errorf("settings are not available")
+	}
+	if enabled {
+		return b.settings.Room(roomID).Delete(featureKey(feature))
+	}
+	return b.settings.Room(roomID).SetBool(featureKey(feature), false)
+}
+
+// DisabledFeatures returns the features disabled in the room.
+func (b *Bot) DisabledFeatures(roomID id.RoomID) (map[string]bool, error) {
+	disabled := make(map[string]bool)
+	if b.settings == nil || len(b.features) == 0 {
+		return disabled, nil
+	}
+	settings, err := b.settings.Room(roomID).All()
+	if err != nil {
+		return disabled, err
+	}
+	for _, feature := range b.features {
+		if value, ok := settings[featureKey(feature)]; ok {
+			enabled, err := strconv.ParseBool(value)
+			disabled[feature] = err == nil && !enabled
+		}
+	}
+	return disabled, nil
+}
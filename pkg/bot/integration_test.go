@@ -0,0 +1,222 @@
+package bot_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"github.com/ilikeorangutans/jarvis/pkg/bot/testserver"
+	"github.com/ilikeorangutans/jarvis/pkg/predicates"
+	"gotest.tools/assert"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	jarvis = id.UserID("@jarvis:example.com")
+	alice  = id.UserID("@alice:example.com")
+)
+
+// runBot logs in and runs a bot that answers ping with pong, until the returned function stops it and returns what Run
+// returned. Handlers can be added with register.
+func runBot(t *testing.T, server *testserver.Server, storage bot.BotStorage, register ...func(*bot.Bot)) (stop func() error) {
+	t.Helper()
+	homeserver, err := url.Parse(server.URL)
+	assert.NilError(t, err)
+	b, err := bot.NewBot(bot.BotConfiguration{Username: "jarvis", Password: "secret", HomeserverURL: homeserver}, storage)
+	assert.NilError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.NilError(t, b.Authenticate(ctx))
+	bot.AddInviteHandlers(b, bot.InvitePolicy{})
+	b.On(
+		func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			client.SendText(evt.RoomID, "pong")
+			return nil
+		},
+		predicates.MessageMatching(regexp.MustCompile(`^ping$`)),
+	)
+	for _, r := range register {
+		r(b)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- b.Run(ctx) }()
+	return func() error {
+		cancel()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(10 * time.Second):
+			return errors.New("bot did not stop")
+		}
+	}
+}
+
+func TestBotWithHomeserver(t *testing.T) {
+	server := testserver.New(t)
+	server.AddUser(jarvis, "secret", "Jarvis")
+	server.AddUser(alice, "secret", "Alice")
+	storage := bot.NewMemoryBotStorage()
+
+	room := server.CreateRoom(alice)
+	server.Invite(room, alice, jarvis)
+	stop := runBot(t, server, storage)
+
+	server.WaitFor(t, "presence", func() bool { return server.Presence(jarvis) == event.PresenceOnline })
+	server.WaitFor(t, "joining the room", func() bool { return server.Membership(room, jarvis) == event.MembershipJoin })
+	ping := server.Send(room, alice, "ping")
+	server.WaitFor(t, "pong", func() bool { return len(server.Messages(room, jarvis)) == 1 })
+	server.WaitFor(t, "read marker", func() bool { return server.ReadMarker(room, jarvis) == ping })
+	assert.NilError(t, stop())
+	assert.Equal(t, server.Presence(jarvis), event.PresenceOffline)
+
+	// after a restart the bot picks up where it left off, through rate limits
+	server.Send(room, alice, "ping")
+	server.LimitNext(testserver.EndpointPresence, 1)
+	server.LimitNext(testserver.EndpointSend, 2)
+	stop = runBot(t, server, storage)
+	defer func() { assert.NilError(t, stop()) }()
+
+	server.WaitFor(t, "presence", func() bool { return server.Presence(jarvis) == event.PresenceOnline })
+	server.WaitFor(t, "second pong", func() bool { return len(server.Messages(room, jarvis)) == 2 })
+	assert.Equal(t, server.Requests(testserver.EndpointSend), 4)
+
+	logins := server.Logins(jarvis)
+	assert.Equal(t, len(logins), 2)
+	assert.Equal(t, logins[1], logins[0])
+
+	rooms, err := storage.LoadJoinedRooms()
+	assert.NilError(t, err)
+	assert.Equal(t, len(rooms), 1)
+	assert.Equal(t, rooms[0].Inviter, alice)
+}
+
+func TestBotShutdown(t *testing.T) {
+	server := testserver.New(t)
+	server.AddUser(jarvis, "secret", "Jarvis")
+	server.AddUser(alice, "secret", "Alice")
+	room := server.CreateRoom(alice)
+	server.Invite(room, alice, jarvis)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	stop := runBot(t, server, bot.NewMemoryBotStorage(), func(b *bot.Bot) {
+		b.On(
+			func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+				close(started)
+				<-release
+				client.SendText(evt.RoomID, "done")
+				return nil
+			},
+			predicates.MessageMatching(regexp.MustCompile(`^slow$`)),
+		)
+		b.OnShutdown(func(ctx context.Context) {
+			// follow ups sent once the homeserver accepted an event go out before the bot stops, too
+			b.Client().SendMessageEvent(room, event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: "goodbye"}, func(id.EventID, error) {
+				b.Client().SendText(room, "see you")
+			})
+		})
+	})
+	server.WaitFor(t, "joining the room", func() bool { return server.Membership(room, jarvis) == event.MembershipJoin })
+
+	server.Send(room, alice, "slow")
+	<-started
+	// rate limits delay the message but don't drop it
+	server.LimitNext(testserver.EndpointSend, 2)
+	stopped := make(chan error, 1)
+	go func() { stopped <- stop() }()
+
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-stopped:
+		t.Fatal("bot stopped before its handler finished")
+	default:
+	}
+	close(release)
+	assert.NilError(t, <-stopped)
+	assert.DeepEqual(t, server.Messages(room, jarvis), []string{"done", "goodbye", "see you"})
+	assert.Equal(t, server.Presence(jarvis), event.PresenceOffline)
+}
+
+// failingStorage fails to store the sync position once fail is set.
+type failingStorage struct {
+	bot.BotStorage
+	fail int32
+}
+
+func (s *failingStorage) StoreNextBatch(userID id.UserID, nextBatchToken string) error {
+	if atomic.LoadInt32(&s.fail) == 1 {
+		return errors.New("disk full")
+	}
+	return s.BotStorage.StoreNextBatch(userID, nextBatchToken)
+}
+
+func TestBotStorageFailure(t *testing.T) {
+	server := testserver.New(t)
+	server.AddUser(jarvis, "secret", "Jarvis")
+	server.AddUser(alice, "secret", "Alice")
+	room := server.CreateRoom(alice)
+	server.Invite(room, alice, jarvis)
+
+	storage := &failingStorage{BotStorage: bot.NewMemoryBotStorage()}
+	stop := runBot(t, server, storage, func(b *bot.Bot) {
+		b.OnShutdown(func(ctx context.Context) { b.Client().SendText(room, "goodbye") })
+	})
+	server.WaitFor(t, "joining the room", func() bool { return server.Membership(room, jarvis) == event.MembershipJoin })
+
+	// the bot stops as if it was shut down, but reports why
+	atomic.StoreInt32(&storage.fail, 1)
+	server.Send(room, alice, "hello")
+	server.WaitFor(t, "presence", func() bool { return server.Presence(jarvis) == event.PresenceOffline })
+	assert.ErrorContains(t, stop(), "disk full")
+	assert.DeepEqual(t, server.Messages(room, jarvis), []string{"goodbye"})
+}
+
+func TestJoinedRoomsAtStartup(t *testing.T) {
+	server := testserver.New(t)
+	server.AddUser(jarvis, "secret", "Jarvis")
+	server.AddUser(alice, "secret", "Alice")
+	// joined before the bot kept a list of its rooms
+	room := server.CreateRoom(alice)
+	server.Join(room, jarvis)
+	storage := bot.NewMemoryBotStorage()
+	assert.NilError(t, storage.SaveJoinedRoom(bot.JoinedRoom{RoomID: "!gone:example.com", Inviter: alice, JoinedAt: time.Now()}))
+
+	stop := runBot(t, server, storage)
+	defer func() { assert.NilError(t, stop()) }()
+	server.WaitFor(t, "joined rooms", func() bool {
+		rooms, err := storage.LoadJoinedRooms()
+		return err == nil && len(rooms) == 1 && rooms[0].RoomID == room
+	})
+}
+
+func TestRoomStateAtStartup(t *testing.T) {
+	server := testserver.New(t)
+	server.AddUser(jarvis, "secret", "Jarvis")
+	server.AddUser(alice, "secret", "Alice")
+	room := server.CreateRoom(alice)
+	server.SetState(room, alice, event.StatePowerLevels, "", &event.PowerLevelsEventContent{
+		Users: map[id.UserID]int{alice: 100},
+	})
+	server.Join(room, jarvis)
+	synced := bot.NewMemoryBotStorage()
+	stop := runBot(t, server, synced)
+	server.WaitFor(t, "room state", func() bool { return bot.RoomState{Room: synced.LoadRoom(room)}.PowerLevel(alice) == 100 })
+	assert.NilError(t, stop())
+
+	// storage that knows where sync left off, but not the state of the room, like before state was tracked
+	storage := bot.NewMemoryBotStorage()
+	nextBatch, err := synced.NextBatch(jarvis)
+	assert.NilError(t, err)
+	assert.NilError(t, storage.StoreNextBatch(jarvis, nextBatch))
+	stop = runBot(t, server, storage)
+	defer func() { assert.NilError(t, stop()) }()
+	server.WaitFor(t, "room state", func() bool { return bot.RoomState{Room: storage.LoadRoom(room)}.PowerLevel(alice) == 100 })
+}
@@ -0,0 +1,199 @@
+package bot
+
+import (
+	"context"
+	"time"
+
+	"github.com/ilikeorangutans/jarvis/pkg/predicates"
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// InvitePolicy decides which invites the bot accepts.
+type InvitePolicy struct {
+	// AllowedUsers may always invite the bot.
+	AllowedUsers []id.UserID
+	// AllowedServers lists homeservers whose users may invite the bot. If neither users nor servers are configured,
+	// users on the bot's own homeserver may invite it.
+	AllowedServers []string
+	// Welcome is the HTML message posted after joining a room.
+	Welcome string
+}
+
+// Allows returns true if the inviter may invite the bot.
+func (p InvitePolicy) Allows(inviter, bot id.UserID) bool {
+	for _, userID := range p.AllowedUsers {
+		if userID == inviter {
+			return true
+		}
+	}
+
+	_, server, err := inviter.Parse()
+	if err != nil {
+		return false
+	}
+	servers := p.AllowedServers
+	if len(servers) == 0 && len(p.AllowedUsers) == 0 {
+		_, own, _ := bot.Parse()
+		servers = []string{own}
+	}
+	for _, s := range servers {
+		if s == server {
+			return true
+		}
+	}
+
+	return false
+}
+
+// membershipOf returns true for membership events concerning the user.
+func membershipOf(userID func() id.UserID, memberships ...event.Membership) predicates.EventPredicate {
+	return func(source mautrix.EventSource, evt *event.Event) bool {
+		if evt.Type.Type != event.StateMember.Type || evt.StateKey == nil {
+			return false
+		}
+		member, ok := evt.Content.Parsed.(*event.MemberEventContent)
+		if !ok {
+			return false
+		}
+		for _, m := range memberships {
+			if member.Membership == m {
+				return *evt.StateKey == userID().String()
+			}
+		}
+		return false
+	}
+}
+
+// AddInviteHandlers joins rooms on invites the policy allows and rejects all others. The bot leaves rooms once
+// everyone else left, and keeps the list of joined rooms in storage.
+func AddInviteHandlers(b *Bot, policy InvitePolicy) {
+	botID := func() id.UserID { return b.UserID }
+
+	b.On(
+		func(ctx context.Context, client MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			if !policy.Allows(evt.Sender, b.UserID) {
+				log.Warn().Stringer("inviter", evt.Sender).Stringer("room-id", evt.RoomID).Msg("rejecting invite")
+				client.LeaveRoom(evt.RoomID)
+				return nil
+			}
+
+			log.Info().Stringer("inviter", evt.Sender).Stringer("room-id", evt.RoomID).Msg("accepting invite")
+			client.JoinRoomByID(evt.RoomID)
+			if policy.Welcome != "" {
+				client.SendHTML(evt.RoomID, policy.Welcome)
+			}
+			return b.storage.SaveJoinedRoom(JoinedRoom{RoomID: evt.RoomID, Inviter: evt.Sender, JoinedAt: time.Now()})
+		},
+		predicates.InvitedToRoom(),
+		membershipOf(botID, event.MembershipInvite),
+	)
+
+	// someone else left, so we might be the last one here
+	b.On(
+		func(ctx context.Context, client MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			members, err := client.JoinedMembers(evt.RoomID)
+			if err != nil {
+				return err
+			}
+			for _, userID := range members {
+				if userID != b.UserID {
+					return nil
+				}
+			}
+
+			log.Info().Stringer("room-id", evt.RoomID).Msg("everyone left, leaving room")
+			client.LeaveRoom(evt.RoomID)
+			return b.storage.RemoveJoinedRoom(evt.RoomID)
+		},
+		predicates.OfType(event.StateMember),
+		predicates.Not(membershipOf(botID, event.MembershipLeave, event.MembershipBan)),
+		func(source mautrix.EventSource, evt *event.Event) bool {
+			member, ok := evt.Content.Parsed.(*event.MemberEventContent)
+			return ok && (member.Membership == event.MembershipLeave || member.Membership == event.MembershipBan)
+		},
+	)
+
+	// we were kicked or banned
+	b.On(
+		func(ctx context.Context, client MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			log.Info().Stringer("room-id", evt.RoomID).Stringer("by", evt.Sender).Msg("removed from room")
+			return b.storage.RemoveJoinedRoom(evt.RoomID)
+		},
+		membershipOf(botID, event.MembershipLeave, event.MembershipBan),
+	)
+}
+
+// reconcileJoinedRooms makes the stored list of joined rooms match the rooms the homeserver says we joined. Rooms
+// joined before the list was kept, or while membership events were missed, are added without an inviter; rooms we
+// are no longer in are removed. Joined rooms whose state is missing get it loaded.
+func (b *Bot) reconcileJoinedRooms(ctx context.Context) error {
+	var resp *mautrix.RespJoinedRooms
+	err := retryLimited(ctx, b.logger, func() (err error) {
+		resp, err = b.client.JoinedRooms()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	stored, err := b.storage.LoadJoinedRooms()
+	if err != nil {
+		return err
+	}
+
+	joined := make(map[id.RoomID]bool)
+	for _, roomID := range resp.JoinedRooms {
+		joined[roomID] = true
+	}
+	for _, room := range stored {
+		if joined[room.RoomID] {
+			delete(joined, room.RoomID)
+			continue
+		}
+		log.Info().Stringer("room-id", room.RoomID).Msg("no longer in room")
+		if err := b.storage.RemoveJoinedRoom(room.RoomID); err != nil {
+			return err
+		}
+	}
+	for _, roomID := range resp.JoinedRooms {
+		if err := b.loadMissingRoomState(ctx, roomID); err != nil {
+			return err
+		}
+		if !joined[roomID] {
+			continue
+		}
+		log.Info().Stringer("room-id", roomID).Msg("found joined room")
+		if err := b.storage.SaveJoinedRoom(JoinedRoom{RoomID: roomID, JoinedAt: time.Now()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadMissingRoomState asks the homeserver for the state of rooms we don't know the creation of, such as rooms joined
+// before room state was tracked. Sync only sends state that changed, so these rooms would otherwise lack power levels.
+func (b *Bot) loadMissingRoomState(ctx context.Context, roomID id.RoomID) error {
+	if b.storage.LoadRoom(roomID).GetStateEvent(event.StateCreate, "") != nil {
+		return nil
+	}
+	log.Info().Stringer("room-id", roomID).Msg("loading room state")
+	var state mautrix.RoomStateMap
+	err := retryLimited(ctx, b.logger, func() (err error) {
+		state, err = b.client.State(roomID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, events := range state {
+		for _, evt := range events {
+			evt.RoomID = roomID
+			if err := b.storage.UpdateRoomState(evt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
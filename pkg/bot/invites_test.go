@@ -0,0 +1,42 @@
+package bot
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestInvitePolicyAllows(t *testing.T) {
+	bot := id.UserID("@jarvis:example.com")
+
+	open := InvitePolicy{}
+	assert.Assert(t, open.Allows("@alice:example.com", bot))
+	assert.Assert(t, !open.Allows("@mallory:evil.com", bot))
+
+	policy := InvitePolicy{
+		AllowedUsers:   []id.UserID{"@bob:friends.org"},
+		AllowedServers: []string{"family.net"},
+	}
+	assert.Assert(t, policy.Allows("@bob:friends.org", bot))
+	assert.Assert(t, policy.Allows("@carol:family.net", bot))
+	assert.Assert(t, !policy.Allows("@dave:friends.org", bot))
+	assert.Assert(t, !policy.Allows("@alice:example.com", bot))
+	assert.Assert(t, !policy.Allows("not a user id", bot))
+}
+
+func TestMembershipOf(t *testing.T) {
+	stateKey := "@jarvis:example.com"
+	evt := &event.Event{
+		Type:     event.StateMember,
+		StateKey: &stateKey,
+		Content:  event.Content{Parsed: &event.MemberEventContent{Membership: event.MembershipInvite}},
+	}
+	bot := func() id.UserID { return "@jarvis:example.com" }
+	other := func() id.UserID { return "@alice:example.com" }
+
+	assert.Assert(t, membershipOf(bot, event.MembershipInvite)(0, evt))
+	assert.Assert(t, !membershipOf(bot, event.MembershipLeave)(0, evt))
+	assert.Assert(t, !membershipOf(other, event.MembershipInvite)(0, evt))
+}
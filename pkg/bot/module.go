@@ -0,0 +1,168 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/ilikeorangutans/jarvis/pkg/database"
+	"github.com/ilikeorangutans/jarvis/pkg/migrations"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/rs/zerolog/log"
+)
+
+// Module is a feature of the bot, like dice or reminders, with its own configuration, tables and lifecycle.
+type Module interface {
+	// Name identifies the module in configuration. It is also the feature rooms can disable.
+	Name() string
+	// Config returns a pointer to the module's configuration struct, or nil if the module has none. It is filled from
+	// environment variables prefixed with the module name, e.g. JARVIS_ALERTS_INTERVAL.
+	Config() interface{}
+	// Migrations returns the module's database migrations, or nil if it has none. Their versions are tracked
+	// separately from other modules.
+	Migrations() fs.FS
+	// Register adds the module's handlers to the bot.
+	Register(context.Context, *Bot) error
+	// Start runs once the bot is authenticated, e.g. to schedule jobs.
+	Start(context.Context) error
+	// Stop releases whatever Start acquired.
+	Stop(context.Context) error
+}
+
+// BaseModule implements the optional parts of Module. Embed it and implement Name and Register.
+type BaseModule struct{}
+
+func (BaseModule) Config() interface{}             { return nil }
+func (BaseModule) Migrations() fs.FS               { return nil }
+func (BaseModule) Start(ctx context.Context) error { return nil }
+func (BaseModule) Stop(ctx context.Context) error  { return nil }
+
+// ModuleRegistry knows all modules and which of them are enabled.
+type ModuleRegistry struct {
+	modules []Module
+	enabled []Module
+}
+
+// NewModuleRegistry returns a registry with all given modules enabled. Modules are registered and started in
+// order, so modules can depend on earlier ones.
+func NewModuleRegistry(modules ...Module) *ModuleRegistry {
+	return &ModuleRegistry{
+		modules: modules,
+		enabled: modules,
+	}
+}
+
+// Modules returns all known modules.
+func (r *ModuleRegistry) Modules() []Module {
+	return r.modules
+}
+
+// Enabled returns the enabled modules.
+func (r *ModuleRegistry) Enabled() []Module {
+	return r.enabled
+}
+
+// IsEnabled returns true if the named module is enabled.
+func (r *ModuleRegistry) IsEnabled(name string) bool {
+	for _, m := range r.enabled {
+		if strings.EqualFold(m.Name(), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Enable enables only the named modules. No names enables all modules.
+func (r *ModuleRegistry) Enable(names ...string) error {
+	if len(names) == 0 {
+		r.enabled = r.modules
+		return nil
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	var enabled []Module
+	for _, m := range r.modules {
+		if wanted[strings.ToLower(m.Name())] {
+			enabled = append(enabled, m)
+			delete(wanted, strings.ToLower(m.Name()))
+		}
+	}
+	for name := range wanted {
+		return fmt.Errorf("unknown module %q", name)
+	}
+
+	r.enabled = enabled
+	return nil
+}
+
+// Configure fills the configuration of the enabled modules from environment variables, see Module.Config.
+func (r *ModuleRegistry) Configure(prefix string) error {
+	for _, m := range r.enabled {
+		config := m.Config()
+		if config == nil {
+			continue
+		}
+		if err := envconfig.Process(fmt.Sprintf("%s_%s", prefix, m.Name()), config); err != nil {
+			return fmt.Errorf("could not configure module %s: %w", m.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Migrations returns the migrations of all modules for the dialect. Disabled modules are included, so tables other
+// modules depend on exist either way.
+func (r *ModuleRegistry) Migrations(dialect database.Dialect) []migrations.Set {
+	var sets []migrations.Set
+	for _, m := range r.modules {
+		if fsys := m.Migrations(); fsys != nil {
+			sets = append(sets, migrations.ForModule(m.Name(), fsys, dialect))
+		}
+	}
+	return sets
+}
+
+// Register registers the handlers of the enabled modules, each as a feature named after the module.
+func (r *ModuleRegistry) Register(ctx context.Context, b *Bot) error {
+	for _, m := range r.enabled {
+		var err error
+		b.Feature(m.Name(), func() {
+			err = m.Register(ctx, b)
+		})
+		if err != nil {
+			return fmt.Errorf("could not register module %s: %w", m.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Start starts the enabled modules.
+func (r *ModuleRegistry) Start(ctx context.Context) error {
+	for _, m := range r.enabled {
+		log.Info().Str("module", m.Name()).Msg("starting module")
+		if err := m.Start(ctx); err != nil {
+			return fmt.Errorf("could not start module %s: %w", m.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Stop stops the enabled modules in reverse order. All modules are stopped even if some fail; the first error is
+// returned.
+func (r *ModuleRegistry) Stop(ctx context.Context) error {
+	var first error
+	for i := len(r.enabled) - 1; i >= 0; i-- {
+		m := r.enabled[i]
+		log.Info().Str("module", m.Name()).Msg("stopping module")
+		if err := m.Stop(ctx); err != nil {
+			log.Error().Err(err).Str("module", m.Name()).Msg("could not stop module")
+			if first == nil {
+				first = fmt.Errorf("could not stop module %s: %w", m.Name(), err)
+			}
+		}
+	}
+	return first
+}
@@ -0,0 +1,75 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+type testModuleConfig struct {
+	Interval time.Duration
+}
+
+type testModule struct {
+	BaseModule
+	name    string
+	config  testModuleConfig
+	events  *[]string
+	stopErr error
+}
+
+func (m *testModule) Name() string        { return m.name }
+func (m *testModule) Config() interface{} { return &m.config }
+
+func (m *testModule) Register(ctx context.Context, b *Bot) error {
+	*m.events = append(*m.events, "register "+m.name)
+	b.On(nil)
+	return nil
+}
+
+func (m *testModule) Start(ctx context.Context) error {
+	*m.events = append(*m.events, "start "+m.name)
+	return nil
+}
+
+func (m *testModule) Stop(ctx context.Context) error {
+	*m.events = append(*m.events, "stop "+m.name)
+	return m.stopErr
+}
+
+func TestModuleRegistry(t *testing.T) {
+	var events []string
+	dice := &testModule{name: "dice", events: &events}
+	polls := &testModule{name: "polls", events: &events, stopErr: errors.New("boom")}
+	weather := &testModule{name: "weather", events: &events}
+	registry := NewModuleRegistry(dice, polls, weather)
+	assert.Assert(t, registry.IsEnabled("weather"))
+
+	assert.ErrorContains(t, registry.Enable("dice", "garage"), `unknown module "garage"`)
+	assert.NilError(t, registry.Enable("Weather", "dice"))
+	assert.Assert(t, registry.IsEnabled("weather"))
+	assert.Assert(t, !registry.IsEnabled("polls"))
+
+	os.Setenv("JARVIS_WEATHER_INTERVAL", "5m")
+	defer os.Unsetenv("JARVIS_WEATHER_INTERVAL")
+	assert.NilError(t, registry.Configure("jarvis"))
+	assert.Equal(t, weather.config.Interval, 5*time.Minute)
+	assert.Equal(t, dice.config.Interval, time.Duration(0))
+
+	b := &Bot{}
+	assert.NilError(t, registry.Register(context.Background(), b))
+	assert.DeepEqual(t, b.Features(), []string{"dice", "weather"})
+	assert.Equal(t, b.handlers[1].Feature, "weather")
+
+	ctx := context.Background()
+	assert.NilError(t, registry.Start(ctx))
+	assert.NilError(t, registry.Stop(ctx))
+	assert.DeepEqual(t, events, []string{"register dice", "register weather", "start dice", "start weather", "stop weather", "stop dice"})
+
+	assert.NilError(t, registry.Enable())
+	assert.ErrorContains(t, registry.Stop(ctx), "could not stop module polls: boom")
+}
@@ -0,0 +1,294 @@
+package bot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// MultiplexError collects the errors of several storers.
+type MultiplexError []error
+
+func (e MultiplexError) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Unwrap returns the collected errors so errors.Is and errors.As look at each of them.
+func (e MultiplexError) Unwrap() []error {
+	return e
+}
+
+// NewMultiplexStorage returns a storage that writes to all storers, e.g. to mirror sync state to a second database.
+// The first storer is the primary: reads go to it first and fall back to the next storer when it comes up empty. Reads
+// fail only if no storer had a value and at least one of them failed.
+func NewMultiplexStorage(primary BotStorage, mirrors ...BotStorage) *MultiplexStorage {
+	return &MultiplexStorage{
+		storers: append([]BotStorage{primary}, mirrors...),
+	}
+}
+
+type MultiplexStorage struct {
+	storers []BotStorage
+}
+
+// each calls f for every storer, and returns the errors of those that failed.
+func (m *MultiplexStorage) each(f func(BotStorage) error) error {
+	var errs MultiplexError
+	for i, s := range m.storers {
+		if err := f(s); err != nil {
+			errs = append(errs, fmt.Errorf("storer %d: %w", i, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// first returns the first value load returns that isn't empty.
+func (m *MultiplexStorage) first(load func(BotStorage) (string, error)) (string, error) {
+	var errs MultiplexError
+	for i, s := range m.storers {
+		value, err := load(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("storer %d: %w", i, err))
+			continue
+		}
+		if value != "" {
+			return value, nil
+		}
+	}
+	if len(errs) > 0 {
+		return "", errs
+	}
+	return "", nil
+}
+
+func (m *MultiplexStorage) SaveFilterID(userID id.UserID, filterID string) {
+	for _, s := range m.storers {
+		s.SaveFilterID(userID, filterID)
+	}
+}
+
+func (m *MultiplexStorage) LoadFilterID(userID id.UserID) string {
+	for _, s := range m.storers {
+		if filterID := s.LoadFilterID(userID); filterID != "" {
+			return filterID
+		}
+	}
+	return ""
+}
+
+func (m *MultiplexStorage) FilterID(userID id.UserID) (string, error) {
+	return m.first(func(s BotStorage) (string, error) { return s.FilterID(userID) })
+}
+
+func (m *MultiplexStorage) StoreFilterID(userID id.UserID, filterID string) error {
+	return m.each(func(s BotStorage) error { return s.StoreFilterID(userID, filterID) })
+}
+
+func (m *MultiplexStorage) SaveNextBatch(userID id.UserID, nextBatchToken string) {
+	for _, s := range m.storers {
+		s.SaveNextBatch(userID, nextBatchToken)
+	}
+}
+
+func (m *MultiplexStorage) LoadNextBatch(userID id.UserID) string {
+	for _, s := range m.storers {
+		if nextBatch := s.LoadNextBatch(userID); nextBatch != "" {
+			return nextBatch
+		}
+	}
+	return ""
+}
+
+func (m *MultiplexStorage) NextBatch(userID id.UserID) (string, error) {
+	return m.first(func(s BotStorage) (string, error) { return s.NextBatch(userID) })
+}
+
+func (m *MultiplexStorage) StoreNextBatch(userID id.UserID, nextBatchToken string) error {
+	return m.each(func(s BotStorage) error { return s.StoreNextBatch(userID, nextBatchToken) })
+}
+
+func (m *MultiplexStorage) SaveRoom(room *mautrix.Room) {
+	for _, s := range m.storers {
+		s.SaveRoom(room)
+	}
+}
+
+func (m *MultiplexStorage) LoadRoom(roomID id.RoomID) *mautrix.Room {
+	var first *mautrix.Room
+	for _, s := range m.storers {
+		room := s.LoadRoom(roomID)
+		if room != nil && len(room.State) > 0 {
+			return room
+		}
+		if first == nil {
+			first = room
+		}
+	}
+	return first
+}
+
+func (m *MultiplexStorage) LoadDeviceID() (id.DeviceID, error) {
+	deviceID, err := m.first(func(s BotStorage) (string, error) {
+		deviceID, err := s.LoadDeviceID()
+		return deviceID.String(), err
+	})
+	return id.DeviceID(deviceID), err
+}
+
+func (m *MultiplexStorage) StoreDeviceID(deviceID id.DeviceID) error {
+	return m.each(func(s BotStorage) error { return s.StoreDeviceID(deviceID) })
+}
+
+// LoadRoomMode returns the first mode that isn't the default RoomModeAuto, as storers return that for rooms they know
+// nothing about.
+func (m *MultiplexStorage) LoadRoomMode(roomID id.RoomID) (RoomMode, error) {
+	var errs MultiplexError
+	for i, s := range m.storers {
+		mode, err := s.LoadRoomMode(roomID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("storer %d: %w", i, err))
+			continue
+		}
+		if mode != RoomModeAuto {
+			return mode, nil
+		}
+	}
+	if len(errs) > 0 {
+		return RoomModeAuto, errs
+	}
+	return RoomModeAuto, nil
+}
+
+func (m *MultiplexStorage) StoreRoomMode(roomID id.RoomID, mode RoomMode) error {
+	return m.each(func(s BotStorage) error { return s.StoreRoomMode(roomID, mode) })
+}
+
+func (m *MultiplexStorage) SaveJoinedRoom(room JoinedRoom) error {
+	return m.each(func(s BotStorage) error { return s.SaveJoinedRoom(room) })
+}
+
+func (m *MultiplexStorage) RemoveJoinedRoom(roomID id.RoomID) error {
+	return m.each(func(s BotStorage) error { return s.RemoveJoinedRoom(roomID) })
+}
+
+func (m *MultiplexStorage) LoadJoinedRooms() ([]JoinedRoom, error) {
+	var errs MultiplexError
+	for i, s := range m.storers {
+		rooms, err := s.LoadJoinedRooms()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("storer %d: %w", i, err))
+			continue
+		}
+		if len(rooms) > 0 {
+			return rooms, nil
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return nil, nil
+}
+
+func (m *MultiplexStorage) UpdateRoomState(evt *event.Event) error {
+	return m.each(func(s BotStorage) error { return s.UpdateRoomState(evt) })
+}
+
+// Check compares what the storers hold for the user, and returns a MultiplexError listing every difference between
+// the primary and the mirrors, or nil if they agree.
+func (m *MultiplexStorage) Check(userID id.UserID) error {
+	primary := m.storers[0]
+	var errs MultiplexError
+	mismatch := func(i int, what string, got, want interface{}) {
+		errs = append(errs, fmt.Errorf("storer %d: %s is %v, primary has %v", i, what, got, want))
+	}
+
+	wantFilterID, err := primary.FilterID(userID)
+	if err != nil {
+		return fmt.Errorf("primary: %w", err)
+	}
+	wantNextBatch, err := primary.NextBatch(userID)
+	if err != nil {
+		return fmt.Errorf("primary: %w", err)
+	}
+	wantDeviceID, err := primary.LoadDeviceID()
+	if err != nil {
+		return fmt.Errorf("primary: %w", err)
+	}
+	wantRooms, err := joinedRoomIDs(primary)
+	if err != nil {
+		return fmt.Errorf("primary: %w", err)
+	}
+
+	for i, s := range m.storers[1:] {
+		i++
+		if got, err := s.FilterID(userID); err != nil {
+			errs = append(errs, fmt.Errorf("storer %d: %w", i, err))
+		} else if got != wantFilterID {
+			mismatch(i, "filter ID", got, wantFilterID)
+		}
+		if got, err := s.NextBatch(userID); err != nil {
+			errs = append(errs, fmt.Errorf("storer %d: %w", i, err))
+		} else if got != wantNextBatch {
+			mismatch(i, "next batch", got, wantNextBatch)
+		}
+		if got, err := s.LoadDeviceID(); err != nil {
+			errs = append(errs, fmt.Errorf("storer %d: %w", i, err))
+		} else if got != wantDeviceID {
+			mismatch(i, "device ID", got, wantDeviceID)
+		}
+
+		gotRooms, err := joinedRoomIDs(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("storer %d: %w", i, err))
+			continue
+		}
+		if strings.Join(gotRooms, ",") != strings.Join(wantRooms, ",") {
+			mismatch(i, "joined rooms", gotRooms, wantRooms)
+			continue
+		}
+		for _, roomID := range wantRooms {
+			got, err := s.LoadRoomMode(id.RoomID(roomID))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("storer %d: %w", i, err))
+				continue
+			}
+			want, err := primary.LoadRoomMode(id.RoomID(roomID))
+			if err != nil {
+				return fmt.Errorf("primary: %w", err)
+			}
+			if got != want {
+				mismatch(i, fmt.Sprintf("mode of %s", roomID), got, want)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// joinedRoomIDs returns the sorted IDs of the rooms the storage says the bot joined.
+func joinedRoomIDs(s BotStorage) ([]string, error) {
+	rooms, err := s.LoadJoinedRooms()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(rooms))
+	for i, room := range rooms {
+		ids[i] = room.RoomID.String()
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
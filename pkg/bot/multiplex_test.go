@@ -0,0 +1,72 @@
+package bot
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ilikeorangutans/jarvis/pkg/database/databasetest"
+	"github.com/ilikeorangutans/jarvis/pkg/migrations"
+	"github.com/rs/zerolog"
+	"gotest.tools/assert"
+	"maunium.net/go/mautrix/id"
+)
+
+func sqliteBotStorage(t *testing.T) BotStorage {
+	db := databasetest.SQLite(t)
+	if err := migrations.Up(db, migrations.Core(db.Dialect)); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := NewSQLBotStorage(db, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+var errBroken = errors.New("broken")
+
+// brokenStorage fails to store room modes and joined rooms.
+type brokenStorage struct {
+	BotStorage
+}
+
+func (brokenStorage) StoreRoomMode(id.RoomID, RoomMode) error { return errBroken }
+func (brokenStorage) SaveJoinedRoom(JoinedRoom) error         { return errBroken }
+
+func TestMultiplexStorage(t *testing.T) {
+	primary, mirror := sqliteBotStorage(t), sqliteBotStorage(t)
+	storage := NewMultiplexStorage(primary, mirror)
+	const userID = id.UserID("@jarvis:example.com")
+
+	storage.SaveNextBatch(userID, "s1")
+	assert.Equal(t, mirror.LoadNextBatch(userID), "s1")
+	assert.NilError(t, storage.SaveJoinedRoom(JoinedRoom{RoomID: "!den:example.com", JoinedAt: time.Now()}))
+	assert.NilError(t, storage.StoreRoomMode("!den:example.com", RoomModeOpen))
+	assert.NilError(t, storage.StoreDeviceID("DEVICE"))
+	assert.NilError(t, storage.Check(userID))
+
+	// reads fall back to the mirror when the primary comes up empty
+	mirror.SaveFilterID(userID, "filter")
+	assert.Equal(t, storage.LoadFilterID(userID), "filter")
+	assert.NilError(t, mirror.StoreRoomMode("!lab:example.com", RoomModeMention))
+	mode, err := storage.LoadRoomMode("!lab:example.com")
+	assert.NilError(t, err)
+	assert.Equal(t, mode, RoomModeMention)
+
+	err = storage.Check(userID)
+	var mismatches MultiplexError
+	assert.Assert(t, errors.As(err, &mismatches))
+	assert.Equal(t, len(mismatches), 1)
+	assert.ErrorContains(t, err, "filter ID is filter, primary has ")
+
+	// writes reach every storer, even if one of them fails
+	broken := NewMultiplexStorage(brokenStorage{primary}, mirror)
+	err = broken.SaveJoinedRoom(JoinedRoom{RoomID: "!lab:example.com", JoinedAt: time.Now()})
+	assert.Assert(t, errors.Is(err, errBroken))
+	rooms, err := mirror.LoadJoinedRooms()
+	assert.NilError(t, err)
+	assert.Equal(t, len(rooms), 2)
+	err = storage.Check(userID)
+	assert.ErrorContains(t, err, "joined rooms is [!den:example.com !lab:example.com], primary has [!den:example.com]")
+}
@@ -0,0 +1,117 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/ilikeorangutans/jarvis/pkg/predicates"
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ReactionCallback is called for a reaction to a watched event with the payload given to Watch.
+type ReactionCallback func(ctx context.Context, client MatrixClient, evt *event.Event, payload string) error
+
+// ReactionWatch links reactions to an event with a named callback.
+type ReactionWatch struct {
+	EventID id.EventID `db:"event_id"`
+	// Key is the reaction to watch for, or empty for any reaction.
+	Key       string
+	Room      id.RoomID
+	Name      string
+	Payload   string
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// NewReactionRegistry returns a registry of reaction watches. Watches are persisted and refer to callbacks by
+// name, so they survive restarts as long as the callbacks are registered again with Handle on startup.
+func NewReactionRegistry(db sqlx.Ext) *ReactionRegistry {
+	return &ReactionRegistry{
+		db:        db,
+		callbacks: make(map[string]ReactionCallback),
+	}
+}
+
+type ReactionRegistry struct {
+	db        sqlx.Ext
+	lock      sync.RWMutex
+	callbacks map[string]ReactionCallback
+}
+
+// Handle registers the callback for watches with the given name.
+func (r *ReactionRegistry) Handle(name string, callback ReactionCallback) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.callbacks[name] = callback
+}
+
+// Watch calls the named callback when someone reacts with key to the event. An empty key matches any reaction.
+func (r *ReactionRegistry) Watch(ctx context.Context, roomID id.RoomID, eventID id.EventID, key, name, payload string) error {
+	key = predicates.ReactionKey(key)
+	_, err := sq.
+		Insert("reaction_watches").
+		Columns("event_id", "key", "room", "name", "payload", "created_at").
+		Values(eventID, key, roomID, name, payload, time.Now()).
+		Suffix("on conflict (event_id, key) do update set name = ?, payload = ?", name, payload).
+		RunWith(r.db).
+		ExecContext(ctx)
+	if err != nil {
+		return fmt.Errorf("could not save reaction watch: %w", err)
+	}
+	return nil
+}
+
+// Unwatch removes all watches on the event.
+func (r *ReactionRegistry) Unwatch(ctx context.Context, eventID id.EventID) error {
+	_, err := sq.Delete("reaction_watches").Where(sq.Eq{"event_id": eventID}).RunWith(r.db).ExecContext(ctx)
+	return err
+}
+
+// Watches returns the watches matching a reaction with key to the event.
+func (r *ReactionRegistry) Watches(ctx context.Context, eventID id.EventID, key string) ([]ReactionWatch, error) {
+	var watches []ReactionWatch
+	query, args := sq.
+		Select("*").
+		From("reaction_watches").
+		Where(sq.Eq{"event_id": eventID, "key": []string{"", predicates.ReactionKey(key)}}).
+		MustSql()
+	if err := sqlx.Select(r.db, &watches, query, args...); err != nil {
+		return nil, err
+	}
+	return watches, nil
+}
+
+// Dispatch is an EventHandler calling the callbacks of all watches matching a reaction.
+func (r *ReactionRegistry) Dispatch(ctx context.Context, client MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+	relatesTo := evt.Content.AsReaction().RelatesTo
+	watches, err := r.Watches(ctx, relatesTo.EventID, relatesTo.Key)
+	if err != nil {
+		return fmt.Errorf("could not load reaction watches: %w", err)
+	}
+
+	for _, watch := range watches {
+		r.lock.RLock()
+		callback, ok := r.callbacks[watch.Name]
+		r.lock.RUnlock()
+		if !ok {
+			log.Warn().Str("name", watch.Name).Str("event-id", watch.EventID.String()).Msg("no callback registered for reaction watch")
+			continue
+		}
+		if err := callback(ctx, client, evt, watch.Payload); err != nil {
+			log.Error().Err(err).Str("name", watch.Name).Msg("reaction callback failed")
+		}
+	}
+
+	return nil
+}
+
+// AddReactionHandlers dispatches reactions to the registry.
+func AddReactionHandlers(b *Bot, registry *ReactionRegistry) {
+	b.On(registry.Dispatch, predicates.Reaction())
+}
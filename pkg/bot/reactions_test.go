@@ -0,0 +1,80 @@
+package bot_test
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"github.com/ilikeorangutans/jarvis/pkg/bot/bottest"
+	"github.com/ilikeorangutans/jarvis/pkg/database"
+	"github.com/ilikeorangutans/jarvis/pkg/database/databasetest"
+	"gotest.tools/assert"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestReactionRegistry(t *testing.T) {
+	databasetest.Migrated(t, databasetest.Core, testReactionRegistry)
+}
+
+func testReactionRegistry(t *testing.T, db *database.DB) {
+	ctx := context.Background()
+	const room = id.RoomID("!room:example.com")
+
+	watching := bot.NewReactionRegistry(db)
+	assert.NilError(t, watching.Watch(ctx, room, "$poll", "👍", "vote", "yes"))
+	assert.NilError(t, watching.Watch(ctx, room, "$poll", "", "any", "poll"))
+	assert.NilError(t, watching.Watch(ctx, room, "$orphan", "", "unknown", "orphan"))
+
+	// watches outlive the registry, callbacks are registered again on startup
+	registry := bot.NewReactionRegistry(db)
+	var calls []string
+	record := func(ctx context.Context, client bot.MatrixClient, evt *event.Event, payload string) error {
+		calls = append(calls, evt.Content.AsReaction().RelatesTo.Key+" "+payload)
+		return nil
+	}
+	registry.Handle("vote", record)
+	registry.Handle("any", record)
+	client := bottest.NewClient()
+	react := func(eventID id.EventID, key string) {
+		t.Helper()
+		calls = nil
+		evt := &event.Event{
+			RoomID: room,
+			Sender: "@alice:example.com",
+			Type:   event.EventReaction,
+			Content: event.Content{Parsed: &event.ReactionEventContent{
+				RelatesTo: event.RelatesTo{Type: event.RelAnnotation, EventID: eventID, Key: key},
+			}},
+		}
+		assert.NilError(t, registry.Dispatch(ctx, client, mautrix.EventSourceTimeline, evt))
+		sort.Strings(calls)
+	}
+
+	react("$poll", "👍")
+	assert.DeepEqual(t, calls, []string{"👍 poll", "👍 yes"})
+
+	// an empty key matches any reaction
+	react("$poll", "👎")
+	assert.DeepEqual(t, calls, []string{"👎 poll"})
+	watches, err := registry.Watches(ctx, "$poll", "👎")
+	assert.NilError(t, err)
+	assert.Equal(t, len(watches), 1)
+	assert.Equal(t, watches[0].Name, "any")
+
+	// watches without a callback are skipped
+	react("$orphan", "👍")
+	assert.Equal(t, len(calls), 0)
+
+	react("$other", "👍")
+	assert.Equal(t, len(calls), 0)
+
+	assert.NilError(t, registry.Unwatch(ctx, "$poll"))
+	react("$poll", "👍")
+	assert.Equal(t, len(calls), 0)
+	watches, err = registry.Watches(ctx, "$orphan", "")
+	assert.NilError(t, err)
+	assert.Equal(t, len(watches), 1)
+}
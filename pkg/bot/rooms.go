@@ -0,0 +1,72 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// RoomMode decides which messages in a room the bot treats as commands.
+type RoomMode string
+
+const (
+	// RoomModeAuto treats every message in direct chats as a command, and requires a mention in group rooms.
+	RoomModeAuto RoomMode = "auto"
+	// RoomModeOpen treats every message as a command.
+	RoomModeOpen RoomMode = "open"
+	// RoomModeMention requires a mention or the command prefix.
+	RoomModeMention RoomMode = "mention"
+)
+
+func ParseRoomMode(s string) (RoomMode, error) {
+	switch mode := RoomMode(strings.ToLower(s)); mode {
+	case RoomModeAuto, RoomModeOpen, RoomModeMention:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown room mode %q", s)
+	}
+}
+
+// IsDirect returns true if the room is a direct chat, that is no one but the bot and one other user joined it.
+// Member counts are cached until the membership of the room changes.
+func (b *Bot) IsDirect(roomID id.RoomID) bool {
+	b.directLock.Lock()
+	defer b.directLock.Unlock()
+
+	if direct, ok := b.direct[roomID]; ok {
+		return direct
+	}
+
+	members, err := b.matrix.JoinedMembers(roomID)
+	if err != nil {
+		b.logger.Error().Err(err).Stringer("room-id", roomID).Msg("could not load joined members")
+		return false
+	}
+	direct := len(members) <= 2
+	b.direct[roomID] = direct
+	return direct
+}
+
+func (b *Bot) forgetMembers(roomID id.RoomID) {
+	b.directLock.Lock()
+	defer b.directLock.Unlock()
+	delete(b.direct, roomID)
+}
+
+// acceptsUnaddressed returns true if messages in the room are commands even if they don't address the bot.
+func (b *Bot) acceptsUnaddressed(roomID id.RoomID) bool {
+	mode, err := b.storage.LoadRoomMode(roomID)
+	if err != nil {
+		b.logger.Error().Err(err).Stringer("room-id", roomID).Msg("could not load room mode")
+	}
+
+	switch mode {
+	case RoomModeOpen:
+		return true
+	case RoomModeMention:
+		return false
+	default:
+		return b.IsDirect(roomID)
+	}
+}
@@ -0,0 +1,99 @@
+package bot
+
+import (
+	"fmt"
+	"html"
+	"sort"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// RoomMember is a user's membership in a room.
+type RoomMember struct {
+	UserID      id.UserID
+	DisplayName string
+	Membership  event.Membership
+}
+
+// Name returns the display name, or the localpart if the member has none.
+func (m RoomMember) Name() string {
+	if m.DisplayName != "" {
+		return m.DisplayName
+	}
+	localpart, _, err := m.UserID.Parse()
+	if err != nil {
+		return m.UserID.String()
+	}
+	return localpart
+}
+
+// RoomState answers questions about a room from its tracked state events.
+type RoomState struct {
+	*mautrix.Room
+}
+
+// RoomState returns the state of the room as seen during sync.
+func (b *Bot) RoomState(roomID id.RoomID) RoomState {
+	return RoomState{Room: b.storage.LoadRoom(roomID)}
+}
+
+// Name returns the room's name or canonical alias, or an empty string if it has neither.
+func (r RoomState) Name() string {
+	if evt := r.GetStateEvent(event.StateRoomName, ""); evt != nil {
+		if name := evt.Content.AsRoomName().Name; name != "" {
+			return name
+		}
+	}
+	if evt := r.GetStateEvent(event.StateCanonicalAlias, ""); evt != nil {
+		return evt.Content.AsCanonicalAlias().Alias.String()
+	}
+	return ""
+}
+
+// Member returns the user's membership; users we know nothing about have left.
+func (r RoomState) Member(userID id.UserID) RoomMember {
+	member := RoomMember{UserID: userID, Membership: event.MembershipLeave}
+	if evt := r.GetStateEvent(event.StateMember, userID.String()); evt != nil {
+		content := evt.Content.AsMember()
+		member.DisplayName = content.Displayname
+		member.Membership = content.Membership
+	}
+	return member
+}
+
+// Members returns the joined members, ordered by user ID.
+func (r RoomState) Members() []RoomMember {
+	var members []RoomMember
+	for stateKey := range r.State[event.StateMember] {
+		member := r.Member(id.UserID(stateKey))
+		if member.Membership == event.MembershipJoin {
+			members = append(members, member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].UserID < members[j].UserID })
+	return members
+}
+
+// PowerLevel returns the user's power level, following the defaults of the spec when the room has no power levels.
+func (r RoomState) PowerLevel(userID id.UserID) int {
+	evt := r.GetStateEvent(event.StatePowerLevels, "")
+	if evt == nil {
+		if create := r.GetStateEvent(event.StateCreate, ""); create != nil && create.Sender == userID {
+			return 100
+		}
+		return 0
+	}
+	return evt.Content.AsPowerLevels().GetUserLevel(userID)
+}
+
+// Encrypted returns true if end-to-end encryption is enabled in the room.
+func (r RoomState) Encrypted() bool {
+	return r.GetStateEvent(event.StateEncryption, "") != nil
+}
+
+// Mention returns an HTML pill for the user, showing their display name in this room.
+func (r RoomState) Mention(userID id.UserID) string {
+	return fmt.Sprintf(`<a href="https://matrix.to/#/%s">%s</a>`, userID, html.EscapeString(r.Member(userID).Name()))
+}
@@ -0,0 +1,49 @@
+package bot
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func stateEvent(t event.Type, stateKey string, sender id.UserID, content interface{}) *event.Event {
+	return &event.Event{Type: t, StateKey: &stateKey, Sender: sender, Content: event.Content{Parsed: content}}
+}
+
+func TestRoomState(t *testing.T) {
+	room := RoomState{Room: mautrix.NewRoom("!room:example.com")}
+	assert.Equal(t, room.Name(), "")
+	assert.Equal(t, room.PowerLevel("@alice:example.com"), 0)
+
+	room.UpdateState(stateEvent(event.StateCreate, "", "@alice:example.com", &event.CreateEventContent{}))
+	assert.Equal(t, room.PowerLevel("@alice:example.com"), 100)
+
+	room.UpdateState(stateEvent(event.StateCanonicalAlias, "", "@alice:example.com", &event.CanonicalAliasEventContent{Alias: "#den:example.com"}))
+	assert.Equal(t, room.Name(), "#den:example.com")
+	room.UpdateState(stateEvent(event.StateRoomName, "", "@alice:example.com", &event.RoomNameEventContent{Name: "The Den"}))
+	assert.Equal(t, room.Name(), "The Den")
+
+	room.UpdateState(stateEvent(event.StateMember, "@alice:example.com", "@alice:example.com", &event.MemberEventContent{Membership: event.MembershipJoin, Displayname: "Alice"}))
+	room.UpdateState(stateEvent(event.StateMember, "@bob:example.com", "@bob:example.com", &event.MemberEventContent{Membership: event.MembershipJoin}))
+	room.UpdateState(stateEvent(event.StateMember, "@carol:example.com", "@carol:example.com", &event.MemberEventContent{Membership: event.MembershipLeave}))
+	assert.DeepEqual(t, room.Members(), []RoomMember{
+		{UserID: "@alice:example.com", DisplayName: "Alice", Membership: event.MembershipJoin},
+		{UserID: "@bob:example.com", Membership: event.MembershipJoin},
+	})
+	assert.Equal(t, room.Member("@dave:example.com").Membership, event.MembershipLeave)
+	assert.Equal(t, room.Mention("@bob:example.com"), `<a href="https://matrix.to/#/@bob:example.com">bob</a>`)
+	assert.Equal(t, room.Mention("@alice:example.com"), `<a href="https://matrix.to/#/@alice:example.com">Alice</a>`)
+
+	room.UpdateState(stateEvent(event.StatePowerLevels, "", "@alice:example.com", &event.PowerLevelsEventContent{
+		Users: map[id.UserID]int{"@alice:example.com": 100, "@bob:example.com": 50},
+	}))
+	assert.Equal(t, room.PowerLevel("@bob:example.com"), 50)
+	assert.Equal(t, room.PowerLevel("@carol:example.com"), 0)
+
+	assert.Assert(t, !room.Encrypted())
+	room.UpdateState(stateEvent(event.StateEncryption, "", "@alice:example.com", &event.EncryptionEventContent{}))
+	assert.Assert(t, room.Encrypted())
+}
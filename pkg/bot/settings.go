@@ -0,0 +1,170 @@
+package bot
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"maunium.net/go/mautrix/id"
+)
+
+// SettingsScope is what a setting applies to.
+type SettingsScope string
+
+const (
+	RoomScope SettingsScope = "room"
+	UserScope SettingsScope = "user"
+)
+
+// Settings stores string values per room and per user.
+type Settings struct {
+	db sqlx.Ext
+}
+
+func NewSettings(db sqlx.Ext) *Settings {
+	return &Settings{db: db}
+}
+
+// Room returns the settings of the room.
+func (s *Settings) Room(roomID id.RoomID) ScopedSettings {
+	return ScopedSettings{settings: s, scope: RoomScope, scopeID: roomID.String()}
+}
+
+// User returns the settings of the user.
+func (s *Settings) User(userID id.UserID) ScopedSettings {
+	return ScopedSettings{settings: s, scope: UserScope, scopeID: userID.String()}
+}
+
+// Get returns the value of the setting and whether it is set at all.
+func (s *Settings) Get(scope SettingsScope, scopeID, key string) (string, bool, error) {
+	var value string
+	err := sqlx.Get(s.db, &value, "select value from settings where scope = ? and scope_id = ? and key = ?", scope, scopeID, key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, fmt.Errorf("could not load setting %s: %w", key, err)
+	}
+	return value, true, nil
+}
+
+func (s *Settings) Set(scope SettingsScope, scopeID, key, value string) error {
+	_, err := sq.
+		Insert("settings").
+		Columns("scope", "scope_id", "key", "value").
+		Values(scope, scopeID, key, value).
+		Suffix("on conflict (scope, scope_id, key) do update set value = ?", value).
+		RunWith(s.db).
+		Exec()
+	if err != nil {
+		return fmt.Errorf("could not save setting %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *Settings) Delete(scope SettingsScope, scopeID, key string) error {
+	_, err := sq.
+		Delete("settings").
+		Where(sq.Eq{"scope": scope, "scope_id": scopeID, "key": key}).
+		RunWith(s.db).
+		Exec()
+	if err != nil {
+		return fmt.Errorf("could not delete setting %s: %w", key, err)
+	}
+	return nil
+}
+
+// All returns every setting in the scope.
+func (s *Settings) All(scope SettingsScope, scopeID string) (map[string]string, error) {
+	var rows []struct {
+		Key   string
+		Value string
+	}
+	if err := sqlx.Select(s.db, &rows, "select key, value from settings where scope = ? and scope_id = ? order by key", scope, scopeID); err != nil {
+		return nil, fmt.Errorf("could not load settings: %w", err)
+	}
+	settings := make(map[string]string, len(rows))
+	for _, row := range rows {
+		settings[row.Key] = row.Value
+	}
+	return settings, nil
+}
+
+// ScopedSettings are the settings of a single room or user, with typed accessors. The accessors return the default
+// if a setting is not set.
+type ScopedSettings struct {
+	settings *Settings
+	scope    SettingsScope
+	scopeID  string
+}
+
+func (s ScopedSettings) String(key, def string) (string, error) {
+	value, ok, err := s.settings.Get(s.scope, s.scopeID, key)
+	if err != nil || !ok {
+		return def, err
+	}
+	return value, nil
+}
+
+func (s ScopedSettings) Bool(key string, def bool) (bool, error) {
+	value, ok, err := s.settings.Get(s.scope, s.scopeID, key)
+	if err != nil || !ok {
+		return def, err
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return def, fmt.Errorf("setting %s is not a boolean: %w", key, err)
+	}
+	return b, nil
+}
+
+func (s ScopedSettings) Int(key string, def int) (int, error) {
+	value, ok, err := s.settings.Get(s.scope, s.scopeID, key)
+	if err != nil || !ok {
+		return def, err
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return def, fmt.Errorf("setting %s is not a number: %w", key, err)
+	}
+	return i, nil
+}
+
+func (s ScopedSettings) Duration(key string, def time.Duration) (time.Duration, error) {
+	value, ok, err := s.settings.Get(s.scope, s.scopeID, key)
+	if err != nil || !ok {
+		return def, err
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return def, fmt.Errorf("setting %s is not a duration: %w", key, err)
+	}
+	return d, nil
+}
+
+func (s ScopedSettings) SetString(key, value string) error {
+	return s.settings.Set(s.scope, s.scopeID, key, value)
+}
+
+func (s ScopedSettings) SetBool(key string, value bool) error {
+	return s.settings.Set(s.scope, s.scopeID, key, strconv.FormatBool(value))
+}
+
+func (s ScopedSettings) SetInt(key string, value int) error {
+	return s.settings.Set(s.scope, s.scopeID, key, strconv.Itoa(value))
+}
+
+func (s ScopedSettings) SetDuration(key string, value time.Duration) error {
+	return s.settings.Set(s.scope, s.scopeID, key, value.String())
+}
+
+func (s ScopedSettings) Delete(key string) error {
+	return s.settings.Delete(s.scope, s.scopeID, key)
+}
+
+func (s ScopedSettings) All() (map[string]string, error) {
+	return s.settings.All(s.scope, s.scopeID)
+}
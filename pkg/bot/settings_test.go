@@ -0,0 +1,88 @@
+package bot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ilikeorangutans/jarvis/pkg/database"
+	"github.com/ilikeorangutans/jarvis/pkg/database/databasetest"
+	"gotest.tools/assert"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestSettings(t *testing.T) {
+	databasetest.Migrated(t, databasetest.Core, testSettings)
+}
+
+func testSettings(t *testing.T, db *database.DB) {
+	settings := NewSettings(db)
+	room := settings.Room("!room:example.com")
+
+	s, err := room.String("greeting", "hello")
+	assert.NilError(t, err)
+	assert.Equal(t, s, "hello")
+
+	assert.NilError(t, room.SetString("greeting", "howdy"))
+	assert.NilError(t, room.SetBool("quiet", true))
+	assert.NilError(t, room.SetInt("limit", 3))
+	assert.NilError(t, room.SetDuration("snooze", 90*time.Minute))
+
+	s, err = room.String("greeting", "hello")
+	assert.NilError(t, err)
+	assert.Equal(t, s, "howdy")
+	b, err := room.Bool("quiet", false)
+	assert.NilError(t, err)
+	assert.Assert(t, b)
+	i, err := room.Int("limit", 1)
+	assert.NilError(t, err)
+	assert.Equal(t, i, 3)
+	d, err := room.Duration("snooze", time.Minute)
+	assert.NilError(t, err)
+	assert.Equal(t, d, 90*time.Minute)
+
+	_, err = room.Int("greeting", 1)
+	assert.ErrorContains(t, err, "not a number")
+
+	// users and rooms don't share settings
+	s, err = settings.User("@alice:example.com").String("greeting", "hello")
+	assert.NilError(t, err)
+	assert.Equal(t, s, "hello")
+
+	assert.NilError(t, room.Delete("greeting"))
+	all, err := room.All()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, all, map[string]string{"limit": "3", "quiet": "true", "snooze": "1h30m0s"})
+}
+
+func TestFeatures(t *testing.T) {
+	databasetest.Migrated(t, databasetest.Core, testFeatures)
+}
+
+func testFeatures(t *testing.T, db *database.DB) {
+	b := &Bot{}
+	b.UseSettings(NewSettings(db))
+	b.Feature("Dice", func() {
+		b.On(nil)
+	})
+	b.On(nil)
+	assert.Equal(t, b.handlers[0].Feature, "dice")
+	assert.Equal(t, b.handlers[1].Feature, "")
+	assert.DeepEqual(t, b.Features(), []string{"dice"})
+
+	roomID := id.RoomID("!room:example.com")
+	assert.NilError(t, b.EnableFeature(roomID, "dice", false))
+	disabled, err := b.DisabledFeatures(roomID)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, disabled, map[string]bool{"dice": true})
+
+	disabled, err = b.DisabledFeatures("!other:example.com")
+	assert.NilError(t, err)
+	assert.Equal(t, len(disabled), 0)
+
+	assert.NilError(t, b.EnableFeature(roomID, "DICE", true))
+	disabled, err = b.DisabledFeatures(roomID)
+	assert.NilError(t, err)
+	assert.Equal(t, len(disabled), 0)
+
+	assert.ErrorContains(t, b.EnableFeature(roomID, "garage", false), "unknown feature")
+}
@@ -1,76 +1,221 @@
 package bot
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rs/zerolog"
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
+var storageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "jarvis_bot_storage_errors_total",
+	Help: "Bot storage operations that failed.",
+}, []string{"method"})
+
+// BotStorage keeps the bot's sync state and rooms. Loading something that was never stored returns its zero value and
+// no error, so errors always mean the storage failed.
 type BotStorage interface {
 	mautrix.Storer
+	// FilterID is LoadFilterID, reporting failures instead of returning an empty ID.
+	FilterID(id.UserID) (string, error)
+	// StoreFilterID is SaveFilterID, reporting failures.
+	StoreFilterID(id.UserID, string) error
+	// NextBatch is LoadNextBatch, reporting failures instead of returning an empty token.
+	NextBatch(id.UserID) (string, error)
+	// StoreNextBatch is SaveNextBatch, reporting failures.
+	StoreNextBatch(id.UserID, string) error
 	LoadDeviceID() (id.DeviceID, error)
 	StoreDeviceID(id.DeviceID) error
+	LoadRoomMode(id.RoomID) (RoomMode, error)
+	StoreRoomMode(id.RoomID, RoomMode) error
+	SaveJoinedRoom(JoinedRoom) error
+	RemoveJoinedRoom(id.RoomID) error
+	LoadJoinedRooms() ([]JoinedRoom, error)
+	// UpdateRoomState records a single state event, replacing the previous event of the same type and state key.
+	UpdateRoomState(*event.Event) error
+}
+
+// JoinedRoom is a room the bot joined and who invited it.
+type JoinedRoom struct {
+	RoomID   id.RoomID `db:"room_id"`
+	Inviter  id.UserID
+	JoinedAt time.Time `db:"joined_at"`
 }
 
-func NewMultiplexStorage(storers ...BotStorage) BotStorage {
-	return &MultiplexStorage{
-		storers: storers,
+// NewMemoryBotStorage returns a storage that keeps everything in memory, e.g. for tests.
+func NewMemoryBotStorage() BotStorage {
+	return &memoryBotStorage{
+		filterIDs:   make(map[id.UserID]string),
+		nextBatches: make(map[id.UserID]string),
+		roomModes:   make(map[id.RoomID]RoomMode),
+		joinedRooms: make(map[id.RoomID]JoinedRoom),
+		rooms:       make(map[id.RoomID]*mautrix.Room),
 	}
 }
 
-type MultiplexStorage struct {
-	storers []BotStorage
+type memoryBotStorage struct {
+	lock        sync.Mutex
+	filterIDs   map[id.UserID]string
+	nextBatches map[id.UserID]string
+	deviceID    id.DeviceID
+	roomModes   map[id.RoomID]RoomMode
+	joinedRooms map[id.RoomID]JoinedRoom
+	rooms       map[id.RoomID]*mautrix.Room
 }
 
-func (m *MultiplexStorage) SaveFilterID(userID id.UserID, filterID string) {
-	for _, s := range m.storers {
-		s.SaveFilterID(userID, filterID)
-	}
+func (s *memoryBotStorage) SaveFilterID(userID id.UserID, filterID string) {
+	s.StoreFilterID(userID, filterID)
+}
+
+func (s *memoryBotStorage) StoreFilterID(userID id.UserID, filterID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.filterIDs[userID] = filterID
+	return nil
+}
+
+func (s *memoryBotStorage) LoadFilterID(userID id.UserID) string {
+	filterID, _ := s.FilterID(userID)
+	return filterID
+}
+
+func (s *memoryBotStorage) FilterID(userID id.UserID) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.filterIDs[userID], nil
+}
+
+func (s *memoryBotStorage) SaveNextBatch(userID id.UserID, nextBatchToken string) {
+	s.StoreNextBatch(userID, nextBatchToken)
+}
+
+func (s *memoryBotStorage) StoreNextBatch(userID id.UserID, nextBatchToken string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.nextBatches[userID] = nextBatchToken
+	return nil
+}
+
+func (s *memoryBotStorage) LoadNextBatch(userID id.UserID) string {
+	nextBatch, _ := s.NextBatch(userID)
+	return nextBatch
+}
+
+func (s *memoryBotStorage) NextBatch(userID id.UserID) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.nextBatches[userID], nil
+}
+
+func (s *memoryBotStorage) LoadDeviceID() (id.DeviceID, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.deviceID, nil
 }
 
-func (m *MultiplexStorage) LoadFilterID(userID id.UserID) string {
-	return m.storers[0].LoadFilterID(userID)
+func (s *memoryBotStorage) StoreDeviceID(deviceID id.DeviceID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.deviceID = deviceID
+	return nil
 }
 
-func (m *MultiplexStorage) SaveNextBatch(userID id.UserID, nextBatchToken string) {
-	for _, s := range m.storers {
-		s.SaveNextBatch(userID, nextBatchToken)
+func (s *memoryBotStorage) LoadRoomMode(roomID id.RoomID) (RoomMode, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if mode, ok := s.roomModes[roomID]; ok {
+		return mode, nil
 	}
+	return RoomModeAuto, nil
 }
 
-func (m *MultiplexStorage) LoadNextBatch(userID id.UserID) string {
-	return m.storers[0].LoadNextBatch(userID)
+func (s *memoryBotStorage) StoreRoomMode(roomID id.RoomID, mode RoomMode) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.roomModes[roomID] = mode
+	return nil
+}
+
+func (s *memoryBotStorage) SaveJoinedRoom(room JoinedRoom) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.joinedRooms[room.RoomID] = room
+	return nil
 }
 
-func (m *MultiplexStorage) SaveRoom(room *mautrix.Room) {
-	for _, s := range m.storers {
-		s.SaveRoom(room)
+func (s *memoryBotStorage) RemoveJoinedRoom(roomID id.RoomID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.joinedRooms, roomID)
+	return nil
+}
+
+func (s *memoryBotStorage) LoadJoinedRooms() ([]JoinedRoom, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var rooms []JoinedRoom
+	for _, room := range s.joinedRooms {
+		rooms = append(rooms, room)
 	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].JoinedAt.Before(rooms[j].JoinedAt) })
+	return rooms, nil
 }
 
-func (m *MultiplexStorage) LoadRoom(roomID id.RoomID) *mautrix.Room {
-	return m.storers[0].LoadRoom(roomID)
+func (s *memoryBotStorage) UpdateRoomState(evt *event.Event) error {
+	if evt.StateKey == nil {
+		return fmt.Errorf("not a state event: %s", evt.Type.Type)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	room, ok := s.rooms[evt.RoomID]
+	if !ok {
+		room = mautrix.NewRoom(evt.RoomID)
+		s.rooms[evt.RoomID] = room
+	}
+	// like state loaded from the database, whatever class the event came with
+	stored := *evt
+	stored.Type.Class = event.StateEventType
+	room.UpdateState(&stored)
+	return nil
 }
 
-func (m *MultiplexStorage) LoadDeviceID() (id.DeviceID, error) {
-	return m.storers[0].LoadDeviceID()
+func (s *memoryBotStorage) SaveRoom(room *mautrix.Room) {
+	for _, events := range room.State {
+		for _, evt := range events {
+			evt.RoomID = room.ID
+			s.UpdateRoomState(evt)
+		}
+	}
 }
 
-func (m *MultiplexStorage) StoreDeviceID(deviceID id.DeviceID) error {
-	for _, s := range m.storers {
-		if err := s.StoreDeviceID(deviceID); err != nil {
-			return err
+// LoadRoom returns a copy of the room, so callers can't change the stored state.
+func (s *memoryBotStorage) LoadRoom(roomID id.RoomID) *mautrix.Room {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	room := mautrix.NewRoom(roomID)
+	if stored, ok := s.rooms[roomID]; ok {
+		for _, events := range stored.State {
+			for _, evt := range events {
+				room.UpdateState(evt)
+			}
 		}
 	}
-	return nil
+	return room
 }
 
-func NewSQLBotStorage(db *sqlx.DB, log zerolog.Logger) (BotStorage, error) {
+func NewSQLBotStorage(db sqlx.Ext, log zerolog.Logger) (BotStorage, error) {
 	return &sqlBotStorage{
 		log: log,
 		db:  db,
@@ -78,13 +223,24 @@ func NewSQLBotStorage(db *sqlx.DB, log zerolog.Logger) (BotStorage, error) {
 }
 
 type sqlBotStorage struct {
-	mautrix.Storer
 	log zerolog.Logger
-	db  *sqlx.DB
+	db  sqlx.Ext
+}
+
+// fail counts a failed method and wraps its error.
+func (s *sqlBotStorage) fail(method, message string, err error) error {
+	storageErrors.WithLabelValues(method).Inc()
+	return fmt.Errorf("%s: %w", message, err)
 }
 
 func (s *sqlBotStorage) SaveFilterID(userID id.UserID, filterID string) {
-	s.log.Debug().Str("method", "SaveFilterID").Stringer("userID", userID).Str("filterID", filterID).Send()
+	if err := s.StoreFilterID(userID, filterID); err != nil {
+		s.log.Error().Err(err).Send()
+	}
+}
+
+func (s *sqlBotStorage) StoreFilterID(userID id.UserID, filterID string) error {
+	s.log.Debug().Str("method", "StoreFilterID").Stringer("userID", userID).Str("filterID", filterID).Send()
 	_, err := sq.
 		Insert("bot_filters").
 		Columns("user_id", "filter_id").
@@ -92,26 +248,43 @@ func (s *sqlBotStorage) SaveFilterID(userID id.UserID, filterID string) {
 		Suffix("on conflict (user_id) do update set filter_id = ?", filterID).
 		RunWith(s.db).
 		Exec()
-
 	if err != nil {
-		s.log.Error().Err(err).Msg("could not save filter id")
+		return s.fail("StoreFilterID", "could not save filter id", err)
 	}
+
+	return nil
 }
 
 func (s *sqlBotStorage) LoadFilterID(userID id.UserID) string {
-	s.log.Debug().Str("method", "LoadFilterID").Stringer("userID", userID).Send()
+	filterID, err := s.FilterID(userID)
+	if err != nil {
+		s.log.Error().Err(err).Send()
+	}
+	return filterID
+}
+
+func (s *sqlBotStorage) FilterID(userID id.UserID) (string, error) {
+	s.log.Debug().Str("method", "FilterID").Stringer("userID", userID).Send()
 
 	var filterID string
 	err := sqlx.Get(s.db, &filterID, "select filter_id from bot_filters where user_id = ?", userID)
-	if err != nil {
-		s.log.Error().Err(err).Msg("could not load filter id")
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", s.fail("FilterID", "could not load filter id", err)
 	}
 
-	return filterID
+	return filterID, nil
 }
 
 func (s *sqlBotStorage) SaveNextBatch(userID id.UserID, nextBatchToken string) {
-	s.log.Debug().Str("method", "SaveNextBatch").Stringer("userID", userID).Str("nextBatchToken", nextBatchToken).Send()
+	if err := s.StoreNextBatch(userID, nextBatchToken); err != nil {
+		s.log.Error().Err(err).Send()
+	}
+}
+
+func (s *sqlBotStorage) StoreNextBatch(userID id.UserID, nextBatchToken string) error {
+	s.log.Debug().Str("method", "StoreNextBatch").Stringer("userID", userID).Str("nextBatchToken", nextBatchToken).Send()
 
 	_, err := sq.
 		Insert("bot_batch").
@@ -121,28 +294,42 @@ func (s *sqlBotStorage) SaveNextBatch(userID id.UserID, nextBatchToken string) {
 		RunWith(s.db).
 		Exec()
 	if err != nil {
-		s.log.Error().Err(err).Msg("could not build query")
+		return s.fail("StoreNextBatch", "could not save next batch token", err)
 	}
+
+	return nil
 }
 
 func (s *sqlBotStorage) LoadNextBatch(userID id.UserID) string {
-	s.log.Debug().Str("method", "LoadNextBatch").Stringer("userID", userID).Send()
+	batchToken, err := s.NextBatch(userID)
+	if err != nil {
+		s.log.Error().Err(err).Send()
+	}
+	return batchToken
+}
+
+func (s *sqlBotStorage) NextBatch(userID id.UserID) (string, error) {
+	s.log.Debug().Str("method", "NextBatch").Stringer("userID", userID).Send()
 
 	var batchToken string
 	err := sqlx.Get(s.db, &batchToken, "select batch_token from bot_batch where user_id = ?", userID)
-	if err != nil {
-		s.log.Error().Err(err).Msg("could not load filter id")
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", s.fail("NextBatch", "could not load next batch token", err)
 	}
 
-	return batchToken
+	return batchToken, nil
 }
 
 func (s *sqlBotStorage) LoadDeviceID() (id.DeviceID, error) {
 	s.log.Debug().Str("method", "LoadDeviceID").Send()
 	var deviceID id.DeviceID
 	err := sqlx.Get(s.db, &deviceID, "select device_id from device_ids order by created_at desc limit 1 ")
-	if err != nil {
-		s.log.Error().Err(err).Msg("could not load device id")
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", s.fail("LoadDeviceID", "could not load device id", err)
 	}
 
 	return deviceID, nil
@@ -158,8 +345,147 @@ func (s *sqlBotStorage) StoreDeviceID(deviceID id.DeviceID) error {
 		RunWith(s.db).
 		Exec()
 	if err != nil {
-		return fmt.Errorf("could not save device id: %w", err)
+		return s.fail("StoreDeviceID", "could not save device id", err)
+	}
+
+	return nil
+}
+
+func (s *sqlBotStorage) LoadRoomMode(roomID id.RoomID) (RoomMode, error) {
+	s.log.Debug().Str("method", "LoadRoomMode").Stringer("roomID", roomID).Send()
+	var mode RoomMode
+	err := sqlx.Get(s.db, &mode, "select mode from bot_room_modes where room_id = ?", roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RoomModeAuto, nil
+	} else if err != nil {
+		return RoomModeAuto, s.fail("LoadRoomMode", "could not load room mode", err)
+	}
+
+	return mode, nil
+}
+
+func (s *sqlBotStorage) StoreRoomMode(roomID id.RoomID, mode RoomMode) error {
+	s.log.Debug().Str("method", "StoreRoomMode").Stringer("roomID", roomID).Str("mode", string(mode)).Send()
+	_, err := sq.
+		Insert("bot_room_modes").
+		Columns("room_id", "mode").
+		Values(roomID, mode).
+		Suffix("on conflict (room_id) do update set mode = ?", mode).
+		RunWith(s.db).
+		Exec()
+	if err != nil {
+		return s.fail("StoreRoomMode", "could not save room mode", err)
+	}
+
+	return nil
+}
+
+func (s *sqlBotStorage) SaveJoinedRoom(room JoinedRoom) error {
+	s.log.Debug().Str("method", "SaveJoinedRoom").Stringer("roomID", room.RoomID).Send()
+	_, err := sq.
+		Insert("bot_rooms").
+		Columns("room_id", "inviter", "joined_at").
+		Values(room.RoomID, room.Inviter, room.JoinedAt).
+		Suffix("on conflict (room_id) do update set inviter = ?, joined_at = ?", room.Inviter, room.JoinedAt).
+		RunWith(s.db).
+		Exec()
+	if err != nil {
+		return s.fail("SaveJoinedRoom", "could not save joined room", err)
+	}
+
+	return nil
+}
+
+func (s *sqlBotStorage) RemoveJoinedRoom(roomID id.RoomID) error {
+	s.log.Debug().Str("method", "RemoveJoinedRoom").Stringer("roomID", roomID).Send()
+	if _, err := sq.Delete("bot_rooms").Where(sq.Eq{"room_id": roomID}).RunWith(s.db).Exec(); err != nil {
+		return s.fail("RemoveJoinedRoom", "could not remove joined room", err)
+	}
+
+	return nil
+}
+
+func (s *sqlBotStorage) LoadJoinedRooms() ([]JoinedRoom, error) {
+	s.log.Debug().Str("method", "LoadJoinedRooms").Send()
+	var rooms []JoinedRoom
+	if err := sqlx.Select(s.db, &rooms, "select * from bot_rooms order by joined_at"); err != nil {
+		return nil, s.fail("LoadJoinedRooms", "could not load joined rooms", err)
+	}
+
+	return rooms, nil
+}
+
+type roomStateRow struct {
+	RoomID   id.RoomID `db:"room_id"`
+	Type     string
+	StateKey string `db:"state_key"`
+	Sender   id.UserID
+	Content  string
+}
+
+func (s *sqlBotStorage) UpdateRoomState(evt *event.Event) error {
+	if evt.StateKey == nil {
+		return fmt.Errorf("not a state event: %s", evt.Type.Type)
+	}
+	content, err := json.Marshal(&evt.Content)
+	if err != nil {
+		return s.fail("UpdateRoomState", "could not serialize state event", err)
+	}
+
+	_, err = sq.
+		Insert("bot_room_state").
+		Columns("room_id", "type", "state_key", "sender", "content").
+		Values(evt.RoomID, evt.Type.Type, *evt.StateKey, evt.Sender, string(content)).
+		Suffix("on conflict (room_id, type, state_key) do update set sender = ?, content = ?", evt.Sender, string(content)).
+		RunWith(s.db).
+		Exec()
+	if err != nil {
+		return s.fail("UpdateRoomState", "could not save room state", err)
 	}
 
 	return nil
 }
+
+func (s *sqlBotStorage) SaveRoom(room *mautrix.Room) {
+	s.log.Debug().Str("method", "SaveRoom").Stringer("roomID", room.ID).Send()
+	for _, events := range room.State {
+		for _, evt := range events {
+			evt.RoomID = room.ID
+			if err := s.UpdateRoomState(evt); err != nil {
+				s.log.Error().Err(err).Msg("could not save room")
+			}
+		}
+	}
+}
+
+func (s *sqlBotStorage) LoadRoom(roomID id.RoomID) *mautrix.Room {
+	s.log.Debug().Str("method", "LoadRoom").Stringer("roomID", roomID).Send()
+	room := mautrix.NewRoom(roomID)
+
+	var rows []roomStateRow
+	if err := sqlx.Select(s.db, &rows, "select * from bot_room_state where room_id = ?", roomID); err != nil {
+		s.log.Error().Err(s.fail("LoadRoom", "could not load room", err)).Send()
+		return room
+	}
+
+	for _, row := range rows {
+		stateKey := row.StateKey
+		evt := &event.Event{
+			RoomID:   row.RoomID,
+			Type:     event.Type{Type: row.Type, Class: event.StateEventType},
+			StateKey: &stateKey,
+			Sender:   row.Sender,
+		}
+		if err := json.Unmarshal([]byte(row.Content), &evt.Content); err != nil {
+			s.log.Error().Err(err).Str("type", row.Type).Msg("could not parse room state")
+			continue
+		}
+		if err := evt.Content.ParseRaw(evt.Type); err != nil && !errors.Is(err, event.UnsupportedContentType) {
+			s.log.Error().Err(err).Str("type", row.Type).Msg("could not parse room state")
+			continue
+		}
+		room.UpdateState(evt)
+	}
+
+	return room
+}
@@ -0,0 +1,106 @@
+package bot
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ilikeorangutans/jarvis/pkg/database"
+	"github.com/ilikeorangutans/jarvis/pkg/database/databasetest"
+	"github.com/rs/zerolog"
+	"gotest.tools/assert"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestSQLBotStorage(t *testing.T) {
+	databasetest.Migrated(t, databasetest.Core, testSQLBotStorage)
+}
+
+func TestMemoryBotStorage(t *testing.T) {
+	testBotStorage(t, NewMemoryBotStorage())
+}
+
+func testSQLBotStorage(t *testing.T, db *database.DB) {
+	storage, err := NewSQLBotStorage(db, zerolog.Nop())
+	assert.NilError(t, err)
+	testBotStorage(t, storage)
+
+	// failures are reported instead of looking like an empty database
+	db.MustExec("drop table bot_batch")
+	_, err = storage.NextBatch("@jarvis:example.com")
+	assert.ErrorContains(t, err, "could not load next batch token")
+}
+
+func testBotStorage(t *testing.T, storage BotStorage) {
+	const userID = id.UserID("@jarvis:example.com")
+
+	// nothing stored yet isn't an error
+	filterID, err := storage.FilterID(userID)
+	assert.NilError(t, err)
+	assert.Equal(t, filterID, "")
+	nextBatch, err := storage.NextBatch(userID)
+	assert.NilError(t, err)
+	assert.Equal(t, nextBatch, "")
+	deviceID, err := storage.LoadDeviceID()
+	assert.NilError(t, err)
+	assert.Equal(t, deviceID, id.DeviceID(""))
+
+	assert.NilError(t, storage.StoreFilterID(userID, "filter"))
+	assert.NilError(t, storage.StoreNextBatch(userID, "s1"))
+	assert.NilError(t, storage.StoreNextBatch(userID, "s2"))
+	assert.NilError(t, storage.StoreDeviceID("DEVICE"))
+	assert.Equal(t, storage.LoadFilterID(userID), "filter")
+	assert.Equal(t, storage.LoadNextBatch(userID), "s2")
+	deviceID, err = storage.LoadDeviceID()
+	assert.NilError(t, err)
+	assert.Equal(t, deviceID, id.DeviceID("DEVICE"))
+
+	mode, err := storage.LoadRoomMode("!den:example.com")
+	assert.NilError(t, err)
+	assert.Equal(t, mode, RoomModeAuto)
+	assert.NilError(t, storage.StoreRoomMode("!den:example.com", RoomModeOpen))
+	mode, err = storage.LoadRoomMode("!den:example.com")
+	assert.NilError(t, err)
+	assert.Equal(t, mode, RoomModeOpen)
+
+	joinedAt := time.Date(2021, 1, 8, 12, 0, 0, 0, time.UTC)
+	assert.NilError(t, storage.SaveJoinedRoom(JoinedRoom{RoomID: "!lab:example.com", JoinedAt: joinedAt.Add(time.Hour)}))
+	assert.NilError(t, storage.SaveJoinedRoom(JoinedRoom{RoomID: "!den:example.com", Inviter: "@alice:example.com", JoinedAt: joinedAt}))
+	assert.NilError(t, storage.RemoveJoinedRoom("!lab:example.com"))
+	rooms, err := storage.LoadJoinedRooms()
+	assert.NilError(t, err)
+	assert.Equal(t, len(rooms), 1)
+	assert.Equal(t, rooms[0].Inviter, id.UserID("@alice:example.com"))
+
+	assert.NilError(t, storage.UpdateRoomState(&event.Event{
+		RoomID:   "!den:example.com",
+		Type:     event.StateRoomName,
+		StateKey: new(string),
+		Sender:   "@alice:example.com",
+		Content:  event.Content{Parsed: &event.RoomNameEventContent{Name: "The Den"}},
+	}))
+	room := RoomState{Room: storage.LoadRoom("!den:example.com")}
+	assert.Equal(t, room.Name(), "The Den")
+}
+
+// unreadableStorage fails to load the next batch token.
+type unreadableStorage struct {
+	BotStorage
+}
+
+func (unreadableStorage) NextBatch(id.UserID) (string, error) { return "", errBroken }
+
+func TestSyncStore(t *testing.T) {
+	failures := make(chan error, 1)
+	store := &syncStore{BotStorage: unreadableStorage{sqliteBotStorage(t)}, failures: failures}
+
+	store.SaveFilterID("@jarvis:example.com", "filter")
+	assert.Equal(t, store.LoadFilterID("@jarvis:example.com"), "filter")
+	assert.Equal(t, len(failures), 0)
+
+	assert.Equal(t, store.LoadNextBatch("@jarvis:example.com"), "")
+	assert.Equal(t, store.LoadNextBatch("@jarvis:example.com"), "")
+	assert.Assert(t, errors.Is(<-failures, errBroken))
+	assert.Equal(t, len(failures), 0)
+}
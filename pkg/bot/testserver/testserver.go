@@ -0,0 +1,775 @@
+// Package testserver is a fake Matrix homeserver implementing the parts of the client-server API jarvis uses: login,
+// whoami, display names, presence, filters, sync, sending, joining and leaving rooms, read markers, joined members,
+// joined rooms and room state.
+// It runs on an httptest.Server, so tests can run the whole bot offline, including restarts and rate limiting.
+package testserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const prefix = "/_matrix/client/r0/"
+
+// RetryAfter is how long rate limited clients are asked to wait.
+const RetryAfter = 10 * time.Millisecond
+
+// Endpoint names a group of requests, e.g. to rate limit them.
+type Endpoint string
+
+const (
+	EndpointLogin         Endpoint = "login"
+	EndpointWhoami        Endpoint = "whoami"
+	EndpointDisplayName   Endpoint = "displayname"
+	EndpointPresence      Endpoint = "presence"
+	EndpointFilter        Endpoint = "filter"
+	EndpointSync          Endpoint = "sync"
+	EndpointSend          Endpoint = "send"
+	EndpointJoin          Endpoint = "join"
+	EndpointLeave         Endpoint = "leave"
+	EndpointReceipt       Endpoint = "receipt"
+	EndpointJoinedMembers Endpoint = "joined_members"
+	EndpointJoinedRooms   Endpoint = "joined_rooms"
+	EndpointState         Endpoint = "state"
+)
+
+type storedEvent struct {
+	pos      int
+	roomID   id.RoomID
+	eventID  id.EventID
+	sender   id.UserID
+	typ      string
+	stateKey *string
+	content  json.RawMessage
+	ts       int64
+}
+
+func (e *storedEvent) MarshalJSON() ([]byte, error) {
+	raw := map[string]interface{}{
+		"event_id":         e.eventID,
+		"room_id":          e.roomID,
+		"sender":           e.sender,
+		"type":             e.typ,
+		"content":          e.content,
+		"origin_server_ts": e.ts,
+	}
+	if e.stateKey != nil {
+		raw["state_key"] = *e.stateKey
+	}
+	return json.Marshal(raw)
+}
+
+type session struct {
+	userID   id.UserID
+	deviceID id.DeviceID
+}
+
+// Server is a homeserver for the users added with AddUser. Everything is kept in memory.
+type Server struct {
+	*httptest.Server
+
+	lock sync.Mutex
+	// changed is closed and replaced whenever an event is added, to wake up syncs waiting for events
+	changed      chan struct{}
+	closing      chan struct{}
+	closeOnce    sync.Once
+	passwords    map[id.UserID]string
+	displayNames map[id.UserID]string
+	sessions     map[string]session
+	logins       map[id.UserID][]id.DeviceID
+	events       []*storedEvent
+	members      map[id.RoomID]map[id.UserID]event.Membership
+	presence     map[id.UserID]event.Presence
+	receipts     map[id.RoomID]map[id.UserID]id.EventID
+	transactions map[string]id.EventID
+	limits       map[Endpoint]int
+	requests     map[Endpoint]int
+	ids          int
+}
+
+// New starts a server that is closed when the test ends.
+func New(t testing.TB) *Server {
+	s := &Server{
+		changed:      make(chan struct{}),
+		closing:      make(chan struct{}),
+		passwords:    make(map[id.UserID]string),
+		displayNames: make(map[id.UserID]string),
+		sessions:     make(map[string]session),
+		logins:       make(map[id.UserID][]id.DeviceID),
+		members:      make(map[id.RoomID]map[id.UserID]event.Membership),
+		presence:     make(map[id.UserID]event.Presence),
+		receipts:     make(map[id.RoomID]map[id.UserID]id.EventID),
+		transactions: make(map[string]id.EventID),
+		limits:       make(map[Endpoint]int),
+		requests:     make(map[Endpoint]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Close ends pending syncs and shuts the server down.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+		s.Server.Close()
+	})
+}
+
+// AddUser adds a user who can log in with the password.
+func (s *Server) AddUser(userID id.UserID, password, displayName string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.passwords[userID] = password
+	s.displayNames[userID] = displayName
+}
+
+// LimitNext rate limits the next n requests to the endpoint.
+func (s *Server) LimitNext(endpoint Endpoint, n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.limits[endpoint] += n
+}
+
+// Requests returns how many requests the endpoint received, including rate limited ones.
+func (s *Server) Requests(endpoint Endpoint) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests[endpoint]
+}
+
+// Logins returns the device of each login of the user, in order.
+func (s *Server) Logins(userID id.UserID) []id.DeviceID {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]id.DeviceID(nil), s.logins[userID]...)
+}
+
+// Presence returns the presence the user set last.
+func (s *Server) Presence(userID id.UserID) event.Presence {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.presence[userID]
+}
+
+// ReadMarker returns the last event the user marked as read in the room.
+func (s *Server) ReadMarker(roomID id.RoomID, userID id.UserID) id.EventID {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.receipts[roomID][userID]
+}
+
+// Membership returns the user's membership in the room, leave if the user never joined.
+func (s *Server) Membership(roomID id.RoomID, userID id.UserID) event.Membership {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.membership(roomID, userID)
+}
+
+func (s *Server) membership(roomID id.RoomID, userID id.UserID) event.Membership {
+	if membership, ok := s.members[roomID][userID]; ok {
+		return membership
+	}
+	return event.MembershipLeave
+}
+
+// CreateRoom creates a room the creator joined.
+func (s *Server) CreateRoom(creator id.UserID) id.RoomID {
+	_, homeserver, _ := creator.Parse()
+	s.lock.Lock()
+	s.ids++
+	roomID := id.RoomID(fmt.Sprintf("!room%d:%s", s.ids, homeserver))
+	s.members[roomID] = make(map[id.UserID]event.Membership)
+	s.lock.Unlock()
+
+	s.SetState(roomID, creator, event.StateCreate, "", &event.CreateEventContent{Creator: creator})
+	s.Join(roomID, creator)
+	return roomID
+}
+
+// Invite has the sender invite the user to the room.
+func (s *Server) Invite(roomID id.RoomID, sender, userID id.UserID) id.EventID {
+	return s.SetState(roomID, sender, event.StateMember, userID.String(), &event.MemberEventContent{Membership: event.MembershipInvite})
+}
+
+// Join makes the user join the room.
+func (s *Server) Join(roomID id.RoomID, userID id.UserID) id.EventID {
+	return s.SetState(roomID, userID, event.StateMember, userID.String(), &event.MemberEventContent{Membership: event.MembershipJoin})
+}
+
+// Leave makes the user leave the room.
+func (s *Server) Leave(roomID id.RoomID, userID id.UserID) id.EventID {
+	return s.SetState(roomID, userID, event.StateMember, userID.String(), &event.MemberEventContent{Membership: event.MembershipLeave})
+}
+
+// Send sends a text message to the room.
+func (s *Server) Send(roomID id.RoomID, sender id.UserID, body string) id.EventID {
+	return s.SendEvent(roomID, sender, event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: body})
+}
+
+// SendEvent sends an event of any type to the room.
+func (s *Server) SendEvent(roomID id.RoomID, sender id.UserID, eventType event.Type, content interface{}) id.EventID {
+	data, err := json.Marshal(content)
+	if err != nil {
+		panic(err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.add(roomID, sender, eventType.Type, nil, data)
+}
+
+// SetState sends a state event to the room.
+func (s *Server) SetState(roomID id.RoomID, sender id.UserID, eventType event.Type, stateKey string, content interface{}) id.EventID {
+	data, err := json.Marshal(content)
+	if err != nil {
+		panic(err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.add(roomID, sender, eventType.Type, &stateKey, data)
+}
+
+func (s *Server) add(roomID id.RoomID, sender id.UserID, eventType string, stateKey *string, content json.RawMessage) id.EventID {
+	s.ids++
+	evt := &storedEvent{
+		pos:      len(s.events) + 1,
+		roomID:   roomID,
+		eventID:  id.EventID(fmt.Sprintf("$event%d", s.ids)),
+		sender:   sender,
+		typ:      eventType,
+		stateKey: stateKey,
+		content:  content,
+		ts:       time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	s.events = append(s.events, evt)
+
+	if eventType == event.StateMember.Type && stateKey != nil {
+		var member event.MemberEventContent
+		if err := json.Unmarshal(content, &member); err == nil {
+			if s.members[roomID] == nil {
+				s.members[roomID] = make(map[id.UserID]event.Membership)
+			}
+			s.members[roomID][id.UserID(*stateKey)] = member.Membership
+		}
+	}
+
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return evt.eventID
+}
+
+// Events returns the events of the room, parsed like a client would.
+func (s *Server) Events(roomID id.RoomID) []*event.Event {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var events []*event.Event
+	for _, stored := range s.events {
+		if stored.roomID != roomID {
+			continue
+		}
+		data, err := json.Marshal(stored)
+		if err != nil {
+			panic(err)
+		}
+		evt := &event.Event{}
+		if err := json.Unmarshal(data, evt); err != nil {
+			panic(err)
+		}
+		_ = evt.Content.ParseRaw(evt.Type)
+		events = append(events, evt)
+	}
+	return events
+}
+
+// Messages returns the bodies of the messages the user sent to the room, or their HTML if they have no plain text.
+func (s *Server) Messages(roomID id.RoomID, sender id.UserID) []string {
+	var bodies []string
+	for _, evt := range s.Events(roomID) {
+		if evt.Sender != sender || evt.Type != event.EventMessage {
+			continue
+		}
+		msg := evt.Content.AsMessage()
+		if msg.Body == "" {
+			bodies = append(bodies, msg.FormattedBody)
+		} else {
+			bodies = append(bodies, msg.Body)
+		}
+	}
+	return bodies
+}
+
+// WaitFor waits up to five seconds for the condition to become true, and fails the test otherwise.
+func (s *Server) WaitFor(t testing.TB, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, errcode, message string) {
+	writeJSON(w, status, map[string]interface{}{"errcode": errcode, "error": message})
+}
+
+// endpoint returns which endpoint the path segments after the API prefix belong to.
+func endpoint(method string, path []string) (Endpoint, bool) {
+	switch {
+	case method == http.MethodPost && len(path) == 1 && path[0] == "login":
+		return EndpointLogin, true
+	case method == http.MethodGet && len(path) == 2 && path[0] == "account" && path[1] == "whoami":
+		return EndpointWhoami, true
+	case method == http.MethodGet && len(path) == 3 && path[0] == "profile" && path[2] == "displayname":
+		return EndpointDisplayName, true
+	case method == http.MethodPut && len(path) == 3 && path[0] == "presence" && path[2] == "status":
+		return EndpointPresence, true
+	case method == http.MethodPost && len(path) == 3 && path[0] == "user" && path[2] == "filter":
+		return EndpointFilter, true
+	case method == http.MethodGet && len(path) == 1 && path[0] == "sync":
+		return EndpointSync, true
+	case method == http.MethodPost && len(path) == 2 && path[0] == "join",
+		method == http.MethodPost && len(path) == 3 && path[0] == "rooms" && path[2] == "join":
+		return EndpointJoin, true
+	case method == http.MethodGet && len(path) == 1 && path[0] == "joined_rooms":
+		return EndpointJoinedRooms, true
+	case len(path) < 3 || path[0] != "rooms":
+		return "", false
+	case method == http.MethodPut && len(path) == 5 && path[2] == "send":
+		return EndpointSend, true
+	case method == http.MethodPost && len(path) == 3 && path[2] == "leave":
+		return EndpointLeave, true
+	case method == http.MethodPost && len(path) == 5 && path[2] == "receipt":
+		return EndpointReceipt, true
+	case method == http.MethodGet && len(path) == 3 && path[2] == "joined_members":
+		return EndpointJoinedMembers, true
+	case method == http.MethodGet && len(path) == 3 && path[2] == "state":
+		return EndpointState, true
+	}
+	return "", false
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	escaped := r.URL.EscapedPath()
+	if !strings.HasPrefix(escaped, prefix) {
+		writeError(w, http.StatusNotFound, "M_UNRECOGNIZED", "unknown API")
+		return
+	}
+	path := strings.Split(strings.TrimPrefix(escaped, prefix), "/")
+	for i, segment := range path {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "M_UNRECOGNIZED", err.Error())
+			return
+		}
+		path[i] = unescaped
+	}
+
+	name, ok := endpoint(r.Method, path)
+	if !ok {
+		writeError(w, http.StatusNotFound, "M_UNRECOGNIZED", fmt.Sprintf("%s %s is not implemented", r.Method, escaped))
+		return
+	}
+
+	s.lock.Lock()
+	s.requests[name]++
+	limited := s.limits[name] > 0
+	if limited {
+		s.limits[name]--
+	}
+	s.lock.Unlock()
+	if limited {
+		writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+			"errcode":        "M_LIMIT_EXCEEDED",
+			"error":          "Too many requests",
+			"retry_after_ms": RetryAfter.Milliseconds(),
+		})
+		return
+	}
+
+	if name == EndpointLogin {
+		s.login(w, r)
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("access_token")
+	}
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, "M_MISSING_TOKEN", "Missing access token")
+		return
+	}
+	s.lock.Lock()
+	sess, ok := s.sessions[token]
+	s.lock.Unlock()
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "M_UNKNOWN_TOKEN", "Unknown access token")
+		return
+	}
+
+	switch name {
+	case EndpointWhoami:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"user_id": sess.userID, "device_id": sess.deviceID})
+	case EndpointDisplayName:
+		s.displayName(w, id.UserID(path[1]))
+	case EndpointPresence:
+		s.setPresence(w, r, sess, id.UserID(path[1]))
+	case EndpointFilter:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"filter_id": "1"})
+	case EndpointSync:
+		s.sync(w, r, sess)
+	case EndpointJoin:
+		roomID := id.RoomID(path[len(path)-2])
+		if path[0] == "join" {
+			roomID = id.RoomID(path[1])
+		}
+		s.join(w, sess, roomID)
+	case EndpointSend:
+		s.send(w, r, token, sess, id.RoomID(path[1]), path[3], path[4])
+	case EndpointLeave:
+		s.leave(w, sess, id.RoomID(path[1]))
+	case EndpointReceipt:
+		s.receipt(w, sess, id.RoomID(path[1]), id.EventID(path[4]))
+	case EndpointJoinedMembers:
+		s.joinedMembers(w, sess, id.RoomID(path[1]))
+	case EndpointJoinedRooms:
+		s.joinedRooms(w, sess)
+	case EndpointState:
+		s.state(w, sess, id.RoomID(path[1]))
+	}
+}
+
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Identifier struct {
+			User string `json:"user"`
+		} `json:"identifier"`
+		Password string      `json:"password"`
+		DeviceID id.DeviceID `json:"device_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "M_BAD_JSON", err.Error())
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var userID id.UserID
+	for u := range s.passwords {
+		if localpart, _, _ := u.Parse(); u.String() == req.Identifier.User || localpart == req.Identifier.User {
+			userID = u
+		}
+	}
+	if userID == "" || s.passwords[userID] != req.Password {
+		writeError(w, http.StatusForbidden, "M_FORBIDDEN", "Invalid username or password")
+		return
+	}
+
+	deviceID := req.DeviceID
+	if deviceID == "" {
+		s.ids++
+		deviceID = id.DeviceID(fmt.Sprintf("DEVICE%d", s.ids))
+	}
+	s.ids++
+	token := fmt.Sprintf("token%d", s.ids)
+	s.sessions[token] = session{userID: userID, deviceID: deviceID}
+	s.logins[userID] = append(s.logins[userID], deviceID)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"user_id": userID, "access_token": token, "device_id": deviceID})
+}
+
+func (s *Server) displayName(w http.ResponseWriter, userID id.UserID) {
+	s.lock.Lock()
+	displayName, ok := s.displayNames[userID]
+	s.lock.Unlock()
+	if !ok || displayName == "" {
+		writeError(w, http.StatusNotFound, "M_NOT_FOUND", "Profile not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"displayname": displayName})
+}
+
+func (s *Server) setPresence(w http.ResponseWriter, r *http.Request, sess session, userID id.UserID) {
+	if userID != sess.userID {
+		writeError(w, http.StatusForbidden, "M_FORBIDDEN", "Can't set another user's presence")
+		return
+	}
+	var req struct {
+		Presence event.Presence `json:"presence"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "M_BAD_JSON", err.Error())
+		return
+	}
+	s.lock.Lock()
+	s.presence[userID] = req.Presence
+	s.lock.Unlock()
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+type eventList struct {
+	Events []*storedEvent `json:"events"`
+}
+
+type syncResponse struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[id.RoomID]struct {
+			Timeline eventList `json:"timeline"`
+		} `json:"join"`
+		Invite map[id.RoomID]struct {
+			State eventList `json:"invite_state"`
+		} `json:"invite"`
+		Leave map[id.RoomID]struct {
+			Timeline eventList `json:"timeline"`
+		} `json:"leave"`
+	} `json:"rooms"`
+}
+
+func (r *syncResponse) empty() bool {
+	return len(r.Rooms.Join) == 0 && len(r.Rooms.Invite) == 0 && len(r.Rooms.Leave) == 0
+}
+
+// syncResponse returns the events after since in the rooms the user joined, was invited to or left. An initial sync
+// returns whole rooms the user joined and pending invites.
+func (s *Server) syncResponse(userID id.UserID, since int, initial bool) *syncResponse {
+	resp := &syncResponse{NextBatch: fmt.Sprintf("s%d", len(s.events))}
+	byRoom := make(map[id.RoomID][]*storedEvent)
+	var roomIDs []id.RoomID
+	for _, evt := range s.events[since:] {
+		if _, ok := byRoom[evt.roomID]; !ok {
+			roomIDs = append(roomIDs, evt.roomID)
+		}
+		byRoom[evt.roomID] = append(byRoom[evt.roomID], evt)
+	}
+
+	for _, roomID := range roomIDs {
+		events := byRoom[roomID]
+		// the user's latest membership change decides which section the room goes in
+		var membershipEvent *storedEvent
+		for _, evt := range events {
+			if evt.typ == event.StateMember.Type && evt.stateKey != nil && *evt.stateKey == userID.String() {
+				membershipEvent = evt
+			}
+		}
+
+		switch s.membership(roomID, userID) {
+		case event.MembershipJoin:
+			if resp.Rooms.Join == nil {
+				resp.Rooms.Join = make(map[id.RoomID]struct {
+					Timeline eventList `json:"timeline"`
+				})
+			}
+			room := resp.Rooms.Join[roomID]
+			room.Timeline.Events = events
+			resp.Rooms.Join[roomID] = room
+		case event.MembershipInvite:
+			if membershipEvent == nil {
+				continue
+			}
+			if resp.Rooms.Invite == nil {
+				resp.Rooms.Invite = make(map[id.RoomID]struct {
+					State eventList `json:"invite_state"`
+				})
+			}
+			room := resp.Rooms.Invite[roomID]
+			room.State.Events = []*storedEvent{membershipEvent}
+			resp.Rooms.Invite[roomID] = room
+		default:
+			if membershipEvent == nil || initial {
+				continue
+			}
+			if resp.Rooms.Leave == nil {
+				resp.Rooms.Leave = make(map[id.RoomID]struct {
+					Timeline eventList `json:"timeline"`
+				})
+			}
+			var timeline []*storedEvent
+			for _, evt := range events {
+				if evt.pos <= membershipEvent.pos {
+					timeline = append(timeline, evt)
+				}
+			}
+			room := resp.Rooms.Leave[roomID]
+			room.Timeline.Events = timeline
+			resp.Rooms.Leave[roomID] = room
+		}
+	}
+	return resp
+}
+
+func (s *Server) sync(w http.ResponseWriter, r *http.Request, sess session) {
+	query := r.URL.Query()
+	since := 0
+	initial := query.Get("since") == ""
+	if !initial {
+		var err error
+		since, err = strconv.Atoi(strings.TrimPrefix(query.Get("since"), "s"))
+		if err != nil || since < 0 {
+			writeError(w, http.StatusBadRequest, "M_INVALID_PARAM", "Invalid since token")
+			return
+		}
+	}
+	timeout, _ := strconv.Atoi(query.Get("timeout"))
+	deadline := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+	defer deadline.Stop()
+
+	for {
+		s.lock.Lock()
+		if since > len(s.events) {
+			s.lock.Unlock()
+			writeError(w, http.StatusBadRequest, "M_INVALID_PARAM", "Unknown since token")
+			return
+		}
+		resp := s.syncResponse(sess.userID, since, initial)
+		changed := s.changed
+		s.lock.Unlock()
+
+		if !resp.empty() || initial {
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			writeJSON(w, http.StatusOK, resp)
+			return
+		case <-s.closing:
+			writeJSON(w, http.StatusOK, resp)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) join(w http.ResponseWriter, sess session, roomID id.RoomID) {
+	s.lock.Lock()
+	membership := s.membership(roomID, sess.userID)
+	s.lock.Unlock()
+	if membership != event.MembershipInvite && membership != event.MembershipJoin {
+		writeError(w, http.StatusForbidden, "M_FORBIDDEN", "You are not invited to this room")
+		return
+	}
+	if membership == event.MembershipInvite {
+		s.Join(roomID, sess.userID)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"room_id": roomID})
+}
+
+func (s *Server) leave(w http.ResponseWriter, sess session, roomID id.RoomID) {
+	s.lock.Lock()
+	membership := s.membership(roomID, sess.userID)
+	s.lock.Unlock()
+	if membership != event.MembershipLeave {
+		s.Leave(roomID, sess.userID)
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func (s *Server) send(w http.ResponseWriter, r *http.Request, token string, sess session, roomID id.RoomID, eventType, txnID string) {
+	var content json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&content); err != nil {
+		writeError(w, http.StatusBadRequest, "M_BAD_JSON", err.Error())
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.membership(roomID, sess.userID) != event.MembershipJoin {
+		writeError(w, http.StatusForbidden, "M_FORBIDDEN", "You are not in this room")
+		return
+	}
+	// retried requests with the same transaction ID don't send the event again
+	key := token + "/" + txnID
+	eventID, ok := s.transactions[key]
+	if !ok {
+		eventID = s.add(roomID, sess.userID, eventType, nil, content)
+		s.transactions[key] = eventID
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"event_id": eventID})
+}
+
+func (s *Server) receipt(w http.ResponseWriter, sess session, roomID id.RoomID, eventID id.EventID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.receipts[roomID] == nil {
+		s.receipts[roomID] = make(map[id.UserID]id.EventID)
+	}
+	s.receipts[roomID][sess.userID] = eventID
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func (s *Server) joinedMembers(w http.ResponseWriter, sess session, roomID id.RoomID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.membership(roomID, sess.userID) != event.MembershipJoin {
+		writeError(w, http.StatusForbidden, "M_FORBIDDEN", "You are not in this room")
+		return
+	}
+	joined := make(map[id.UserID]interface{})
+	for userID, membership := range s.members[roomID] {
+		if membership == event.MembershipJoin {
+			joined[userID] = map[string]interface{}{}
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"joined": joined})
+}
+
+func (s *Server) joinedRooms(w http.ResponseWriter, sess session) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	joined := []id.RoomID{}
+	for roomID := range s.members {
+		if s.membership(roomID, sess.userID) == event.MembershipJoin {
+			joined = append(joined, roomID)
+		}
+	}
+	sort.Slice(joined, func(i, j int) bool { return joined[i] < joined[j] })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"joined_rooms": joined})
+}
+
+// state returns the latest event of every type and state key in the room.
+func (s *Server) state(w http.ResponseWriter, sess session, roomID id.RoomID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.membership(roomID, sess.userID) != event.MembershipJoin {
+		writeError(w, http.StatusForbidden, "M_FORBIDDEN", "You are not in this room")
+		return
+	}
+	type key struct{ typ, stateKey string }
+	latest := make(map[key]int)
+	state := []*storedEvent{}
+	for _, evt := range s.events {
+		if evt.roomID != roomID || evt.stateKey == nil {
+			continue
+		}
+		k := key{evt.typ, *evt.stateKey}
+		if i, ok := latest[k]; ok {
+			state[i] = evt
+			continue
+		}
+		latest[k] = len(state)
+		state = append(state, evt)
+	}
+	writeJSON(w, http.StatusOK, state)
+}
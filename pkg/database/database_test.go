@@ -0,0 +1,60 @@
+package database
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jarvis")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "jarvis.db"))
+	assert.NilError(t, err)
+	defer Close(db)
+
+	var journalMode string
+	assert.NilError(t, db.Get(&journalMode, "pragma journal_mode"))
+	assert.Equal(t, journalMode, "wal")
+	var foreignKeys bool
+	assert.NilError(t, db.Get(&foreignKeys, "pragma foreign_keys"))
+	assert.Assert(t, foreignKeys)
+	var busyTimeout int
+	assert.NilError(t, db.Get(&busyTimeout, "pragma busy_timeout"))
+	assert.Equal(t, busyTimeout, 5000)
+}
+
+func TestBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jarvis")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "jarvis.db"))
+	assert.NilError(t, err)
+	defer Close(db)
+	db.MustExec("create table greetings (text text)")
+	db.MustExec("insert into greetings (text) values ('hello')")
+
+	ctx := context.Background()
+	now := time.Date(2021, time.January, 8, 12, 30, 0, 0, time.UTC)
+	path, err := Backup(ctx, db, dir, now)
+	assert.NilError(t, err)
+	assert.Equal(t, path, filepath.Join(dir, "jarvis-backup-20210108-123000.db"))
+
+	_, err = Backup(ctx, db, dir, now)
+	assert.ErrorContains(t, err, "already exists")
+
+	backup, err := Open(path)
+	assert.NilError(t, err)
+	defer Close(backup)
+	var text string
+	assert.NilError(t, backup.Get(&text, "select text from greetings"))
+	assert.Equal(t, text, "hello")
+}
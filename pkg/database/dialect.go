@@ -0,0 +1,168 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+)
+
+// Dialect is the flavour of SQL a database speaks.
+type Dialect string
+
+const (
+	SQLite   Dialect = "sqlite3"
+	Postgres Dialect = "postgres"
+)
+
+// DialectOf returns the dialect of the database or transaction.
+func DialectOf(db sqlx.Ext) Dialect {
+	if db.DriverName() == "postgres" {
+		return Postgres
+	}
+	return SQLite
+}
+
+// DB is a database that accepts queries with ? placeholders whatever its dialect, so queries, including those built
+// with squirrel, work with both SQLite and Postgres. Queries must stick to SQL both understand: quote "user", and
+// use InsertReturningID instead of LastInsertId.
+type DB struct {
+	*sqlx.DB
+	Dialect Dialect
+}
+
+func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(db.Rebind(query), args...)
+}
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.ExecContext(ctx, db.Rebind(query), args...)
+}
+
+func (db *DB) MustExec(query string, args ...interface{}) sql.Result {
+	return db.DB.MustExec(db.Rebind(query), args...)
+}
+
+func (db *DB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(db.Rebind(query), args...)
+}
+
+func (db *DB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.QueryContext(ctx, db.Rebind(query), args...)
+}
+
+func (db *DB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(db.Rebind(query), args...)
+}
+
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRowContext(ctx, db.Rebind(query), args...)
+}
+
+func (db *DB) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
+	return db.DB.Queryx(db.Rebind(query), args...)
+}
+
+func (db *DB) QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error) {
+	return db.DB.QueryxContext(ctx, db.Rebind(query), args...)
+}
+
+func (db *DB) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	return db.DB.QueryRowx(db.Rebind(query), args...)
+}
+
+func (db *DB) QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row {
+	return db.DB.QueryRowxContext(ctx, db.Rebind(query), args...)
+}
+
+func (db *DB) Get(dest interface{}, query string, args ...interface{}) error {
+	return sqlx.Get(db, dest, query, args...)
+}
+
+func (db *DB) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return sqlx.GetContext(ctx, db, dest, query, args...)
+}
+
+func (db *DB) Select(dest interface{}, query string, args ...interface{}) error {
+	return sqlx.Select(db, dest, query, args...)
+}
+
+func (db *DB) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return sqlx.SelectContext(ctx, db, dest, query, args...)
+}
+
+// InsertReturningID runs the insert and returns the ID of the new row, which must be in a column named id.
+func InsertReturningID(ctx context.Context, db sqlx.Ext, insert sq.InsertBuilder) (int64, error) {
+	var id int64
+	if DialectOf(db) == Postgres {
+		if err := insert.Suffix("returning id").RunWith(db).QueryRowContext(ctx).Scan(&id); err != nil {
+			return 0, err
+		}
+		return id, nil
+	}
+
+	result, err := insert.RunWith(db).ExecContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if id, err = result.LastInsertId(); err != nil {
+		return 0, fmt.Errorf("could not get last inserted id: %w", err)
+	}
+	return id, nil
+}
+
+// BeginTxx starts a transaction that accepts ? placeholders like the database.
+func (db *DB) BeginTxx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	tx, err := db.DB.BeginTxx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx}, nil
+}
+
+// Tx is a transaction that accepts ? placeholders whatever its dialect, see DB.
+type Tx struct {
+	*sqlx.Tx
+}
+
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(tx.Rebind(query), args...)
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.ExecContext(ctx, tx.Rebind(query), args...)
+}
+
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.Rebind(query), args...)
+}
+
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.QueryContext(ctx, tx.Rebind(query), args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(tx.Rebind(query), args...)
+}
+
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRowContext(ctx, tx.Rebind(query), args...)
+}
+
+func (tx *Tx) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
+	return tx.Tx.Queryx(tx.Rebind(query), args...)
+}
+
+func (tx *Tx) QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error) {
+	return tx.Tx.QueryxContext(ctx, tx.Rebind(query), args...)
+}
+
+func (tx *Tx) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	return tx.Tx.QueryRowx(tx.Rebind(query), args...)
+}
+
+func (tx *Tx) QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row {
+	return tx.Tx.QueryRowxContext(ctx, tx.Rebind(query), args...)
+}
@@ -0,0 +1,54 @@
+package database_test
+
+import (
+	"context"
+	"testing"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/ilikeorangutans/jarvis/pkg/database"
+	"github.com/ilikeorangutans/jarvis/pkg/database/databasetest"
+	"gotest.tools/assert"
+)
+
+func TestDB(t *testing.T) {
+	databasetest.Each(t, func(t *testing.T, db *database.DB) {
+		if db.Dialect == database.Postgres {
+			db.MustExec(`create table greetings (id bigserial, "user" text, text text, primary key(id))`)
+		} else {
+			db.MustExec(`create table greetings (id integer, "user" text, text text, primary key(id))`)
+		}
+		ctx := context.Background()
+
+		for i, text := range []string{"hello", "howdy"} {
+			id, err := database.InsertReturningID(ctx, db, sq.Insert("greetings").Columns(`"user"`, "text").Values("@alice:example.com", text))
+			assert.NilError(t, err)
+			assert.Equal(t, id, int64(i+1))
+		}
+
+		// ? placeholders work in plain queries and with squirrel, whatever the dialect
+		var text string
+		assert.NilError(t, db.Get(&text, `select text from greetings where "user" = ? and id = ?`, "@alice:example.com", 2))
+		assert.Equal(t, text, "howdy")
+
+		_, err := sq.Update("greetings").Set("text", "hi").Where(sq.Eq{"id": 1}).RunWith(db).ExecContext(ctx)
+		assert.NilError(t, err)
+		var texts []string
+		assert.NilError(t, db.Select(&texts, "select text from greetings where id <= ? order by id", 2))
+		assert.DeepEqual(t, texts, []string{"hi", "howdy"})
+
+		// transactions take ? placeholders too
+		tx, err := db.BeginTxx(ctx, nil)
+		assert.NilError(t, err)
+		_, err = sq.Delete("greetings").Where(sq.Eq{"id": 1}).RunWith(tx).ExecContext(ctx)
+		assert.NilError(t, err)
+		assert.NilError(t, tx.Rollback())
+		tx, err = db.BeginTxx(ctx, nil)
+		assert.NilError(t, err)
+		_, err = sq.Update("greetings").Set("text", "hey").Where(sq.Eq{"id": 2}).RunWith(tx).ExecContext(ctx)
+		assert.NilError(t, err)
+		assert.NilError(t, tx.Commit())
+		texts = nil
+		assert.NilError(t, db.Select(&texts, "select text from greetings order by id"))
+		assert.DeepEqual(t, texts, []string{"hi", "hey"})
+	})
+}
@@ -0,0 +1,475 @@
+// Package dice parses and rolls dice expressions like "3d20+5", "4d6kh3", "2d10!" or "d%".
+package dice
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"html"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Limits keep rolls and their breakdowns small enough to post. Dice, groups and explosions count across the whole
+// expression.
+const (
+	MaxDice       = 100
+	MaxGroups     = 10
+	MaxSides      = 1000
+	MaxExplosions = 100
+)
+
+// minInt and maxInt are the bounds of int, which math only has constants for since Go 1.17.
+const (
+	maxInt = 1<<(strconv.IntSize-1) - 1
+	minInt = -maxInt - 1
+)
+
+var (
+	ErrEmpty    = errors.New("empty expression")
+	ErrTooLarge = errors.New("result too large")
+)
+
+// Source returns a uniformly distributed roll between 1 and sides inclusive.
+type Source func(sides int) (int, error)
+
+// CryptoSource rolls dice using crypto/rand. rand.Int samples uniformly, so there is no modulo bias.
+func CryptoSource(sides int) (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(sides)))
+	if err != nil {
+		return 0, err
+	}
+	return int(n.Int64()) + 1, nil
+}
+
+// Die is a single rolled die.
+type Die struct {
+	Value int
+	// Kept is false for dice dropped by a keep modifier.
+	Kept bool
+	// Exploded is true for dice that rolled the maximum and caused another roll.
+	Exploded bool
+}
+
+// Group is the result of rolling one dice term like "4d6kh3".
+type Group struct {
+	Notation string
+	Dice     []Die
+	Total    int
+}
+
+// Result is an evaluated expression.
+type Result struct {
+	Expression string
+	Total      int
+	Groups     []Group
+	// explosions counts the extra dice rolled so far, see MaxExplosions
+	explosions int
+}
+
+// HTML renders the result with a per-die breakdown. Dropped dice are struck through.
+func (r Result) HTML() string {
+	var builder strings.Builder
+	builder.WriteString("🎲 <code>")
+	builder.WriteString(html.EscapeString(r.Expression))
+	builder.WriteString("</code> = <strong>")
+	builder.WriteString(strconv.Itoa(r.Total))
+	builder.WriteString("</strong>")
+	for _, g := range r.Groups {
+		builder.WriteString("<br/>")
+		builder.WriteString(html.EscapeString(g.Notation))
+		builder.WriteString(": ")
+		for i, d := range g.Dice {
+			if i > 0 {
+				builder.WriteString(", ")
+			}
+			value := strconv.Itoa(d.Value)
+			if d.Exploded {
+				value += "💥"
+			}
+			if !d.Kept {
+				value = "<del>" + value + "</del>"
+			}
+			builder.WriteString(value)
+		}
+		builder.WriteString(" (")
+		builder.WriteString(strconv.Itoa(g.Total))
+		builder.WriteString(")")
+	}
+	return builder.String()
+}
+
+// Expression is a parsed dice expression that can be rolled repeatedly.
+type Expression struct {
+	source string
+	root   node
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Roll evaluates the expression with the given source of randomness.
+func (e *Expression) Roll(source Source) (Result, error) {
+	result := Result{Expression: e.source}
+	total, err := e.root.eval(source, &result)
+	if err != nil {
+		return Result{}, err
+	}
+	result.Total = total
+	return result, nil
+}
+
+// Roll parses and rolls the expression using CryptoSource.
+func Roll(expression string) (Result, error) {
+	e, err := Parse(expression)
+	if err != nil {
+		return Result{}, err
+	}
+	return e.Roll(CryptoSource)
+}
+
+type node interface {
+	eval(Source, *Result) (int, error)
+}
+
+type number int
+
+func (n number) eval(Source, *Result) (int, error) {
+	return int(n), nil
+}
+
+type binary struct {
+	op          byte
+	left, right node
+}
+
+func (b binary) eval(source Source, result *Result) (int, error) {
+	l, err := b.left.eval(source, result)
+	if err != nil {
+		return 0, err
+	}
+	r, err := b.right.eval(source, result)
+	if err != nil {
+		return 0, err
+	}
+	switch b.op {
+	case '+':
+		if (r > 0 && l > maxInt-r) || (r < 0 && l < minInt-r) {
+			return 0, ErrTooLarge
+		}
+		return l + r, nil
+	case '-':
+		if (r < 0 && l > maxInt+r) || (r > 0 && l < minInt+r) {
+			return 0, ErrTooLarge
+		}
+		return l - r, nil
+	case '*':
+		if l == 0 || r == 0 {
+			return 0, nil
+		}
+		product := l * r
+		if product/r != l || (l == -1 && r == minInt) || (r == -1 && l == minInt) {
+			return 0, ErrTooLarge
+		}
+		return product, nil
+	case '/':
+		if r == 0 {
+			return 0, errors.New("division by zero")
+		}
+		if l == minInt && r == -1 {
+			return 0, ErrTooLarge
+		}
+		return l / r, nil
+	}
+	return 0, fmt.Errorf("unknown operator %q", b.op)
+}
+
+type negate struct {
+	operand node
+}
+
+func (n negate) eval(source Source, result *Result) (int, error) {
+	v, err := n.operand.eval(source, result)
+	if err != nil {
+		return 0, err
+	}
+	if v == minInt {
+		return 0, ErrTooLarge
+	}
+	return -v, nil
+}
+
+type dice struct {
+	notation  string
+	count     int
+	sides     int
+	explode   bool
+	keepHigh  int
+	keepLow   int
+	keepCount bool
+}
+
+func (d dice) eval(source Source, result *Result) (int, error) {
+	group := Group{Notation: d.notation}
+	for i := 0; i < d.count; i++ {
+		for {
+			v, err := source(d.sides)
+			if err != nil {
+				return 0, fmt.Errorf("could not roll: %w", err)
+			}
+			die := Die{Value: v, Kept: true}
+			if d.explode && v == d.sides && result.explosions < MaxExplosions {
+				die.Exploded = true
+				result.explosions++
+				group.Dice = append(group.Dice, die)
+				continue
+			}
+			group.Dice = append(group.Dice, die)
+			break
+		}
+	}
+
+	if d.keepCount {
+		keep := d.keepHigh
+		if d.keepLow > 0 {
+			keep = d.keepLow
+		}
+		order := make([]int, len(group.Dice))
+		for i := range order {
+			order[i] = i
+		}
+		// stable, so that of equal values the earlier rolls are kept
+		sort.SliceStable(order, func(i, j int) bool {
+			a, b := group.Dice[order[i]].Value, group.Dice[order[j]].Value
+			if d.keepLow > 0 {
+				return a < b
+			}
+			return a > b
+		})
+		for i, idx := range order {
+			group.Dice[idx].Kept = i < keep
+		}
+	}
+
+	for _, die := range group.Dice {
+		if die.Kept {
+			group.Total += die.Value
+		}
+	}
+	result.Groups = append(result.Groups, group)
+	return group.Total, nil
+}
+
+// Parse parses a dice expression. Supported are dice terms "NdM" (N defaults to 1, M may be "%" for 100) with
+// optional modifiers "khK"/"kK" (keep highest K), "klK" (keep lowest K) and "!" (exploding), integer constants,
+// the operators + - * / and parentheses.
+func Parse(expression string) (*Expression, error) {
+	p := &parser{input: strings.ToLower(strings.Join(strings.Fields(expression), " "))}
+	if p.input == "" {
+		return nil, ErrEmpty
+	}
+	root, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	p.space()
+	if p.pos < len(p.input) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos+1)
+	}
+	return &Expression{source: p.input, root: root}, nil
+}
+
+type parser struct {
+	input string
+	pos   int
+	// dice and groups count the dice terms parsed so far, see MaxDice and MaxGroups
+	dice   int
+	groups int
+}
+
+func (p *parser) peek() byte {
+	if p.pos >= len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+// space skips whitespace between tokens.
+func (p *parser) space() {
+	for p.peek() == ' ' {
+		p.pos++
+	}
+}
+
+func (p *parser) expr() (node, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for p.space(); p.peek() == '+' || p.peek() == '-'; p.space() {
+		op := p.peek()
+		p.pos++
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = binary{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) term() (node, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for p.space(); p.peek() == '*' || p.peek() == '/'; p.space() {
+		op := p.peek()
+		p.pos++
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		left = binary{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) factor() (node, error) {
+	p.space()
+	switch c := p.peek(); {
+	case c == '(':
+		p.pos++
+		n, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		p.space()
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing closing parenthesis at position %d", p.pos+1)
+		}
+		p.pos++
+		return n, nil
+	case c == '-':
+		p.pos++
+		n, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return negate{operand: n}, nil
+	case c == 'd' || isDigit(c):
+		return p.diceOrNumber()
+	case c == 0:
+		return nil, errors.New("unexpected end of expression")
+	default:
+		return nil, fmt.Errorf("unexpected %q at position %d", c, p.pos+1)
+	}
+}
+
+// integer reads a run of digits. ok is false if there are none.
+func (p *parser) integer() (n int, ok bool, err error) {
+	start := p.pos
+	for isDigit(p.peek()) {
+		p.pos++
+	}
+	if start == p.pos {
+		return 0, false, nil
+	}
+	n, err = strconv.Atoi(p.input[start:p.pos])
+	if err != nil {
+		return 0, false, fmt.Errorf("number too large at position %d", start+1)
+	}
+	return n, true, nil
+}
+
+func (p *parser) diceOrNumber() (node, error) {
+	start := p.pos
+	count, hasCount, err := p.integer()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != 'd' {
+		return number(count), nil
+	}
+	p.pos++
+	if !hasCount {
+		count = 1
+	}
+
+	d := dice{count: count}
+	if p.peek() == '%' {
+		p.pos++
+		d.sides = 100
+	} else {
+		sides, ok, err := p.integer()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("missing number of sides at position %d", p.pos+1)
+		}
+		d.sides = sides
+	}
+
+	for {
+		if p.peek() == '!' {
+			p.pos++
+			d.explode = true
+		} else if p.peek() == 'k' {
+			p.pos++
+			low := false
+			if p.peek() == 'h' {
+				p.pos++
+			} else if p.peek() == 'l' {
+				p.pos++
+				low = true
+			}
+			keep, ok, err := p.integer()
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, fmt.Errorf("missing number of dice to keep at position %d", p.pos+1)
+			}
+			d.keepCount = true
+			if low {
+				d.keepLow = keep
+			} else {
+				d.keepHigh = keep
+			}
+		} else {
+			break
+		}
+	}
+	d.notation = p.input[start:p.pos]
+
+	if d.count < 1 || d.count > MaxDice {
+		return nil, fmt.Errorf("%s: number of dice must be between 1 and %d", d.notation, MaxDice)
+	}
+	if d.sides < 1 || d.sides > MaxSides {
+		return nil, fmt.Errorf("%s: number of sides must be between 1 and %d", d.notation, MaxSides)
+	}
+	if d.explode && d.sides == 1 {
+		return nil, fmt.Errorf("%s: one-sided dice can't explode", d.notation)
+	}
+	if d.keepCount && (d.keepHigh+d.keepLow < 1 || d.keepHigh+d.keepLow > d.count) {
+		return nil, fmt.Errorf("%s: can only keep between 1 and %d dice", d.notation, d.count)
+	}
+	p.groups++
+	if p.groups > MaxGroups {
+		return nil, fmt.Errorf("%s: can roll at most %d groups of dice at once", d.notation, MaxGroups)
+	}
+	p.dice += d.count
+	if p.dice > MaxDice {
+		return nil, fmt.Errorf("%s: can roll at most %d dice at once", d.notation, MaxDice)
+	}
+
+	return d, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,143 @@
+package dice
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// sequence returns a source yielding the given values in order.
+func sequence(values ...int) Source {
+	i := 0
+	return func(sides int) (int, error) {
+		v := values[i%len(values)]
+		i++
+		return v, nil
+	}
+}
+
+func TestRoll(t *testing.T) {
+	data := []struct {
+		expression string
+		rolls      []int
+		total      int
+	}{
+		{"3d20+5", []int{4, 12, 6}, 27},
+		{"d20", []int{17}, 17},
+		{"4d6kh3", []int{3, 1, 5, 3}, 11},
+		{"4d6k3", []int{3, 1, 5, 3}, 11},
+		{"2d20kl1", []int{15, 4}, 4},
+		{"2d10!", []int{10, 10, 3, 7}, 30},
+		{"d%", []int{42}, 42},
+		{"2d6 + 1d8 - 2", []int{3, 4, 8}, 13},
+		{"(1d4+1)*2", []int{3}, 8},
+		{"10/3", nil, 3},
+		{"-d4+10", []int{2}, 8},
+	}
+
+	for _, d := range data {
+		e, err := Parse(d.expression)
+		assert.NilError(t, err, d.expression)
+		rolls := d.rolls
+		if rolls == nil {
+			rolls = []int{1}
+		}
+		result, err := e.Roll(sequence(rolls...))
+		assert.NilError(t, err, d.expression)
+		assert.Equal(t, result.Total, d.total, d.expression)
+	}
+}
+
+func TestRollGroups(t *testing.T) {
+	e, err := Parse("4d6kh3 + 2d10!")
+	assert.NilError(t, err)
+	result, err := e.Roll(sequence(3, 1, 5, 3, 10, 2, 6))
+	assert.NilError(t, err)
+
+	assert.Equal(t, len(result.Groups), 2)
+	assert.DeepEqual(t, result.Groups[0], Group{
+		Notation: "4d6kh3",
+		Dice:     []Die{{3, true, false}, {1, false, false}, {5, true, false}, {3, true, false}},
+		Total:    11,
+	})
+	assert.DeepEqual(t, result.Groups[1], Group{
+		Notation: "2d10!",
+		Dice:     []Die{{10, true, true}, {2, true, false}, {6, true, false}},
+		Total:    18,
+	})
+	assert.Equal(t, result.Total, 29)
+
+	html := result.HTML()
+	assert.Assert(t, strings.Contains(html, "<strong>29</strong>"))
+	assert.Assert(t, strings.Contains(html, "<del>1</del>"))
+	assert.Assert(t, strings.Contains(html, "10💥"))
+}
+
+func TestExplosionsAreCapped(t *testing.T) {
+	e, err := Parse("1d6!")
+	assert.NilError(t, err)
+	result, err := e.Roll(sequence(6))
+	assert.NilError(t, err)
+	assert.Equal(t, len(result.Groups[0].Dice), MaxExplosions+1)
+
+	// across the whole expression
+	e, err = Parse("1d6! + 1d6!")
+	assert.NilError(t, err)
+	result, err = e.Roll(sequence(6))
+	assert.NilError(t, err)
+	assert.Equal(t, len(result.Groups[0].Dice)+len(result.Groups[1].Dice), MaxExplosions+2)
+}
+
+func TestRollTooLarge(t *testing.T) {
+	for _, expression := range []string{
+		"2147483647 * 2147483647 * 2147483647",
+		"0 - 2147483647 * 2147483647 * 2147483647 * 4",
+		"1d6 * 2147483647 * 2147483647 * 2147483647",
+	} {
+		e, err := Parse(expression)
+		assert.NilError(t, err, expression)
+		_, err = e.Roll(sequence(6))
+		assert.Equal(t, err, ErrTooLarge, expression)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	data := []struct {
+		expression string
+		err        string
+	}{
+		{"", "empty expression"},
+		{"3d", "missing number of sides"},
+		{"101d6", "number of dice must be between"},
+		{"1d1001", "number of sides must be between"},
+		{"2d6kh3", "can only keep between"},
+		{"1d1!", "can't explode"},
+		{"(1d6", "missing closing parenthesis"},
+		{"1d6+", "unexpected end"},
+		{"fireball", "unexpected"},
+		{"1d6 2", "unexpected"},
+		{"99999999999999999999d6", "number too large at position 1"},
+		{"1d99999999999999999999", "number too large at position 3"},
+		{"4d6kh99999999999999999999", "number too large at position 6"},
+		{"1d6 + 99999999999999999999", "number too large at position 7"},
+		{"60d6 + 50d6", "50d6: can roll at most 100 dice at once"},
+		{"1d4+1d4+1d4+1d4+1d4+1d4+1d4+1d4+1d4+1d4+1d6", "1d6: can roll at most 10 groups of dice at once"},
+	}
+
+	for _, d := range data {
+		_, err := Parse(d.expression)
+		assert.ErrorContains(t, err, d.err, d.expression)
+	}
+}
+
+func TestCryptoSourceRange(t *testing.T) {
+	seen := make(map[int]int)
+	for i := 0; i < 6000; i++ {
+		v, err := CryptoSource(6)
+		assert.NilError(t, err)
+		assert.Assert(t, v >= 1 && v <= 6, v)
+		seen[v]++
+	}
+	assert.Equal(t, len(seen), 6)
+}
@@ -0,0 +1,226 @@
+// Package httpcache provides a HTTP client for external lookups that caches responses according to their
+// Cache-Control and ETag headers.
+package httpcache
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultTimeout = 10 * time.Second
+	DefaultTTL     = 10 * time.Minute
+)
+
+var (
+	hits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jarvis_httpcache_hits_total",
+		Help: "Requests served from the cache, including revalidated and stale responses.",
+	}, []string{"host", "kind"})
+	misses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jarvis_httpcache_misses_total",
+		Help: "Requests that went upstream because nothing fresh was cached, whether they succeeded or not.",
+	}, []string{"host"})
+	upstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jarvis_httpcache_upstream_errors_total",
+		Help: "Upstream requests that failed or returned an unexpected status.",
+	}, []string{"host"})
+)
+
+// StatusError is returned when upstream responds with anything but 200 OK.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %s from %s", e.Status, e.URL)
+}
+
+// Entry is a cached response.
+type Entry struct {
+	URL          string    `db:"url"`
+	StatusCode   int       `db:"status_code"`
+	Body         []byte    `db:"body"`
+	ETag         string    `db:"etag"`
+	LastModified string    `db:"last_modified"`
+	ContentType  string    `db:"content_type"`
+	FetchedAt    time.Time `db:"fetched_at"`
+	ExpiresAt    time.Time `db:"expires_at"`
+}
+
+// Fresh reports whether the entry can be served without revalidation.
+func (e *Entry) Fresh(now time.Time) bool {
+	return now.Before(e.ExpiresAt)
+}
+
+// Store persists cached entries. Get returns nil and no error if there is no entry for the URL.
+type Store interface {
+	Get(ctx context.Context, url string) (*Entry, error)
+	Set(ctx context.Context, entry *Entry) error
+}
+
+func NewClient(store Store, defaultTTL time.Duration) *Client {
+	return &Client{
+		http: &http.Client{
+			Timeout: DefaultTimeout,
+		},
+		store:      store,
+		defaultTTL: defaultTTL,
+		now:        time.Now,
+		logger:     log.With().Str("component", "httpcache").Logger(),
+	}
+}
+
+// Client performs GET requests, serving fresh responses from its store and revalidating stale ones with
+// If-None-Match/If-Modified-Since.
+type Client struct {
+	http       *http.Client
+	store      Store
+	defaultTTL time.Duration
+	now        func() time.Time
+	logger     zerolog.Logger
+}
+
+// Get returns the body of the resource at url. If upstream fails but a stale entry is cached, the stale body is
+// returned instead of the error.
+func (c *Client) Get(ctx context.Context, rawURL string) ([]byte, error) {
+	host := hostOf(rawURL)
+	logger := c.logger.With().Str("url", rawURL).Logger()
+
+	cached, err := c.store.Get(ctx, rawURL)
+	if err != nil {
+		logger.Error().Err(err).Msg("could not read cache")
+		cached = nil
+	}
+	if cached != nil && cached.Fresh(c.now()) {
+		hits.WithLabelValues(host, "fresh").Inc()
+		return cached.Body, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	misses.WithLabelValues(host).Inc()
+	resp, err := c.http.Do(req)
+	if err != nil {
+		upstreamErrors.WithLabelValues(host).Inc()
+		return c.stale(host, cached, fmt.Errorf("HTTP GET failed: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		hits.WithLabelValues(host, "revalidated").Inc()
+		cached.FetchedAt = c.now()
+		cached.ExpiresAt = c.expiry(resp.Header)
+		if err := c.store.Set(ctx, cached); err != nil {
+			logger.Error().Err(err).Msg("could not update cache")
+		}
+		return cached.Body, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		upstreamErrors.WithLabelValues(host).Inc()
+		return c.stale(host, cached, &StatusError{URL: rawURL, StatusCode: resp.StatusCode, Status: resp.Status})
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		upstreamErrors.WithLabelValues(host).Inc()
+		return c.stale(host, cached, fmt.Errorf("unable to read response: %w", err))
+	}
+
+	if cacheable(resp.Header) {
+		entry := &Entry{
+			URL:          rawURL,
+			StatusCode:   resp.StatusCode,
+			Body:         body,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			ContentType:  resp.Header.Get("Content-Type"),
+			FetchedAt:    c.now(),
+			ExpiresAt:    c.expiry(resp.Header),
+		}
+		if err := c.store.Set(ctx, entry); err != nil {
+			logger.Error().Err(err).Msg("could not write cache")
+		}
+	}
+
+	return body, nil
+}
+
+func (c *Client) stale(host string, cached *Entry, err error) ([]byte, error) {
+	if cached == nil {
+		return nil, err
+	}
+	c.logger.Warn().Err(err).Str("url", cached.URL).Msg("serving stale response")
+	hits.WithLabelValues(host, "stale").Inc()
+	return cached.Body, nil
+}
+
+// expiry computes when a response expires from its Cache-Control max-age, falling back to the default TTL.
+// Responses marked no-cache expire immediately but are kept for revalidation.
+func (c *Client) expiry(header http.Header) time.Time {
+	now := c.now()
+	directives := parseCacheControl(header.Get("Cache-Control"))
+	if _, ok := directives["no-cache"]; ok {
+		return now
+	}
+	if maxAge, ok := directives["max-age"]; ok {
+		if seconds, err := strconv.Atoi(maxAge); err == nil {
+			return now.Add(time.Duration(seconds) * time.Second)
+		}
+	}
+	return now.Add(c.defaultTTL)
+}
+
+func cacheable(header http.Header) bool {
+	_, noStore := parseCacheControl(header.Get("Cache-Control"))["no-store"]
+	return !noStore
+}
+
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, val := part, ""
+		if i := strings.Index(part, "="); i >= 0 {
+			key, val = part[:i], strings.Trim(part[i+1:], `"`)
+		}
+		directives[strings.ToLower(key)] = val
+	}
+	return directives
+}
+
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "invalid"
+	}
+	return u.Host
+}
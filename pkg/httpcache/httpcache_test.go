@@ -0,0 +1,159 @@
+package httpcache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ilikeorangutans/jarvis/pkg/database"
+	"github.com/ilikeorangutans/jarvis/pkg/database/databasetest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+)
+
+type upstream struct {
+	requests    int32
+	revalidated int32
+	etag        string
+	header      http.Header
+	status      int
+}
+
+func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&u.requests, 1)
+	if u.etag != "" && r.Header.Get("If-None-Match") == u.etag {
+		atomic.AddInt32(&u.revalidated, 1)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	for key, values := range u.header {
+		w.Header()[key] = values
+	}
+	if u.etag != "" {
+		w.Header().Set("ETag", u.etag)
+	}
+	if u.status != 0 {
+		w.WriteHeader(u.status)
+	}
+	w.Write([]byte("hello"))
+}
+
+func newTestClient(store Store) (*Client, *time.Time) {
+	now := time.Date(2021, time.January, 8, 12, 0, 0, 0, time.UTC)
+	c := NewClient(store, time.Minute)
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func TestClientCachesUntilMaxAge(t *testing.T) {
+	u := &upstream{header: http.Header{"Cache-Control": {"public, max-age=300"}}}
+	server := httptest.NewServer(u)
+	defer server.Close()
+
+	c, now := newTestClient(NewMemoryStore())
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		body, err := c.Get(ctx, server.URL)
+		assert.NilError(t, err)
+		assert.Equal(t, string(body), "hello")
+	}
+	assert.Equal(t, u.requests, int32(1))
+
+	*now = now.Add(301 * time.Second)
+	_, err := c.Get(ctx, server.URL)
+	assert.NilError(t, err)
+	assert.Equal(t, u.requests, int32(2))
+}
+
+func TestClientRevalidatesWithETag(t *testing.T) {
+	u := &upstream{etag: `"v1"`, header: http.Header{"Cache-Control": {"no-cache"}}}
+	server := httptest.NewServer(u)
+	defer server.Close()
+
+	c, _ := newTestClient(NewMemoryStore())
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		body, err := c.Get(ctx, server.URL)
+		assert.NilError(t, err)
+		assert.Equal(t, string(body), "hello")
+	}
+	assert.Equal(t, u.requests, int32(2))
+	assert.Equal(t, u.revalidated, int32(1))
+}
+
+func TestClientDoesNotStoreNoStore(t *testing.T) {
+	u := &upstream{header: http.Header{"Cache-Control": {"no-store"}}}
+	server := httptest.NewServer(u)
+	defer server.Close()
+
+	store := NewMemoryStore()
+	c, _ := newTestClient(store)
+	ctx := context.Background()
+
+	_, err := c.Get(ctx, server.URL)
+	assert.NilError(t, err)
+	entry, err := store.Get(ctx, server.URL)
+	assert.NilError(t, err)
+	assert.Assert(t, entry == nil)
+}
+
+func TestClientStatusErrorsAndStaleFallback(t *testing.T) {
+	u := &upstream{}
+	server := httptest.NewServer(u)
+	defer server.Close()
+
+	c, now := newTestClient(NewMemoryStore())
+	ctx := context.Background()
+	upstreamRequests := misses.WithLabelValues(hostOf(server.URL))
+	before := testutil.ToFloat64(upstreamRequests)
+
+	_, err := c.Get(ctx, server.URL)
+	assert.NilError(t, err)
+
+	u.status = http.StatusBadGateway
+	*now = now.Add(2 * time.Minute)
+	body, err := c.Get(ctx, server.URL)
+	assert.NilError(t, err)
+	assert.Equal(t, string(body), "hello")
+
+	_, err = c.Get(ctx, server.URL+"/other")
+	var statusErr *StatusError
+	assert.Assert(t, errors.As(err, &statusErr))
+	assert.Equal(t, statusErr.StatusCode, http.StatusBadGateway)
+	// failed requests went upstream too
+	assert.Equal(t, testutil.ToFloat64(upstreamRequests)-before, float64(3))
+}
+
+func TestSQLStore(t *testing.T) {
+	databasetest.Migrated(t, databasetest.Core, testSQLStore)
+}
+
+func testSQLStore(t *testing.T, db *database.DB) {
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	entry, err := store.Get(ctx, "https://example.com")
+	assert.NilError(t, err)
+	assert.Assert(t, entry == nil)
+
+	expires := time.Date(2021, time.January, 8, 12, 0, 0, 0, time.UTC)
+	assert.NilError(t, store.Set(ctx, &Entry{URL: "https://example.com", StatusCode: 200, Body: []byte("a"), ETag: `"1"`, ExpiresAt: expires}))
+	assert.NilError(t, store.Set(ctx, &Entry{URL: "https://example.com", StatusCode: 200, Body: []byte("b"), ETag: `"2"`, ExpiresAt: expires}))
+
+	entry, err = store.Get(ctx, "https://example.com")
+	assert.NilError(t, err)
+	assert.Equal(t, string(entry.Body), "b")
+	assert.Equal(t, entry.ETag, `"2"`)
+	assert.Assert(t, entry.ExpiresAt.Equal(expires))
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = store.Get(cancelled, "https://example.com")
+	assert.Assert(t, errors.Is(err, context.Canceled), err)
+}
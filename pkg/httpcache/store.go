@@ -0,0 +1,89 @@
+package httpcache
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+)
+
+func NewMemoryStore() Store {
+	return &memoryStore{
+		entries: make(map[string]Entry),
+	}
+}
+
+type memoryStore struct {
+	sync.Mutex
+	entries map[string]Entry
+}
+
+func (m *memoryStore) Get(ctx context.Context, url string) (*Entry, error) {
+	m.Lock()
+	defer m.Unlock()
+	entry, ok := m.entries[url]
+	if !ok {
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+func (m *memoryStore) Set(ctx context.Context, entry *Entry) error {
+	m.Lock()
+	defer m.Unlock()
+	m.entries[entry.URL] = *entry
+	return nil
+}
+
+// DB is the database a SQL store runs on: squirrel needs the plain methods, queries honour the context.
+type DB interface {
+	sqlx.Ext
+	sqlx.QueryerContext
+	sqlx.ExecerContext
+}
+
+// NewSQLStore returns a store persisting entries in the http_cache table so restarts don't refetch.
+func NewSQLStore(db DB) Store {
+	return &sqlStore{
+		db: db,
+	}
+}
+
+type sqlStore struct {
+	db DB
+}
+
+func (s *sqlStore) Get(ctx context.Context, url string) (*Entry, error) {
+	entry := &Entry{}
+	query, args := sq.Select("*").From("http_cache").Where(sq.Eq{"url": url}).Limit(1).MustSql()
+	err := sqlx.GetContext(ctx, s.db, entry, query, args...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not load cache entry: %w", err)
+	}
+
+	return entry, nil
+}
+
+func (s *sqlStore) Set(ctx context.Context, entry *Entry) error {
+	_, err := sq.
+		Insert("http_cache").
+		Columns("url", "status_code", "body", "etag", "last_modified", "content_type", "fetched_at", "expires_at").
+		Values(entry.URL, entry.StatusCode, entry.Body, entry.ETag, entry.LastModified, entry.ContentType, entry.FetchedAt, entry.ExpiresAt).
+		Suffix(
+			"on conflict (url) do update set status_code = ?, body = ?, etag = ?, last_modified = ?, content_type = ?, fetched_at = ?, expires_at = ?",
+			entry.StatusCode, entry.Body, entry.ETag, entry.LastModified, entry.ContentType, entry.FetchedAt, entry.ExpiresAt,
+		).
+		RunWith(s.db).
+		ExecContext(ctx)
+	if err != nil {
+		return fmt.Errorf("could not save cache entry: %w", err)
+	}
+
+	return nil
+}
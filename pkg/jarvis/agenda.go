@@ -2,30 +2,373 @@ package jarvis
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	sq "github.com/Masterminds/squirrel"
 	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"github.com/ilikeorangutans/jarvis/pkg/database"
+	"github.com/ilikeorangutans/jarvis/pkg/httpcache"
 	"github.com/ilikeorangutans/jarvis/pkg/predicates"
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog/log"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
-func AddAgendaHandlers(ctx context.Context, b *bot.Bot) error {
+var (
+	agendaRegex = regexp.MustCompile(`(?i)\A\s*agenda\s+(enable|disable|status)(\s+at\s+([0-9]{1,2}):?([0-9]{2})?\s*(am|pm)?)?(\s+for\s+([a-z]{2}-[0-9]+))?`)
+)
+
+type AgendaSubscription struct {
+	ID        int64
+	Room      id.RoomID
+	User      id.UserID
+	Hour      string
+	Minute    string
+	CityCode  string        `db:"city_code"`
+	EntryID   *cron.EntryID `db:"entry_id"`
+	CreatedAt time.Time     `db:"created_at"`
+}
+
+func (s *AgendaSubscription) ToSpec() string {
+	return fmt.Sprintf("%s %s * * *", s.Minute, s.Hour)
+}
+
+func (s *AgendaSubscription) String() string {
+	return fmt.Sprintf("every day at %s:%s with the weather for %s", s.Hour, s.Minute, s.CityCode)
+}
+
+// AgendaSection renders one part of the daily briefing as HTML. Sections that fail are left out of the briefing.
+type AgendaSection func(ctx context.Context, subscription *AgendaSubscription, now time.Time) (string, error)
+
+func NewAgenda(ctx context.Context, b *bot.Bot, c *cron.Cron, db *database.DB, sections ...AgendaSection) (*Agenda, error) {
+	return &Agenda{
+		ctx:      ctx,
+		c:        c,
+		b:        b,
+		db:       db,
+		sections: sections,
+	}, nil
+}
+
+// Agenda sends a daily morning briefing to subscribed users.
+type Agenda struct {
+	// ctx is the context briefings are composed in; request contexts end long before briefings are due
+	ctx      context.Context
+	c        *cron.Cron
+	b        *bot.Bot
+	db       *database.DB
+	sections []AgendaSection
+}
+
+func (a *Agenda) Start(ctx context.Context) error {
+	a.ctx = ctx
+	var subscriptions []*AgendaSubscription
+	if err := a.db.SelectContext(ctx, &subscriptions, "select * from agenda_subscriptions"); err != nil {
+		return err
+	}
+	log.Info().Int("count", len(subscriptions)).Msg("rescheduling agendas")
+	for _, subscription := range subscriptions {
+		a.schedule(ctx, subscription)
+	}
+
+	return nil
+}
+
+// Find returns the subscription for the user in the given room, or nil if there is none.
+func (a *Agenda) Find(ctx context.Context, roomID id.RoomID, userID id.UserID) (*AgendaSubscription, error) {
+	subscription := &AgendaSubscription{}
+	query, args := sq.Select("*").From("agenda_subscriptions").Where(sq.Eq{"room": roomID, `"user"`: userID}).Limit(1).MustSql()
+	err := a.db.GetContext(ctx, subscription, query, args...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return subscription, nil
+}
+
+// Enable subscribes the user, replacing any existing subscription in the same room.
+func (a *Agenda) Enable(ctx context.Context, subscription *AgendaSubscription) error {
+	if _, err := a.Disable(ctx, subscription.Room, subscription.User); err != nil {
+		return err
+	}
+
+	id, err := database.InsertReturningID(ctx, a.db, sq.
+		Insert("agenda_subscriptions").
+		Columns("room", `"user"`, "hour", "minute", "city_code", "created_at").
+		Values(subscription.Room, subscription.User, subscription.Hour, subscription.Minute, subscription.CityCode, subscription.CreatedAt))
+	if err != nil {
+		return fmt.Errorf("could not insert record: %w", err)
+	}
+	subscription.ID = id
+
+	a.schedule(ctx, subscription)
+
+	return nil
+}
+
+// Disable removes the user's subscription and reports whether there was one.
+func (a *Agenda) Disable(ctx context.Context, roomID id.RoomID, userID id.UserID) (bool, error) {
+	subscription, err := a.Find(ctx, roomID, userID)
+	if err != nil {
+		return false, err
+	}
+	if subscription == nil {
+		return false, nil
+	}
+
+	if subscription.EntryID != nil {
+		a.c.Remove(*subscription.EntryID)
+	}
+
+	_, err = sq.Delete("agenda_subscriptions").Where(sq.Eq{"id": subscription.ID}).RunWith(a.db).ExecContext(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (a *Agenda) schedule(ctx context.Context, subscription *AgendaSubscription) {
+	spec := subscription.ToSpec()
+	log.Info().Str("spec", spec).Str("user-id", subscription.User.String()).Msg("scheduling agenda")
+	entryID, err := a.c.AddFunc(spec, func() {
+		a.send(a.ctx, subscription)
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("could not schedule")
+		return
+	}
+
+	subscription.EntryID = &entryID
+	_, err = sq.
+		Update("agenda_subscriptions").
+		Set("entry_id", subscription.EntryID).
+		Where(sq.Eq{"id": subscription.ID}).
+		RunWith(a.db).
+		ExecContext(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("could not update")
+	}
+}
+
+func (a *Agenda) send(ctx context.Context, subscription *AgendaSubscription) {
+	log.Info().Str("user-id", subscription.User.String()).Str("room-id", subscription.Room.String()).Msg("sending agenda")
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	a.b.Client().SendHTML(subscription.Room, a.Compose(ctx, subscription, time.Now().In(a.c.Location())))
+}
+
+// Compose renders all sections into a single briefing.
+func (a *Agenda) Compose(ctx context.Context, subscription *AgendaSubscription, now time.Time) string {
+	user, _, _ := subscription.User.Parse()
+
+	var builder strings.Builder
+	builder.WriteString("<h3>☀️ Good morning, ")
+	builder.WriteString(user)
+	builder.WriteString("! Here's your agenda for ")
+	builder.WriteString(now.Format("Monday, January 2"))
+	builder.WriteString("</h3>")
+	for _, section := range a.sections {
+		html, err := section(ctx, subscription, now)
+		if err != nil {
+			log.Error().Err(err).Msg("could not render agenda section")
+			continue
+		}
+		if html == "" {
+			continue
+		}
+		builder.WriteString(html)
+	}
+
+	return builder.String()
+}
+
+// WeatherAgendaSection renders warnings, current conditions and the next forecast periods.
+func WeatherAgendaSection(httpClient *httpcache.Client) AgendaSection {
+	return func(ctx context.Context, subscription *AgendaSubscription, now time.Time) (string, error) {
+		feed, err := FetchFeed(ctx, httpClient, subscription.CityCode)
+		if err != nil {
+			return "", err
+		}
+
+		var builder strings.Builder
+		for _, warning := range feed.Warnings() {
+			builder.WriteString("<p><strong>⚠️ ")
+			builder.WriteString(warning.Title)
+			builder.WriteString("</strong></p>")
+		}
+		if current, err := feed.CurrentConditions(); err == nil {
+			builder.WriteString("<p>🌦️ Currently ")
+			builder.WriteString(current.String())
+			builder.WriteString("</p>")
+		}
+		forecasts := feed.Forecasts()
+		if len(forecasts) > 2 {
+			forecasts = forecasts[:2]
+		}
+		if len(forecasts) > 0 {
+			builder.WriteString("<ul>")
+			for _, forecast := range forecasts {
+				builder.WriteString("<li>")
+				builder.WriteString(forecast.Title)
+				builder.WriteString("</li>")
+			}
+			builder.WriteString("</ul>")
+		}
+
+		return builder.String(), nil
+	}
+}
+
+func SunAgendaSection(locations *Locations) AgendaSection {
+	return func(ctx context.Context, subscription *AgendaSubscription, now time.Time) (string, error) {
+		location, err := locations.ForUser(ctx, subscription.User)
+		if err != nil {
+			return "", err
+		}
+		times := ComputeSunTimes(location, now)
+		return "<p>" + FormatSunTimes(times, ComputeMoonPhase(now)) + "</p>", nil
+	}
+}
+
+// ReminderAgendaSection lists the user's reminders that fire today.
+func ReminderAgendaSection(reminders *Reminders) AgendaSection {
+	return func(ctx context.Context, subscription *AgendaSubscription, now time.Time) (string, error) {
+		list, err := reminders.List(subscription.User)
+		if err != nil {
+			return "", err
+		}
+
+		var builder strings.Builder
+		for _, reminder := range list {
+			if !reminder.OccursOn(now) {
+				continue
+			}
+			builder.WriteString("<li>")
+			builder.WriteString(reminder.TimeOfDay())
+			builder.WriteString(": ")
+			builder.WriteString(reminder.Message)
+			builder.WriteString("</li>")
+		}
+		if builder.Len() == 0 {
+			return "<p>🗓️ No reminders today.</p>", nil
+		}
+
+		return "<p>🗓️ Today's reminders:</p><ul>" + builder.String() + "</ul>", nil
+	}
+}
+
+// AgendaCityCodeFromParts extracts the city whose weather the agenda includes from an agendaRegex match, defaulting to
+// Toronto.
+func AgendaCityCodeFromParts(parts []string) string {
+	if parts[7] == "" {
+		return defaultCityCode
+	}
+	return strings.ToLower(parts[7])
+}
+
+// AgendaTimeFromParts extracts hour and minute from an agendaRegex match, defaulting to 7am.
+func AgendaTimeFromParts(parts []string) (string, string, error) {
+	hour := "07"
+	minute := "00"
+	if parts[3] != "" {
+		h, err := strconv.Atoi(parts[3])
+		if err != nil {
+			return "", "", err
+		}
+		switch strings.ToLower(parts[5]) {
+		case "pm":
+			if h < 12 {
+				h += 12
+			}
+		case "am":
+			if h == 12 {
+				h = 0
+			}
+		}
+		if h > 23 {
+			return "", "", fmt.Errorf("%d is not a valid hour", h)
+		}
+		hour = fmt.Sprintf("%02d", h)
+	}
+	if parts[4] != "" {
+		m, err := strconv.Atoi(parts[4])
+		if err != nil {
+			return "", "", err
+		}
+		if m > 59 {
+			return "", "", fmt.Errorf("%d is not a valid minute", m)
+		}
+		minute = fmt.Sprintf("%02d", m)
+	}
+
+	return hour, minute, nil
+}
+
+func AddAgendaHandlers(ctx context.Context, b *bot.Bot, agenda *Agenda) error {
 	b.On(
 		func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
 			msg := evt.Content.AsMessage()
-			if strings.Contains(strings.ToLower(msg.Body), "enable") {
-				client.SendText(evt.RoomID, "agenda enable")
-			} else if strings.Contains(strings.ToLower(msg.Body), "disable") {
-				client.SendText(evt.RoomID, "agenda disable")
-			} else {
-				client.SendText(evt.RoomID, "agenda status")
+			parts := agendaRegex.FindStringSubmatch(msg.Body)
+			user, _, _ := evt.Sender.Parse()
+
+			switch strings.ToLower(parts[1]) {
+			case "enable":
+				hour, minute, err := AgendaTimeFromParts(parts)
+				if err != nil {
+					client.SendText(evt.RoomID, fmt.Sprintf("I'm afraid I didn't understand that time: %s", err))
+					return nil
+				}
+				subscription := &AgendaSubscription{
+					Room:      evt.RoomID,
+					User:      evt.Sender,
+					Hour:      hour,
+					Minute:    minute,
+					CityCode:  AgendaCityCodeFromParts(parts),
+					CreatedAt: time.Now(),
+				}
+				if err := agenda.Enable(ctx, subscription); err != nil {
+					client.SendText(evt.RoomID, fmt.Sprintf("Terribly sorry, but I couldn't enable your agenda: %s", err))
+					return err
+				}
+				client.SendText(evt.RoomID, fmt.Sprintf("☀️ Very good %s, I'll send you your agenda %s.", user, subscription))
+			case "disable":
+				removed, err := agenda.Disable(ctx, evt.RoomID, evt.Sender)
+				if err != nil {
+					client.SendText(evt.RoomID, fmt.Sprintf("Terribly sorry, but I couldn't disable your agenda: %s", err))
+					return err
+				}
+				if !removed {
+					client.SendText(evt.RoomID, fmt.Sprintf("You don't have an agenda in this room, %s.", user))
+					return nil
+				}
+				client.SendText(evt.RoomID, fmt.Sprintf("✅ Very good %s, no more agendas for you.", user))
+			default:
+				subscription, err := agenda.Find(ctx, evt.RoomID, evt.Sender)
+				if err != nil {
+					return err
+				}
+				if subscription == nil {
+					client.SendHTML(evt.RoomID, fmt.Sprintf("You don't have an agenda in this room, %s. Enable it like so: <tt>agenda enable at 7am</tt>", user))
+					return nil
+				}
+				client.SendText(evt.RoomID, fmt.Sprintf("☀️ I'm sending you your agenda %s, %s.", subscription, user))
 			}
 			return nil
 		},
 		predicates.All(
-			predicates.MessageMatching(regexp.MustCompile(`(?i)\A\s*agenda\s+(enable|disable|status)`)),
+			predicates.MessageMatching(agendaRegex),
 		),
 	)
 
@@ -0,0 +1,95 @@
+package jarvis
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"github.com/ilikeorangutans/jarvis/pkg/bot/bottest"
+	"github.com/ilikeorangutans/jarvis/pkg/database"
+	"github.com/ilikeorangutans/jarvis/pkg/database/databasetest"
+	"github.com/robfig/cron/v3"
+	"gotest.tools/assert"
+)
+
+func TestAgendaTimeFromParts(t *testing.T) {
+	data := []struct {
+		input  string
+		hour   string
+		minute string
+	}{
+		{"agenda enable", "07", "00"},
+		{"agenda enable at 6am", "06", "00"},
+		{"agenda enable at 6:45", "06", "45"},
+		{"agenda enable at 12am", "00", "00"},
+		{"agenda enable at 1pm", "13", "00"},
+		{"agenda enable at 0815", "08", "15"},
+	}
+
+	for _, d := range data {
+		parts := agendaRegex.FindStringSubmatch(d.input)
+		hour, minute, err := AgendaTimeFromParts(parts)
+		assert.NilError(t, err, d.input)
+		assert.Equal(t, hour, d.hour, d.input)
+		assert.Equal(t, minute, d.minute, d.input)
+	}
+
+	_, _, err := AgendaTimeFromParts(agendaRegex.FindStringSubmatch("agenda enable at 25"))
+	assert.ErrorContains(t, err, "not a valid hour")
+}
+
+func TestAgendaCityCodeFromParts(t *testing.T) {
+	assert.Equal(t, AgendaCityCodeFromParts(agendaRegex.FindStringSubmatch("agenda enable")), "on-143")
+	assert.Equal(t, AgendaCityCodeFromParts(agendaRegex.FindStringSubmatch("agenda enable for BC-74")), "bc-74")
+	assert.Equal(t, AgendaCityCodeFromParts(agendaRegex.FindStringSubmatch("agenda enable at 6:45pm for qc-147")), "qc-147")
+}
+
+func TestAgendaCompose(t *testing.T) {
+	agenda, err := NewAgenda(context.Background(), nil, nil, nil,
+		func(ctx context.Context, subscription *AgendaSubscription, now time.Time) (string, error) {
+			return "<p>first</p>", nil
+		},
+		func(ctx context.Context, subscription *AgendaSubscription, now time.Time) (string, error) {
+			return "", errors.New("broken")
+		},
+		func(ctx context.Context, subscription *AgendaSubscription, now time.Time) (string, error) {
+			return "<p>third</p>", nil
+		},
+	)
+	assert.NilError(t, err)
+
+	now := time.Date(2021, time.January, 8, 7, 0, 0, 0, time.UTC)
+	html := agenda.Compose(context.Background(), &AgendaSubscription{User: "@jakob:example.com"}, now)
+	assert.Assert(t, strings.Contains(html, "Good morning, jakob"))
+	assert.Assert(t, strings.Contains(html, "Friday, January 8"))
+	assert.Assert(t, strings.HasSuffix(html, "<p>first</p><p>third</p>"))
+}
+
+func TestAgendaHandlers(t *testing.T) {
+	databasetest.Migrated(t, withModules("agenda"), func(t *testing.T, db *database.DB) {
+		h := bottest.New(t, bot.BotConfiguration{})
+		c := cron.New()
+		agenda, err := NewAgenda(context.Background(), h.Bot, c, db,
+			func(ctx context.Context, subscription *AgendaSubscription, now time.Time) (string, error) {
+				return "<p>weather for " + subscription.CityCode + "</p>", ctx.Err()
+			},
+		)
+		assert.NilError(t, err)
+		assert.NilError(t, AddAgendaHandlers(context.Background(), h.Bot, agenda))
+
+		h.Send(bottest.Room, "@alice:example.com", "agenda enable at 6am for bc-74")
+		assert.DeepEqual(t, h.Bodies(bottest.Room), []string{"☀️ Very good alice, I'll send you your agenda every day at 06:00 with the weather for bc-74."})
+
+		// the briefing is sent long after the handler's context ended
+		subscription, err := agenda.Find(context.Background(), bottest.Room, "@alice:example.com")
+		assert.NilError(t, err)
+		h.Client.Reset()
+		c.Entry(*subscription.EntryID).Job.Run()
+		bodies := h.Bodies(bottest.Room)
+		assert.Equal(t, len(bodies), 1)
+		assert.Assert(t, strings.HasSuffix(bodies[0], "<p>weather for bc-74</p>"), bodies[0])
+	})
+}
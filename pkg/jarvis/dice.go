@@ -2,40 +2,220 @@ package jarvis
 
 import (
 	"context"
-	"crypto/rand"
+	"database/sql"
+	"errors"
 	"fmt"
+	"html"
 	"regexp"
-	"strconv"
 	"strings"
+	"time"
 
+	sq "github.com/Masterminds/squirrel"
 	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"github.com/ilikeorangutans/jarvis/pkg/dice"
 	"github.com/ilikeorangutans/jarvis/pkg/predicates"
+	"github.com/jmoiron/sqlx"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
-func AddDiceHandler(b *bot.Bot) {
-	r := regexp.MustCompile(`(?i)\A([0-9]+\s+)?dice\s+roll\s*`)
+var (
+	legacyDiceRegex = regexp.MustCompile(`(?i)\A([0-9]+\s+)?dice\s+roll\s*`)
+	rollRegex       = regexp.MustCompile(`(?i)\A\s*roll\s+(.+)`)
+	saveRollRegex   = regexp.MustCompile(`(?i)\A\s*save\s+roll\s+([a-z][a-z0-9_-]*)\s+(as\s+)?(.+)`)
+	deleteRollRegex = regexp.MustCompile(`(?i)\A\s*delete\s+roll\s+([a-z][a-z0-9_-]*)\s*\z`)
+	listRollsRegex  = regexp.MustCompile(`(?i)\A\s*rolls\s*\z`)
+)
+
+type SavedRoll struct {
+	User       id.UserID
+	Name       string
+	Expression string
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+func NewSavedRolls(db sqlx.Ext) *SavedRolls {
+	return &SavedRolls{
+		db: db,
+	}
+}
+
+// SavedRolls stores named dice expressions per user.
+type SavedRolls struct {
+	db sqlx.Ext
+}
+
+// Find returns the user's saved roll with the given name, or nil if there is none.
+func (s *SavedRolls) Find(ctx context.Context, userID id.UserID, name string) (*SavedRoll, error) {
+	roll := &SavedRoll{}
+	query, args := sq.Select("*").From("saved_rolls").Where(sq.Eq{`"user"`: userID, "name": strings.ToLower(name)}).Limit(1).MustSql()
+	err := sqlx.Get(s.db, roll, query, args...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return roll, nil
+}
+
+func (s *SavedRolls) List(ctx context.Context, userID id.UserID) ([]*SavedRoll, error) {
+	var rolls []*SavedRoll
+	query, args := sq.Select("*").From("saved_rolls").Where(sq.Eq{`"user"`: userID}).OrderBy("name").MustSql()
+	if err := sqlx.Select(s.db, &rolls, query, args...); err != nil {
+		return nil, err
+	}
+	return rolls, nil
+}
+
+func (s *SavedRolls) Save(ctx context.Context, roll *SavedRoll) error {
+	name := strings.ToLower(roll.Name)
+	_, err := sq.
+		Insert("saved_rolls").
+		Columns(`"user"`, "name", "expression", "created_at").
+		Values(roll.User, name, roll.Expression, roll.CreatedAt).
+		Suffix(`on conflict ("user", name) do update set expression = ?`, roll.Expression).
+		RunWith(s.db).
+		ExecContext(ctx)
+	if err != nil {
+		return fmt.Errorf("could not save roll: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the saved roll and reports whether there was one.
+func (s *SavedRolls) Delete(ctx context.Context, userID id.UserID, name string) (bool, error) {
+	res, err := sq.Delete("saved_rolls").Where(sq.Eq{`"user"`: userID, "name": strings.ToLower(name)}).RunWith(s.db).ExecContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// resolveRoll parses input as a dice expression, falling back to the user's saved roll of that name.
+func resolveRoll(ctx context.Context, saved *SavedRolls, userID id.UserID, input string) (*dice.Expression, string, error) {
+	input = strings.TrimSpace(input)
+	expression, parseErr := dice.Parse(input)
+	if parseErr == nil {
+		return expression, "", nil
+	}
+
+	roll, err := saved.Find(ctx, userID, input)
+	if err != nil {
+		return nil, "", err
+	}
+	if roll == nil {
+		return nil, "", parseErr
+	}
+	expression, err = dice.Parse(roll.Expression)
+	if err != nil {
+		return nil, "", fmt.Errorf("saved roll %q is invalid: %w", roll.Name, err)
+	}
+	return expression, roll.Name, nil
+}
+
+func AddDiceHandler(b *bot.Bot, saved *SavedRolls) {
 	b.On(func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
 		msg := evt.Content.AsMessage()
+		count := strings.TrimSpace(legacyDiceRegex.FindStringSubmatch(msg.Body)[1])
+		if count == "" {
+			count = "1"
+		}
 
-		parts := r.FindStringSubmatch(msg.Body)
-		diceRoll, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		result, err := dice.Roll(count + "d6")
 		if err != nil {
-			diceRoll = 1
+			client.SendText(evt.RoomID, fmt.Sprintf("Sorry, I can't roll that: %s", err))
+			return nil
 		}
-		if diceRoll > 20 {
-			client.SendText(evt.RoomID, fmt.Sprintf("Sorry, I don't have that many dice!"))
+		client.SendHTML(evt.RoomID, result.HTML())
+		return nil
+	}, predicates.MessageMatching(legacyDiceRegex))
+
+	b.On(func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+		input := rollRegex.FindStringSubmatch(evt.Content.AsMessage().Body)[1]
+		expression, name, err := resolveRoll(ctx, saved, evt.Sender, input)
+		if err != nil {
+			client.SendHTML(evt.RoomID, fmt.Sprintf("Sorry, I can't roll <code>%s</code>: %s", html.EscapeString(input), html.EscapeString(err.Error())))
 			return nil
 		}
 
-		var rolls []string
-		b := make([]byte, diceRoll)
-		rand.Read(b)
-		for i := 0; i < diceRoll; i++ {
-			rolls = append(rolls, fmt.Sprintf("%d", (b[i]%6+1)))
+		result, err := expression.Roll(dice.CryptoSource)
+		if err != nil {
+			return err
+		}
+		message := result.HTML()
+		if name != "" {
+			message = fmt.Sprintf("<em>%s</em>: %s", html.EscapeString(name), message)
+		}
+		client.SendHTML(evt.RoomID, message)
+		return nil
+	}, predicates.MessageMatching(rollRegex))
+
+	b.On(func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+		parts := saveRollRegex.FindStringSubmatch(evt.Content.AsMessage().Body)
+		name := parts[1]
+		if _, err := dice.Parse(name); err == nil {
+			client.SendHTML(evt.RoomID, fmt.Sprintf("<code>%s</code> looks like a dice expression, please pick another name.", html.EscapeString(name)))
+			return nil
+		}
+		expression, err := dice.Parse(parts[3])
+		if err != nil {
+			client.SendHTML(evt.RoomID, fmt.Sprintf("Sorry, <code>%s</code> isn't a roll I understand: %s", html.EscapeString(parts[3]), html.EscapeString(err.Error())))
+			return nil
+		}
+
+		roll := &SavedRoll{
+			User:       evt.Sender,
+			Name:       name,
+			Expression: expression.String(),
+			CreatedAt:  time.Now(),
+		}
+		if err := saved.Save(ctx, roll); err != nil {
+			client.SendText(evt.RoomID, fmt.Sprintf("Terribly sorry, but I couldn't save your roll: %s", err))
+			return err
+		}
+		client.SendHTML(evt.RoomID, fmt.Sprintf("🎲 Saved, roll it with <code>roll %s</code>.", html.EscapeString(strings.ToLower(name))))
+		return nil
+	}, predicates.MessageMatching(saveRollRegex))
+
+	b.On(func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+		name := deleteRollRegex.FindStringSubmatch(evt.Content.AsMessage().Body)[1]
+		removed, err := saved.Delete(ctx, evt.Sender, name)
+		if err != nil {
+			return err
+		}
+		if !removed {
+			client.SendHTML(evt.RoomID, fmt.Sprintf("You don't have a roll called <code>%s</code>.", html.EscapeString(name)))
+			return nil
+		}
+		client.SendHTML(evt.RoomID, fmt.Sprintf("✅ Deleted <code>%s</code>.", html.EscapeString(name)))
+		return nil
+	}, predicates.MessageMatching(deleteRollRegex))
+
+	b.On(func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+		rolls, err := saved.List(ctx, evt.Sender)
+		if err != nil {
+			return err
+		}
+		if len(rolls) == 0 {
+			client.SendHTML(evt.RoomID, "You have no saved rolls. Save one like so: <code>save roll fireball 8d6</code>")
+			return nil
+		}
+		var builder strings.Builder
+		builder.WriteString("🎲 Your saved rolls:<ul>")
+		for _, roll := range rolls {
+			builder.WriteString("<li><code>")
+			builder.WriteString(html.EscapeString(roll.Name))
+			builder.WriteString("</code>: ")
+			builder.WriteString(html.EscapeString(roll.Expression))
+			builder.WriteString("</li>")
 		}
-		client.SendText(evt.RoomID, fmt.Sprintf("🎲 I've rolled the dice for you: %s", strings.Join(rolls, ", ")))
+		builder.WriteString("</ul>")
+		client.SendHTML(evt.RoomID, builder.String())
 		return nil
-	}, predicates.MessageMatching(r))
+	}, predicates.MessageMatching(listRollsRegex))
 }
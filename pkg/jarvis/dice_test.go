@@ -0,0 +1,88 @@
+package jarvis
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"github.com/ilikeorangutans/jarvis/pkg/bot/bottest"
+	"github.com/ilikeorangutans/jarvis/pkg/database"
+	"github.com/ilikeorangutans/jarvis/pkg/database/databasetest"
+	"github.com/ilikeorangutans/jarvis/pkg/migrations"
+	"gotest.tools/assert"
+)
+
+func TestDiceCommands(t *testing.T) {
+	assert.Assert(t, rollRegex.MatchString("roll 3d20+5"))
+	assert.Assert(t, rollRegex.MatchString("roll fireball"))
+	assert.Assert(t, !rollRegex.MatchString("rolls"))
+	assert.Assert(t, listRollsRegex.MatchString("rolls"))
+	assert.Assert(t, legacyDiceRegex.MatchString("3 dice roll"))
+
+	parts := saveRollRegex.FindStringSubmatch("save roll fireball as 8d6")
+	assert.Equal(t, parts[1], "fireball")
+	assert.Equal(t, parts[3], "8d6")
+
+	parts = saveRollRegex.FindStringSubmatch("save roll stats 4d6kh3")
+	assert.Equal(t, parts[1], "stats")
+	assert.Equal(t, parts[3], "4d6kh3")
+
+	assert.Equal(t, deleteRollRegex.FindStringSubmatch("delete roll fireball")[1], "fireball")
+}
+
+func TestSavedRolls(t *testing.T) {
+	sets := func(dialect database.Dialect) []migrations.Set {
+		return []migrations.Set{migrations.ForModule("dice", moduleMigrations("dice"), dialect)}
+	}
+	databasetest.Migrated(t, sets, func(t *testing.T, db *database.DB) {
+		saved := NewSavedRolls(db)
+		ctx := context.Background()
+
+		roll, err := saved.Find(ctx, "@alice:example.com", "fireball")
+		assert.NilError(t, err)
+		assert.Assert(t, roll == nil)
+
+		now := time.Now()
+		assert.NilError(t, saved.Save(ctx, &SavedRoll{User: "@alice:example.com", Name: "Fireball", Expression: "8d6", CreatedAt: now}))
+		assert.NilError(t, saved.Save(ctx, &SavedRoll{User: "@alice:example.com", Name: "fireball", Expression: "9d6", CreatedAt: now}))
+		assert.NilError(t, saved.Save(ctx, &SavedRoll{User: "@bob:example.com", Name: "fireball", Expression: "1d6", CreatedAt: now}))
+
+		roll, err = saved.Find(ctx, "@alice:example.com", "FIREBALL")
+		assert.NilError(t, err)
+		assert.Equal(t, roll.Expression, "9d6")
+
+		rolls, err := saved.List(ctx, "@alice:example.com")
+		assert.NilError(t, err)
+		assert.Equal(t, len(rolls), 1)
+
+		deleted, err := saved.Delete(ctx, "@alice:example.com", "fireball")
+		assert.NilError(t, err)
+		assert.Assert(t, deleted)
+		deleted, err = saved.Delete(ctx, "@alice:example.com", "fireball")
+		assert.NilError(t, err)
+		assert.Assert(t, !deleted)
+	})
+}
+
+func TestDiceHandler(t *testing.T) {
+	sets := func(dialect database.Dialect) []migrations.Set {
+		return []migrations.Set{migrations.ForModule("dice", moduleMigrations("dice"), dialect)}
+	}
+	databasetest.Migrated(t, sets, func(t *testing.T, db *database.DB) {
+		h := bottest.New(t, bot.BotConfiguration{})
+		AddDiceHandler(h.Bot, NewSavedRolls(db))
+
+		h.Send(bottest.Room, "@alice:example.com", "roll 2d1+3")
+		h.Send(bottest.Room, "@alice:example.com", "save roll fireball as 3d1")
+		h.Send(bottest.Room, "@alice:example.com", "roll fireball")
+		h.Send(bottest.Room, "@bob:example.com", "roll fireball")
+		bodies := h.Bodies(bottest.Room)
+		assert.Equal(t, len(bodies), 4)
+		assert.Assert(t, strings.HasPrefix(bodies[0], "🎲 <code>2d1+3</code> = <strong>5</strong>"), bodies[0])
+		assert.Equal(t, bodies[1], "🎲 Saved, roll it with <code>roll fireball</code>.")
+		assert.Assert(t, strings.HasPrefix(bodies[2], "<em>fireball</em>: 🎲 <code>3d1</code> = <strong>3</strong>"), bodies[2])
+		assert.Assert(t, strings.HasPrefix(bodies[3], "Sorry, I can't roll <code>fireball</code>"), bodies[3])
+	})
+}
@@ -0,0 +1,162 @@
+package jarvis
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"github.com/ilikeorangutans/jarvis/pkg/predicates"
+	"github.com/jmoiron/sqlx"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrNoLocation = errors.New("no location known")
+
+	setLocationRegex = regexp.MustCompile(`(?i)\A\s*set\s+(my\s+)?location\s+(to\s+)?(-?[0-9]+(\.[0-9]+)?)\s*(?:,\s*|\s+)(-?[0-9]+(\.[0-9]+)?)(\s+in\s+([A-Za-z_]+/[A-Za-z_/+-]+|UTC))?\s*\z`)
+)
+
+// Location is a point on earth with the time zone used to present times for it.
+type Location struct {
+	Latitude  float64
+	Longitude float64
+	TimeZone  *time.Location
+}
+
+func (l Location) String() string {
+	return fmt.Sprintf("%.4f, %.4f (%s)", l.Latitude, l.Longitude, l.TimeZone)
+}
+
+type userLocation struct {
+	User      id.UserID
+	Latitude  float64
+	Longitude float64
+	TimeZone  string    `db:"time_zone"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// NewLocations returns a store for users' locations. If fallback is not nil, it is used for users who haven't
+// saved a location.
+func NewLocations(db sqlx.Ext, fallback *Location) *Locations {
+	return &Locations{
+		db:       db,
+		fallback: fallback,
+	}
+}
+
+type Locations struct {
+	db       sqlx.Ext
+	fallback *Location
+	// saved are called after a user saved a location, see OnSave
+	saved []func(context.Context, id.UserID)
+}
+
+// OnSave registers a function that is called after a user saved a new location, e.g. to reschedule what depends on it.
+// Register functions before handling events.
+func (l *Locations) OnSave(f func(ctx context.Context, userID id.UserID)) {
+	l.saved = append(l.saved, f)
+}
+
+// ForUser returns the user's saved location, the configured fallback, or ErrNoLocation.
+func (l *Locations) ForUser(ctx context.Context, userID id.UserID) (Location, error) {
+	var saved userLocation
+	query, args := sq.Select("*").From("user_locations").Where(sq.Eq{`"user"`: userID}).Limit(1).MustSql()
+	err := sqlx.Get(l.db, &saved, query, args...)
+	if errors.Is(err, sql.ErrNoRows) {
+		if l.fallback == nil {
+			return Location{}, ErrNoLocation
+		}
+		return *l.fallback, nil
+	} else if err != nil {
+		return Location{}, fmt.Errorf("could not load location: %w", err)
+	}
+
+	tz, err := time.LoadLocation(saved.TimeZone)
+	if err != nil {
+		return Location{}, fmt.Errorf("could not load time zone %q: %w", saved.TimeZone, err)
+	}
+
+	return Location{Latitude: saved.Latitude, Longitude: saved.Longitude, TimeZone: tz}, nil
+}
+
+func (l *Locations) Save(ctx context.Context, userID id.UserID, location Location) error {
+	_, err := sq.
+		Insert("user_locations").
+		Columns(`"user"`, "latitude", "longitude", "time_zone", "created_at").
+		Values(userID, location.Latitude, location.Longitude, location.TimeZone.String(), time.Now()).
+		Suffix(`on conflict ("user") do update set latitude = ?, longitude = ?, time_zone = ?`, location.Latitude, location.Longitude, location.TimeZone.String()).
+		RunWith(l.db).
+		ExecContext(ctx)
+	if err != nil {
+		return fmt.Errorf("could not save location: %w", err)
+	}
+	for _, f := range l.saved {
+		f(ctx, userID)
+	}
+	return nil
+}
+
+// LocationFromParts parses a setLocationRegex match. Without an explicit time zone the fallback's zone is used.
+func LocationFromParts(parts []string, fallback *time.Location) (Location, error) {
+	latitude, err := strconv.ParseFloat(parts[3], 64)
+	if err != nil {
+		return Location{}, err
+	}
+	longitude, err := strconv.ParseFloat(parts[5], 64)
+	if err != nil {
+		return Location{}, err
+	}
+	if latitude < -90 || latitude > 90 {
+		return Location{}, fmt.Errorf("latitude %v out of range", latitude)
+	}
+	if longitude < -180 || longitude > 180 {
+		return Location{}, fmt.Errorf("longitude %v out of range", longitude)
+	}
+
+	tz := fallback
+	if parts[8] != "" {
+		tz, err = time.LoadLocation(parts[8])
+		if err != nil {
+			return Location{}, fmt.Errorf("unknown time zone %q", parts[8])
+		}
+	}
+
+	return Location{Latitude: latitude, Longitude: longitude, TimeZone: tz}, nil
+}
+
+func AddLocationHandlers(ctx context.Context, b *bot.Bot, locations *Locations) error {
+	b.On(
+		func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			parts := setLocationRegex.FindStringSubmatch(evt.Content.AsMessage().Body)
+			fallback := time.UTC
+			if current, err := locations.ForUser(ctx, evt.Sender); err == nil {
+				fallback = current.TimeZone
+			}
+			location, err := LocationFromParts(parts, fallback)
+			if err != nil {
+				client.SendText(evt.RoomID, fmt.Sprintf("I'm afraid I didn't understand that location: %s", err))
+				return nil
+			}
+			if err := locations.Save(ctx, evt.Sender, location); err != nil {
+				client.SendText(evt.RoomID, fmt.Sprintf("Terribly sorry, but I couldn't save your location: %s", err))
+				return err
+			}
+			user, _, _ := evt.Sender.Parse()
+			client.SendText(evt.RoomID, fmt.Sprintf("📍 Very good %s, I've noted your location as %s.", user, location))
+			return nil
+		},
+		predicates.All(
+			predicates.MessageMatching(setLocationRegex),
+		),
+	)
+
+	return nil
+}
@@ -0,0 +1,20 @@
+package jarvis
+
+import (
+	"embed"
+	"io/fs"
+	"path"
+)
+
+// migrationFiles holds a directory of migrations per module.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+func moduleMigrations(name string) fs.FS {
+	sub, err := fs.Sub(migrationFiles, path.Join("migrations", name))
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
@@ -0,0 +1 @@
+drop table agenda_subscriptions;
@@ -0,0 +1 @@
+create table if not exists agenda_subscriptions (id integer, room text, user text, hour text, minute text, city_code text, entry_id integer, created_at datetime, primary key(id), unique(room, user));
@@ -0,0 +1,2 @@
+drop table weather_alert_subscriptions;
+drop table weather_alerts;
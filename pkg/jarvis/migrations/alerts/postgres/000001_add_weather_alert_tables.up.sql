@@ -0,0 +1,2 @@
+create table if not exists weather_alert_subscriptions (id bigserial, room text, city_code text, created_at timestamptz, primary key(id), unique(room, city_code));
+create table if not exists weather_alerts (city_code text, title text, summary text, link text, updated_at timestamptz, primary key(city_code, title));
@@ -0,0 +1 @@
+create table if not exists saved_rolls ("user" text, name text, expression text, created_at timestamptz, primary key("user", name));
@@ -0,0 +1 @@
+create table if not exists user_locations (user text, latitude real, longitude real, time_zone text, created_at datetime, primary key(user));
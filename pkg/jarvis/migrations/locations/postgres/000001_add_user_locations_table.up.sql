@@ -0,0 +1 @@
+create table if not exists user_locations ("user" text, latitude double precision, longitude double precision, time_zone text, created_at timestamptz, primary key("user"));
@@ -0,0 +1,2 @@
+drop table polls;
+drop table poll_votes;
@@ -0,0 +1,2 @@
+create table if not exists polls (id integer, room text, event_id text, question text, options text, native boolean, user text, closes_at datetime, closed boolean not null default false, entry_id integer, created_at datetime, primary key(id));
+create table if not exists poll_votes (poll_id integer, event_id text, user text, choice integer, created_at datetime, primary key(event_id, choice));
@@ -0,0 +1,2 @@
+create table if not exists polls (id bigserial, room text, event_id text, question text, options text, native boolean, "user" text, closes_at timestamptz, closed boolean not null default false, entry_id integer, created_at timestamptz, primary key(id));
+create table if not exists poll_votes (poll_id bigint, event_id text, "user" text, choice integer, created_at timestamptz, primary key(event_id, choice));
@@ -0,0 +1,29 @@
+package jarvis
+
+import (
+	"testing"
+
+	"github.com/ilikeorangutans/jarvis/pkg/database"
+	"github.com/ilikeorangutans/jarvis/pkg/database/databasetest"
+	"github.com/ilikeorangutans/jarvis/pkg/migrations"
+)
+
+// withModules returns the core migrations and those of the modules, for databasetest.Migrated.
+func withModules(names ...string) func(database.Dialect) []migrations.Set {
+	return func(dialect database.Dialect) []migrations.Set {
+		sets := []migrations.Set{migrations.Core(dialect)}
+		for _, name := range names {
+			sets = append(sets, migrations.ForModule(name, moduleMigrations(name), dialect))
+		}
+		return sets
+	}
+}
+
+func TestModuleMigrations(t *testing.T) {
+	// modules can be enabled on their own, so their migrations may only depend on the core ones
+	for _, name := range []string{"agenda", "alerts", "dice", "locations", "polls"} {
+		t.Run(name, func(t *testing.T) {
+			databasetest.Migrated(t, withModules(name), func(t *testing.T, db *database.DB) {})
+		})
+	}
+}
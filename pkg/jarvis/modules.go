@@ -0,0 +1,214 @@
+package jarvis
+
+import (
+	"context"
+	"io/fs"
+	"time"
+
+	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"github.com/ilikeorangutans/jarvis/pkg/database"
+	"github.com/ilikeorangutans/jarvis/pkg/httpcache"
+	"github.com/jmoiron/sqlx"
+	"github.com/robfig/cron/v3"
+)
+
+// Modules returns all of jarvis' modules in the order they depend on each other.
+func Modules(c *cron.Cron, db *database.DB, httpClient *httpcache.Client, locations *Locations, reactions *bot.ReactionRegistry) []bot.Module {
+	reminders := &RemindersModule{c: c, db: db, locations: locations}
+	return []bot.Module{
+		&DiceModule{db: db},
+		&WeatherModule{httpClient: httpClient},
+		&LocationsModule{locations: locations},
+		&SunriseModule{locations: locations},
+		reminders,
+		&AgendaModule{c: c, db: db, httpClient: httpClient, locations: locations, reminders: reminders},
+		&AlertsModule{db: db, httpClient: httpClient, config: AlertsConfig{Interval: defaultWeatherPollInterval}},
+		&PollsModule{c: c, db: db, reactions: reactions},
+	}
+}
+
+// DiceModule rolls dice and keeps saved rolls.
+type DiceModule struct {
+	bot.BaseModule
+	db sqlx.Ext
+}
+
+func (m *DiceModule) Name() string { return "dice" }
+
+func (m *DiceModule) Migrations() fs.FS { return moduleMigrations(m.Name()) }
+
+func (m *DiceModule) Register(ctx context.Context, b *bot.Bot) error {
+	AddDiceHandler(b, NewSavedRolls(m.db))
+	return nil
+}
+
+// WeatherModule answers questions about the weather.
+type WeatherModule struct {
+	bot.BaseModule
+	httpClient *httpcache.Client
+}
+
+func (m *WeatherModule) Name() string { return "weather" }
+
+func (m *WeatherModule) Register(ctx context.Context, b *bot.Bot) error {
+	AddWeatherHandler(ctx, b, m.httpClient)
+	return nil
+}
+
+// LocationsModule lets users tell jarvis where they are.
+type LocationsModule struct {
+	bot.BaseModule
+	locations *Locations
+}
+
+func (m *LocationsModule) Name() string { return "locations" }
+
+func (m *LocationsModule) Migrations() fs.FS { return moduleMigrations(m.Name()) }
+
+func (m *LocationsModule) Register(ctx context.Context, b *bot.Bot) error {
+	return AddLocationHandlers(ctx, b, m.locations)
+}
+
+// SunriseModule answers when the sun rises and sets.
+type SunriseModule struct {
+	bot.BaseModule
+	locations *Locations
+}
+
+func (m *SunriseModule) Name() string { return "sunrise" }
+
+func (m *SunriseModule) Register(ctx context.Context, b *bot.Bot) error {
+	return AddSunriseHandlers(ctx, b, m.locations)
+}
+
+// RemindersModule reminds users of things. Its table was altered several times before modules had migrations of
+// their own, so it remains part of the core migrations.
+type RemindersModule struct {
+	bot.BaseModule
+	c         *cron.Cron
+	db        sqlx.Ext
+	locations *Locations
+	reminders *Reminders
+}
+
+func (m *RemindersModule) Name() string { return "reminders" }
+
+func (m *RemindersModule) Register(ctx context.Context, b *bot.Bot) error {
+	reminders, err := NewReminders(ctx, b, m.c, m.db, m.locations)
+	if err != nil {
+		return err
+	}
+	m.reminders = reminders
+	return AddReminderHandlers(ctx, b, reminders)
+}
+
+func (m *RemindersModule) Start(ctx context.Context) error {
+	return m.reminders.Start(ctx)
+}
+
+// AgendaModule sends daily briefings. The briefing lists reminders only if the reminders module is enabled.
+type AgendaModule struct {
+	bot.BaseModule
+	c          *cron.Cron
+	db         *database.DB
+	httpClient *httpcache.Client
+	locations  *Locations
+	reminders  *RemindersModule
+	agenda     *Agenda
+}
+
+func (m *AgendaModule) Name() string { return "agenda" }
+
+func (m *AgendaModule) Migrations() fs.FS { return moduleMigrations(m.Name()) }
+
+func (m *AgendaModule) Register(ctx context.Context, b *bot.Bot) error {
+	sections := []AgendaSection{
+		WeatherAgendaSection(m.httpClient),
+		SunAgendaSection(m.locations),
+	}
+	if m.reminders.reminders != nil {
+		sections = append(sections, ReminderAgendaSection(m.reminders.reminders))
+	}
+	agenda, err := NewAgenda(ctx, b, m.c, m.db, sections...)
+	if err != nil {
+		return err
+	}
+	m.agenda = agenda
+	return AddAgendaHandlers(ctx, b, agenda)
+}
+
+func (m *AgendaModule) Start(ctx context.Context) error {
+	return m.agenda.Start(ctx)
+}
+
+// AlertsConfig configures the weather alerts module.
+type AlertsConfig struct {
+	// Interval is how often the alert feeds are polled.
+	Interval time.Duration
+}
+
+// AlertsModule announces weather alerts to subscribed rooms.
+type AlertsModule struct {
+	bot.BaseModule
+	db         *database.DB
+	httpClient *httpcache.Client
+	config     AlertsConfig
+	alerts     *WeatherAlerts
+	cancel     context.CancelFunc
+}
+
+func (m *AlertsModule) Name() string { return "alerts" }
+
+func (m *AlertsModule) Migrations() fs.FS { return moduleMigrations(m.Name()) }
+
+func (m *AlertsModule) Config() interface{} { return &m.config }
+
+func (m *AlertsModule) Register(ctx context.Context, b *bot.Bot) error {
+	alerts, err := NewWeatherAlerts(ctx, b, m.db, m.httpClient)
+	if err != nil {
+		return err
+	}
+	if m.config.Interval > 0 {
+		alerts.interval = m.config.Interval
+	}
+	m.alerts = alerts
+	return AddWeatherAlertHandlers(ctx, b, alerts)
+}
+
+func (m *AlertsModule) Start(ctx context.Context) error {
+	ctx, m.cancel = context.WithCancel(ctx)
+	return m.alerts.Start(ctx)
+}
+
+func (m *AlertsModule) Stop(ctx context.Context) error {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	return nil
+}
+
+// PollsModule runs polls.
+type PollsModule struct {
+	bot.BaseModule
+	c         *cron.Cron
+	db        sqlx.Ext
+	reactions *bot.ReactionRegistry
+	polls     *Polls
+}
+
+func (m *PollsModule) Name() string { return "polls" }
+
+func (m *PollsModule) Migrations() fs.FS { return moduleMigrations(m.Name()) }
+
+func (m *PollsModule) Register(ctx context.Context, b *bot.Bot) error {
+	polls, err := NewPolls(ctx, b, m.c, m.db, m.reactions)
+	if err != nil {
+		return err
+	}
+	m.polls = polls
+	return AddPollHandlers(ctx, b, polls)
+}
+
+func (m *PollsModule) Start(ctx context.Context) error {
+	return m.polls.Start(ctx)
+}
@@ -0,0 +1,772 @@
+package jarvis
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"github.com/ilikeorangutans/jarvis/pkg/database"
+	"github.com/ilikeorangutans/jarvis/pkg/predicates"
+	"github.com/jmoiron/sqlx"
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	maxPollOptions = 10
+	// maxHeldVotes is how many votes per room wait for polls being posted, see Polls.withPoll.
+	maxHeldVotes = 100
+
+	pollCloseKey      = "🏁"
+	pollCloseCallback = "poll.close"
+)
+
+var (
+	pollRegex        = regexp.MustCompile(`(?i)\A\s*poll\s+(native\s+)?"([^"]+)"\s+(.+?)(\s+for\s+([0-9]+)\s*(minutes?|mins?|m|hours?|h|days?|d))?\s*\z`)
+	closePollRegex   = regexp.MustCompile(`(?i)\A\s*close\s+poll\s+#?([0-9]+)\s*\z`)
+	pollResultsRegex = regexp.MustCompile(`(?i)\A\s*poll\s+results\s+#?([0-9]+)\s*\z`)
+	listPollsRegex   = regexp.MustCompile(`(?i)\A\s*polls\s*\z`)
+
+	// pollKeys are the reactions used to vote on the options of a poll, in order.
+	pollKeys = []string{"1️⃣", "2️⃣", "3️⃣", "4️⃣", "5️⃣", "6️⃣", "7️⃣", "8️⃣", "9️⃣", "🔟"}
+
+	// Poll events as specified by MSC3381. Clients still send the unstable names for the most part.
+	EventPollStart          = event.Type{Type: "org.matrix.msc3381.poll.start", Class: event.MessageEventType}
+	EventPollResponse       = event.Type{Type: "org.matrix.msc3381.poll.response", Class: event.MessageEventType}
+	EventPollEnd            = event.Type{Type: "org.matrix.msc3381.poll.end", Class: event.MessageEventType}
+	EventPollResponseStable = event.Type{Type: "m.poll.response", Class: event.MessageEventType}
+
+	ErrPollClosed   = errors.New("poll is closed")
+	ErrNotPollOwner = errors.New("only the creator of a poll can close it")
+
+	errPollOptionCount = fmt.Errorf("a poll needs between 2 and %d options", maxPollOptions)
+)
+
+type Poll struct {
+	ID       int64
+	Room     id.RoomID
+	EventID  id.EventID `db:"event_id"`
+	Question string
+	// Options holds the options separated by newlines, see Choices.
+	Options   string
+	Native    bool
+	User      id.UserID
+	ClosesAt  *time.Time    `db:"closes_at"`
+	Closed    bool          `db:"closed"`
+	EntryID   *cron.EntryID `db:"entry_id"`
+	CreatedAt time.Time     `db:"created_at"`
+}
+
+func (p *Poll) Choices() []string {
+	return strings.Split(p.Options, "\n")
+}
+
+// PollVote is a single vote, cast by a reaction or a poll response event.
+type PollVote struct {
+	PollID    int64      `db:"poll_id"`
+	EventID   id.EventID `db:"event_id"`
+	User      id.UserID
+	Choice    int
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// PollTally is the number of voters for one option.
+type PollTally struct {
+	Choice string
+	Votes  int
+}
+
+// TallyPoll counts the distinct voters per option, in the order of the options.
+func TallyPoll(choices []string, votes []PollVote) []PollTally {
+	voters := make([]map[id.UserID]struct{}, len(choices))
+	for i := range voters {
+		voters[i] = make(map[id.UserID]struct{})
+	}
+	for _, vote := range votes {
+		if vote.Choice < 0 || vote.Choice >= len(choices) {
+			continue
+		}
+		voters[vote.Choice][vote.User] = struct{}{}
+	}
+
+	tally := make([]PollTally, len(choices))
+	for i, choice := range choices {
+		tally[i] = PollTally{Choice: choice, Votes: len(voters[i])}
+	}
+	return tally
+}
+
+// PollFromParts parses a pollRegex match.
+func PollFromParts(parts []string) (*Poll, time.Duration, error) {
+	var choices []string
+	for _, option := range strings.Split(parts[3], "|") {
+		option = strings.Join(strings.Fields(option), " ")
+		if option != "" {
+			choices = append(choices, option)
+		}
+	}
+	if len(choices) < 2 || len(choices) > maxPollOptions {
+		return nil, 0, errPollOptionCount
+	}
+
+	var duration time.Duration
+	if parts[5] != "" {
+		n, err := strconv.Atoi(parts[5])
+		if err != nil {
+			return nil, 0, err
+		}
+		switch unit := strings.ToLower(parts[6]); {
+		case strings.HasPrefix(unit, "m"):
+			duration = time.Duration(n) * time.Minute
+		case strings.HasPrefix(unit, "h"):
+			duration = time.Duration(n) * time.Hour
+		default:
+			duration = time.Duration(n) * 24 * time.Hour
+		}
+		if duration <= 0 {
+			return nil, 0, fmt.Errorf("a poll needs to be open for at least a minute")
+		}
+	}
+
+	return &Poll{
+		Question: strings.TrimSpace(parts[2]),
+		Options:  strings.Join(choices, "\n"),
+		Native:   parts[1] != "",
+	}, duration, nil
+}
+
+// pollChoiceForKey returns the option index voted for by a reaction key, or -1.
+func pollChoiceForKey(key string) int {
+	key = predicates.ReactionKey(key)
+	for i, k := range pollKeys {
+		if predicates.ReactionKey(k) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// pollResponse extracts the referenced poll and the selected answer IDs from a raw poll response, either in the
+// unstable or the stable format.
+func pollResponse(raw map[string]interface{}) (id.EventID, []string) {
+	var pollEventID id.EventID
+	if relatesTo, ok := raw["m.relates_to"].(map[string]interface{}); ok {
+		if eventID, ok := relatesTo["event_id"].(string); ok {
+			pollEventID = id.EventID(eventID)
+		}
+	}
+
+	var answers []interface{}
+	if response, ok := raw[EventPollResponse.Type].(map[string]interface{}); ok {
+		answers, _ = response["answers"].([]interface{})
+	} else {
+		answers, _ = raw["m.selections"].([]interface{})
+	}
+
+	var selections []string
+	for _, answer := range answers {
+		if s, ok := answer.(string); ok {
+			selections = append(selections, s)
+		}
+	}
+	return pollEventID, selections
+}
+
+// pollStartContent builds an MSC3381 poll. Answer IDs are the option indices.
+func pollStartContent(poll *Poll) map[string]interface{} {
+	var answers []map[string]interface{}
+	var fallback strings.Builder
+	fallback.WriteString(poll.Question)
+	for i, choice := range poll.Choices() {
+		answers = append(answers, map[string]interface{}{
+			"id":                      strconv.Itoa(i),
+			"org.matrix.msc1767.text": choice,
+		})
+		fallback.WriteString(fmt.Sprintf("\n%d. %s", i+1, choice))
+	}
+
+	return map[string]interface{}{
+		EventPollStart.Type: map[string]interface{}{
+			"question":       map[string]interface{}{"org.matrix.msc1767.text": poll.Question},
+			"kind":           "org.matrix.msc3381.poll.disclosed",
+			"max_selections": 1,
+			"answers":        answers,
+		},
+		"org.matrix.msc1767.text": fallback.String(),
+	}
+}
+
+func FormatPoll(poll *Poll) string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("📊 <strong>Poll #%d: %s</strong><br/>", poll.ID, html.EscapeString(poll.Question)))
+	for i, choice := range poll.Choices() {
+		builder.WriteString(fmt.Sprintf("%s %s<br/>", pollKeys[i], html.EscapeString(choice)))
+	}
+	builder.WriteString("React to vote")
+	if poll.ClosesAt != nil {
+		builder.WriteString(fmt.Sprintf(", closes %s", poll.ClosesAt.Format("Mon Jan 2 15:04")))
+	}
+	builder.WriteString(fmt.Sprintf(". The creator can close it early with %s.", pollCloseKey))
+	return builder.String()
+}
+
+func FormatPollResults(poll *Poll, tally []PollTally) string {
+	total := 0
+	for _, t := range tally {
+		total += t.Votes
+	}
+
+	var builder strings.Builder
+	if poll.Closed {
+		builder.WriteString(fmt.Sprintf("📊 <strong>Results for poll #%d: %s</strong><br/>", poll.ID, html.EscapeString(poll.Question)))
+	} else {
+		builder.WriteString(fmt.Sprintf("📊 <strong>Poll #%d so far: %s</strong><br/>", poll.ID, html.EscapeString(poll.Question)))
+	}
+
+	sorted := make([]PollTally, len(tally))
+	copy(sorted, tally)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Votes > sorted[j].Votes })
+	for _, t := range sorted {
+		percent := 0
+		if total > 0 {
+			percent = t.Votes * 100 / total
+		}
+		builder.WriteString(fmt.Sprintf("%s: %s (%d%%)<br/>", html.EscapeString(t.Choice), humanizeCount(t.Votes, "vote"), percent))
+	}
+
+	switch {
+	case total == 0:
+		builder.WriteString("Nobody voted.")
+	case len(sorted) > 1 && sorted[0].Votes == sorted[1].Votes:
+		builder.WriteString("It's a tie!")
+	default:
+		builder.WriteString(fmt.Sprintf("🏆 %s wins.", html.EscapeString(sorted[0].Choice)))
+	}
+	return builder.String()
+}
+
+// onceSchedule is a cron schedule firing a single time.
+type onceSchedule struct {
+	at time.Time
+}
+
+func (o onceSchedule) Next(t time.Time) time.Time {
+	if o.at.After(t) {
+		return o.at
+	}
+	return time.Time{}
+}
+
+func NewPolls(ctx context.Context, b *bot.Bot, c *cron.Cron, db sqlx.Ext, reactions *bot.ReactionRegistry) (*Polls, error) {
+	return &Polls{
+		b:         b,
+		c:         c,
+		db:        db,
+		reactions: reactions,
+		held:      make(map[id.RoomID][]heldVote),
+	}, nil
+}
+
+type Polls struct {
+	b         *bot.Bot
+	c         *cron.Cron
+	db        sqlx.Ext
+	reactions *bot.ReactionRegistry
+	// held are votes on events that may be polls still being posted, see withPoll
+	heldLock sync.Mutex
+	held     map[id.RoomID][]heldVote
+}
+
+// heldVote is a vote on an event that wasn't known to be a poll when the vote arrived.
+type heldVote struct {
+	eventID id.EventID
+	vote    func(context.Context, *Poll) error
+}
+
+// Start schedules the deadlines of all open polls. Polls whose deadline passed while we were down are closed
+// right away.
+func (p *Polls) Start(ctx context.Context) error {
+	// polls without an event ID were never posted, so nobody can vote on them
+	if _, err := sq.Delete("polls").Where(sq.Eq{"event_id": "", "closed": false}).RunWith(p.db).ExecContext(ctx); err != nil {
+		return fmt.Errorf("could not remove unposted polls: %w", err)
+	}
+
+	var polls []*Poll
+	query, args := sq.Select("*").From("polls").Where(sq.And{sq.Eq{"closed": false}, sq.NotEq{"closes_at": nil}}).MustSql()
+	if err := sqlx.Select(p.db, &polls, query, args...); err != nil {
+		return err
+	}
+	log.Info().Int("count", len(polls)).Msg("rescheduling poll deadlines")
+	for _, poll := range polls {
+		if poll.ClosesAt.Before(time.Now()) {
+			if err := p.Close(ctx, poll); err != nil {
+				log.Error().Err(err).Int64("id", poll.ID).Msg("could not close poll")
+			}
+			continue
+		}
+		p.schedule(ctx, poll)
+	}
+
+	return nil
+}
+
+// Create stores the poll and posts it to its room.
+func (p *Polls) Create(ctx context.Context, poll *Poll) error {
+	var err error
+	poll.ID, err = database.InsertReturningID(ctx, p.db, sq.
+		Insert("polls").
+		Columns("room", "event_id", "question", "options", "native", `"user"`, "closes_at", "created_at").
+		Values(poll.Room, "", poll.Question, poll.Options, poll.Native, poll.User, poll.ClosesAt, poll.CreatedAt))
+	if err != nil {
+		return fmt.Errorf("could not insert poll: %w", err)
+	}
+
+	if poll.ClosesAt != nil {
+		p.schedule(ctx, poll)
+	}
+
+	sent := func(eventID id.EventID, err error) {
+		if err != nil {
+			log.Error().Err(err).Int64("id", poll.ID).Msg("could not post poll")
+			if err := p.discard(poll); err != nil {
+				log.Error().Err(err).Int64("id", poll.ID).Msg("could not remove unposted poll")
+			}
+			return
+		}
+		held, err := p.posted(poll, eventID)
+		if err != nil {
+			log.Error().Err(err).Int64("id", poll.ID).Msg("could not save poll event id")
+			return
+		}
+		for _, vote := range held {
+			if err := vote(context.Background(), poll); err != nil && !errors.Is(err, ErrPollClosed) {
+				log.Error().Err(err).Int64("id", poll.ID).Msg("could not record early vote")
+			}
+		}
+		if err := p.reactions.Watch(context.Background(), poll.Room, eventID, pollCloseKey, pollCloseCallback, strconv.FormatInt(poll.ID, 10)); err != nil {
+			log.Error().Err(err).Int64("id", poll.ID).Msg("could not watch poll for reactions")
+		}
+		if poll.Native {
+			return
+		}
+		for i := range poll.Choices() {
+			p.b.Client().SendReaction(poll.Room, eventID, pollKeys[i])
+		}
+	}
+	if poll.Native {
+		p.b.Client().SendMessageEvent(poll.Room, EventPollStart, pollStartContent(poll), sent)
+	} else {
+		p.b.Client().SendMessageEvent(poll.Room, event.EventMessage, event.MessageEventContent{
+			MsgType:       event.MsgText,
+			Body:          fmt.Sprintf("Poll #%d: %s", poll.ID, poll.Question),
+			FormattedBody: FormatPoll(poll),
+			Format:        event.FormatHTML,
+		}, sent)
+	}
+	return nil
+}
+
+// discard removes a poll that could not be posted, along with the votes held for it.
+func (p *Polls) discard(poll *Poll) error {
+	p.heldLock.Lock()
+	defer p.heldLock.Unlock()
+	if poll.EntryID != nil {
+		p.c.Remove(*poll.EntryID)
+	}
+	if _, err := sq.Delete("polls").Where(sq.Eq{"id": poll.ID}).RunWith(p.db).Exec(); err != nil {
+		return err
+	}
+	posting, err := p.posting(context.Background(), poll.Room)
+	if err != nil || !posting {
+		delete(p.held, poll.Room)
+	}
+	return err
+}
+
+// posted saves the event ID of a poll and returns the votes on it that arrived before it was known.
+func (p *Polls) posted(poll *Poll, eventID id.EventID) ([]func(context.Context, *Poll) error, error) {
+	p.heldLock.Lock()
+	defer p.heldLock.Unlock()
+	if _, err := sq.Update("polls").Set("event_id", eventID).Where(sq.Eq{"id": poll.ID}).RunWith(p.db).Exec(); err != nil {
+		return nil, err
+	}
+	poll.EventID = eventID
+
+	var votes []func(context.Context, *Poll) error
+	var remaining []heldVote
+	for _, held := range p.held[poll.Room] {
+		if held.eventID == eventID {
+			votes = append(votes, held.vote)
+		} else {
+			remaining = append(remaining, held)
+		}
+	}
+	posting, err := p.posting(context.Background(), poll.Room)
+	if err != nil || !posting {
+		remaining = nil
+	}
+	if len(remaining) == 0 {
+		delete(p.held, poll.Room)
+	} else {
+		p.held[poll.Room] = remaining
+	}
+	return votes, nil
+}
+
+// posting returns true if polls in the room are being posted, that is they don't have an event ID yet.
+func (p *Polls) posting(ctx context.Context, roomID id.RoomID) (bool, error) {
+	var count int
+	query, args := sq.Select("count(*)").From("polls").Where(sq.Eq{"room": roomID, "event_id": "", "closed": false}).MustSql()
+	if err := sqlx.Get(p.db, &count, query, args...); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// withPoll calls vote with the poll posted as eventID. Votes can arrive before Create learned the event ID of a poll,
+// so while polls are being posted to the room, votes on unknown events are held until the poll's event ID is known.
+func (p *Polls) withPoll(ctx context.Context, roomID id.RoomID, eventID id.EventID, vote func(context.Context, *Poll) error) error {
+	if eventID == "" {
+		return nil
+	}
+	p.heldLock.Lock()
+	poll, err := p.FindByEvent(ctx, eventID)
+	if err == nil && poll == nil {
+		var posting bool
+		posting, err = p.posting(ctx, roomID)
+		if posting && len(p.held[roomID]) < maxHeldVotes {
+			p.held[roomID] = append(p.held[roomID], heldVote{eventID: eventID, vote: vote})
+		}
+	}
+	p.heldLock.Unlock()
+	if err != nil || poll == nil {
+		return err
+	}
+	return vote(ctx, poll)
+}
+
+func (p *Polls) schedule(ctx context.Context, poll *Poll) {
+	entryID := p.c.Schedule(onceSchedule{at: *poll.ClosesAt}, cron.FuncJob(func() {
+		current, err := p.FindByID(context.Background(), poll.ID)
+		if err != nil || current == nil {
+			log.Error().Err(err).Int64("id", poll.ID).Msg("could not load poll")
+			return
+		}
+		if err := p.Close(context.Background(), current); err != nil {
+			log.Error().Err(err).Int64("id", poll.ID).Msg("could not close poll")
+		}
+	}))
+
+	poll.EntryID = &entryID
+	if _, err := sq.Update("polls").Set("entry_id", entryID).Where(sq.Eq{"id": poll.ID}).RunWith(p.db).ExecContext(ctx); err != nil {
+		log.Error().Err(err).Msg("could not update")
+	}
+}
+
+// FindByID returns the poll or nil if there is none.
+func (p *Polls) FindByID(ctx context.Context, pollID int64) (*Poll, error) {
+	return p.find(ctx, sq.Eq{"id": pollID})
+}
+
+// FindByEvent returns the poll posted as the given event, or nil if there is none.
+func (p *Polls) FindByEvent(ctx context.Context, eventID id.EventID) (*Poll, error) {
+	if eventID == "" {
+		return nil, nil
+	}
+	return p.find(ctx, sq.Eq{"event_id": eventID})
+}
+
+func (p *Polls) find(ctx context.Context, where sq.Sqlizer) (*Poll, error) {
+	poll := &Poll{}
+	query, args := sq.Select("*").From("polls").Where(where).Limit(1).MustSql()
+	err := sqlx.Get(p.db, poll, query, args...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return poll, nil
+}
+
+// Open returns the open polls in a room.
+func (p *Polls) Open(ctx context.Context, roomID id.RoomID) ([]*Poll, error) {
+	var polls []*Poll
+	query, args := sq.Select("*").From("polls").Where(sq.Eq{"room": roomID, "closed": false}).OrderBy("id").MustSql()
+	if err := sqlx.Select(p.db, &polls, query, args...); err != nil {
+		return nil, err
+	}
+	return polls, nil
+}
+
+// Vote records votes cast by a single event.
+func (p *Polls) Vote(ctx context.Context, poll *Poll, eventID id.EventID, userID id.UserID, choices ...int) error {
+	if poll.Closed {
+		return ErrPollClosed
+	}
+	for _, choice := range choices {
+		_, err := sq.
+			Insert("poll_votes").
+			Columns("poll_id", "event_id", `"user"`, "choice", "created_at").
+			Values(poll.ID, eventID, userID, choice, time.Now()).
+			Suffix("on conflict do nothing").
+			RunWith(p.db).
+			ExecContext(ctx)
+		if err != nil {
+			return fmt.Errorf("could not record vote: %w", err)
+		}
+	}
+	return nil
+}
+
+// ReplaceVotes drops the user's previous votes before recording the new ones, as native poll responses replace
+// earlier responses.
+func (p *Polls) ReplaceVotes(ctx context.Context, poll *Poll, eventID id.EventID, userID id.UserID, choices ...int) error {
+	if poll.Closed {
+		return ErrPollClosed
+	}
+	if _, err := sq.Delete("poll_votes").Where(sq.Eq{"poll_id": poll.ID, `"user"`: userID}).RunWith(p.db).ExecContext(ctx); err != nil {
+		return fmt.Errorf("could not remove previous votes: %w", err)
+	}
+	return p.Vote(ctx, poll, eventID, userID, choices...)
+}
+
+// Retract removes the votes cast by a redacted event. Votes on closed polls stay.
+func (p *Polls) Retract(ctx context.Context, eventID id.EventID) error {
+	_, err := sq.
+		Delete("poll_votes").
+		Where(sq.And{
+			sq.Eq{"event_id": eventID},
+			sq.Expr("poll_id in (select id from polls where closed = ?)", false),
+		}).
+		RunWith(p.db).
+		ExecContext(ctx)
+	return err
+}
+
+func (p *Polls) Tally(ctx context.Context, poll *Poll) ([]PollTally, error) {
+	var votes []PollVote
+	query, args := sq.Select("*").From("poll_votes").Where(sq.Eq{"poll_id": poll.ID}).MustSql()
+	if err := sqlx.Select(p.db, &votes, query, args...); err != nil {
+		return nil, err
+	}
+	return TallyPoll(poll.Choices(), votes), nil
+}
+
+// Close ends the poll and posts the results.
+func (p *Polls) Close(ctx context.Context, poll *Poll) error {
+	if poll.Closed {
+		return ErrPollClosed
+	}
+	// the deadline and a manual close can race, only the one that flips closed posts the results
+	result, err := sq.Update("polls").Set("closed", true).Where(sq.Eq{"id": poll.ID, "closed": false}).RunWith(p.db).ExecContext(ctx)
+	if err != nil {
+		return fmt.Errorf("could not close poll: %w", err)
+	}
+	if closed, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("could not close poll: %w", err)
+	} else if closed == 0 {
+		poll.Closed = true
+		return ErrPollClosed
+	}
+	poll.Closed = true
+	if poll.EntryID != nil {
+		p.c.Remove(*poll.EntryID)
+	}
+	if err := p.reactions.Unwatch(ctx, poll.EventID); err != nil {
+		log.Error().Err(err).Int64("id", poll.ID).Msg("could not stop watching poll")
+	}
+
+	tally, err := p.Tally(ctx, poll)
+	if err != nil {
+		return err
+	}
+	if poll.Native && poll.EventID != "" {
+		p.b.Client().SendMessageEvent(poll.Room, EventPollEnd, map[string]interface{}{
+			"m.relates_to":            map[string]interface{}{"rel_type": "m.reference", "event_id": poll.EventID},
+			EventPollEnd.Type:         map[string]interface{}{},
+			"org.matrix.msc1767.text": "The poll has ended.",
+		}, nil)
+	}
+	p.b.Client().SendHTML(poll.Room, FormatPollResults(poll, tally))
+	return nil
+}
+
+func AddPollHandlers(ctx context.Context, b *bot.Bot, polls *Polls) error {
+	b.On(
+		func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			parts := pollRegex.FindStringSubmatch(evt.Content.AsMessage().Body)
+			poll, duration, err := PollFromParts(parts)
+			if err != nil {
+				client.SendText(evt.RoomID, fmt.Sprintf("I'm afraid I can't set up that poll: %s", err))
+				return nil
+			}
+			poll.Room = evt.RoomID
+			poll.User = evt.Sender
+			poll.CreatedAt = time.Now()
+			if duration > 0 {
+				closesAt := poll.CreatedAt.Add(duration).Truncate(time.Minute)
+				poll.ClosesAt = &closesAt
+			}
+
+			if err := polls.Create(ctx, poll); err != nil {
+				client.SendText(evt.RoomID, fmt.Sprintf("Terribly sorry, but I couldn't create your poll: %s", err))
+				return err
+			}
+			return nil
+		},
+		predicates.MessageMatching(pollRegex),
+	)
+
+	closePoll := func(ctx context.Context, client bot.MatrixClient, evt *event.Event, pollID int64) error {
+		poll, err := polls.FindByID(ctx, pollID)
+		if err != nil {
+			return err
+		}
+		if poll == nil || poll.Room != evt.RoomID {
+			client.SendText(evt.RoomID, fmt.Sprintf("There is no poll #%d here.", pollID))
+			return nil
+		}
+		if poll.User != evt.Sender {
+			client.SendText(evt.RoomID, ErrNotPollOwner.Error())
+			return nil
+		}
+		if err := polls.Close(ctx, poll); errors.Is(err, ErrPollClosed) {
+			client.SendText(evt.RoomID, fmt.Sprintf("Poll #%d is already closed.", pollID))
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	polls.reactions.Handle(pollCloseCallback, func(ctx context.Context, client bot.MatrixClient, evt *event.Event, payload string) error {
+		pollID, err := strconv.ParseInt(payload, 10, 64)
+		if err != nil {
+			return err
+		}
+		return closePoll(ctx, client, evt, pollID)
+	})
+
+	b.On(
+		func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			pollID, _ := strconv.ParseInt(closePollRegex.FindStringSubmatch(evt.Content.AsMessage().Body)[1], 10, 64)
+			return closePoll(ctx, client, evt, pollID)
+		},
+		predicates.MessageMatching(closePollRegex),
+	)
+
+	b.On(
+		func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			pollID, _ := strconv.ParseInt(pollResultsRegex.FindStringSubmatch(evt.Content.AsMessage().Body)[1], 10, 64)
+			poll, err := polls.FindByID(ctx, pollID)
+			if err != nil {
+				return err
+			}
+			if poll == nil || poll.Room != evt.RoomID {
+				client.SendText(evt.RoomID, fmt.Sprintf("There is no poll #%d here.", pollID))
+				return nil
+			}
+			tally, err := polls.Tally(ctx, poll)
+			if err != nil {
+				return err
+			}
+			client.SendHTML(evt.RoomID, FormatPollResults(poll, tally))
+			return nil
+		},
+		predicates.MessageMatching(pollResultsRegex),
+	)
+
+	b.On(
+		func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			open, err := polls.Open(ctx, evt.RoomID)
+			if err != nil {
+				return err
+			}
+			if len(open) == 0 {
+				client.SendText(evt.RoomID, "There are no open polls in this room.")
+				return nil
+			}
+			var builder strings.Builder
+			builder.WriteString("📊 Open polls:<ul>")
+			for _, poll := range open {
+				builder.WriteString(fmt.Sprintf("<li>#%d: %s", poll.ID, html.EscapeString(poll.Question)))
+				if poll.ClosesAt != nil {
+					builder.WriteString(fmt.Sprintf(", closes %s", poll.ClosesAt.Format("Mon Jan 2 15:04")))
+				}
+				builder.WriteString("</li>")
+			}
+			builder.WriteString("</ul>")
+			client.SendHTML(evt.RoomID, builder.String())
+			return nil
+		},
+		predicates.MessageMatching(listPollsRegex),
+	)
+
+	b.On(
+		func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			reaction := evt.Content.AsReaction()
+			return polls.withPoll(ctx, evt.RoomID, reaction.RelatesTo.EventID, func(ctx context.Context, poll *Poll) error {
+				if poll.Native {
+					return nil
+				}
+				choice := pollChoiceForKey(reaction.RelatesTo.Key)
+				if choice < 0 || choice >= len(poll.Choices()) {
+					return nil
+				}
+				if err := polls.Vote(ctx, poll, evt.ID, evt.Sender, choice); err != nil && !errors.Is(err, ErrPollClosed) {
+					return err
+				}
+				return nil
+			})
+		},
+		predicates.Reaction(),
+	)
+
+	b.On(
+		func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			pollEventID, selections := pollResponse(evt.Content.Raw)
+			return polls.withPoll(ctx, evt.RoomID, pollEventID, func(ctx context.Context, poll *Poll) error {
+				if !poll.Native {
+					return nil
+				}
+				var choices []int
+				for _, selection := range selections {
+					choice, err := strconv.Atoi(selection)
+					if err != nil || choice < 0 || choice >= len(poll.Choices()) {
+						continue
+					}
+					// max_selections is 1
+					choices = append(choices, choice)
+					break
+				}
+				if err := polls.ReplaceVotes(ctx, poll, evt.ID, evt.Sender, choices...); err != nil && !errors.Is(err, ErrPollClosed) {
+					return err
+				}
+				return nil
+			})
+		},
+		predicates.OfType(EventPollResponse, EventPollResponseStable),
+	)
+
+	b.On(
+		func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			return polls.Retract(ctx, evt.Redacts)
+		},
+		predicates.OfType(event.EventRedaction),
+	)
+
+	return nil
+}
@@ -0,0 +1,277 @@
+package jarvis
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"github.com/ilikeorangutans/jarvis/pkg/bot/bottest"
+	"github.com/ilikeorangutans/jarvis/pkg/database"
+	"github.com/ilikeorangutans/jarvis/pkg/database/databasetest"
+	"github.com/robfig/cron/v3"
+	"gotest.tools/assert"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestPollFromParts(t *testing.T) {
+	parts := pollRegex.FindStringSubmatch(`poll "Dinner?" pizza | sushi |  tacos`)
+	poll, duration, err := PollFromParts(parts)
+	assert.NilError(t, err)
+	assert.Equal(t, poll.Question, "Dinner?")
+	assert.DeepEqual(t, poll.Choices(), []string{"pizza", "sushi", "tacos"})
+	assert.Equal(t, poll.Native, false)
+	assert.Equal(t, duration, time.Duration(0))
+
+	parts = pollRegex.FindStringSubmatch(`poll native "Movie night?" yes | no for 2h`)
+	poll, duration, err = PollFromParts(parts)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, poll.Choices(), []string{"yes", "no"})
+	assert.Equal(t, poll.Native, true)
+	assert.Equal(t, duration, 2*time.Hour)
+
+	_, _, err = PollFromParts(pollRegex.FindStringSubmatch(`poll "Lonely?" yes`))
+	assert.ErrorContains(t, err, "between 2 and 10 options")
+
+	assert.Assert(t, !pollRegex.MatchString("poll results 3"))
+	assert.Equal(t, pollResultsRegex.FindStringSubmatch("poll results #3")[1], "3")
+}
+
+func TestPollChoiceForKey(t *testing.T) {
+	assert.Equal(t, pollChoiceForKey("1️⃣"), 0)
+	assert.Equal(t, pollChoiceForKey("3⃣"), 2)
+	assert.Equal(t, pollChoiceForKey("🔟"), 9)
+	assert.Equal(t, pollChoiceForKey("👍"), -1)
+}
+
+func TestTallyPoll(t *testing.T) {
+	votes := []PollVote{
+		{User: id.UserID("@a:example.com"), Choice: 0},
+		{User: id.UserID("@b:example.com"), Choice: 0},
+		{User: id.UserID("@a:example.com"), Choice: 1},
+		{User: id.UserID("@c:example.com"), Choice: 7},
+	}
+	tally := TallyPoll([]string{"pizza", "sushi", "tacos"}, votes)
+	assert.DeepEqual(t, tally, []PollTally{{"pizza", 2}, {"sushi", 1}, {"tacos", 0}})
+
+	poll := &Poll{ID: 1, Question: "Dinner?", Closed: true}
+	results := FormatPollResults(poll, tally)
+	assert.Assert(t, strings.Contains(results, "pizza: 2 votes (66%)"), results)
+	assert.Assert(t, strings.Contains(results, "🏆 pizza wins."), results)
+
+	results = FormatPollResults(poll, TallyPoll([]string{"yes", "no"}, nil))
+	assert.Assert(t, strings.Contains(results, "Nobody voted."), results)
+}
+
+func TestPollResponse(t *testing.T) {
+	unstable := map[string]interface{}{
+		"m.relates_to":                     map[string]interface{}{"rel_type": "m.reference", "event_id": "$poll"},
+		"org.matrix.msc3381.poll.response": map[string]interface{}{"answers": []interface{}{"1"}},
+	}
+	eventID, selections := pollResponse(unstable)
+	assert.Equal(t, eventID, id.EventID("$poll"))
+	assert.DeepEqual(t, selections, []string{"1"})
+
+	stable := map[string]interface{}{
+		"m.relates_to": map[string]interface{}{"rel_type": "m.reference", "event_id": "$poll"},
+		"m.selections": []interface{}{"0"},
+	}
+	_, selections = pollResponse(stable)
+	assert.DeepEqual(t, selections, []string{"0"})
+}
+
+func TestOnceSchedule(t *testing.T) {
+	at := time.Date(2021, time.December, 1, 17, 0, 0, 0, time.UTC)
+	s := onceSchedule{at: at}
+	assert.Equal(t, s.Next(at.Add(-time.Hour)), at)
+	assert.Assert(t, s.Next(at).IsZero())
+}
+
+const (
+	alice = id.UserID("@alice:example.com")
+	bob   = id.UserID("@bob:example.com")
+)
+
+func newPollHarness(t *testing.T, db *database.DB) (*bottest.Harness, *Polls) {
+	h := bottest.New(t, bot.BotConfiguration{})
+	reactions := bot.NewReactionRegistry(db)
+	bot.AddReactionHandlers(h.Bot, reactions)
+	polls, err := NewPolls(context.Background(), h.Bot, cron.New(), db, reactions)
+	assert.NilError(t, err)
+	assert.NilError(t, AddPollHandlers(context.Background(), h.Bot, polls))
+	h.Join(bottest.Room, alice, bob)
+	return h, polls
+}
+
+// tally returns the votes per option of the poll.
+func tally(t *testing.T, polls *Polls, pollID int64) []int {
+	t.Helper()
+	poll, err := polls.FindByID(context.Background(), pollID)
+	assert.NilError(t, err)
+	tally, err := polls.Tally(context.Background(), poll)
+	assert.NilError(t, err)
+	var votes []int
+	for _, t := range tally {
+		votes = append(votes, t.Votes)
+	}
+	return votes
+}
+
+func TestPollVoting(t *testing.T) {
+	databasetest.Migrated(t, withModules("polls"), func(t *testing.T, db *database.DB) {
+		h, polls := newPollHarness(t, db)
+
+		h.Send(bottest.Room, alice, `jarvis poll "Dinner?" pizza | sushi`)
+		pollEvent := h.Client.Messages()[0].EventID
+		assert.DeepEqual(t, h.Bodies(bottest.Room)[1:], []string{"1️⃣", "2️⃣"})
+
+		vote := h.React(bottest.Room, alice, pollEvent, "1️⃣")
+		retracted := h.React(bottest.Room, bob, pollEvent, "2️⃣")
+		h.React(bottest.Room, bob, pollEvent, "1️⃣")
+		assert.DeepEqual(t, tally(t, polls, 1), []int{2, 1})
+
+		// a redacted reaction no longer counts
+		redaction := h.Event(bottest.Room, bob, event.EventRedaction, nil, map[string]interface{}{})
+		redaction.Redacts = retracted
+		h.Dispatch(redaction)
+		assert.DeepEqual(t, tally(t, polls, 1), []int{2, 0})
+
+		h.Client.Reset()
+		h.Send(bottest.Room, bob, "jarvis close poll 1")
+		h.Send(bottest.Room, alice, "jarvis close poll 1")
+		h.Send(bottest.Room, alice, "jarvis close poll 1")
+		bodies := h.Bodies(bottest.Room)
+		assert.Equal(t, len(bodies), 3)
+		assert.Equal(t, bodies[0], ErrNotPollOwner.Error())
+		assert.Assert(t, strings.Contains(bodies[1], "pizza: 2 votes (100%)"), bodies[1])
+		assert.Assert(t, strings.Contains(bodies[1], "🏆 pizza wins."), bodies[1])
+		assert.Equal(t, bodies[2], "Poll #1 is already closed.")
+
+		// closed polls neither take nor lose votes
+		h.React(bottest.Room, bob, pollEvent, "2️⃣")
+		redaction = h.Event(bottest.Room, alice, event.EventRedaction, nil, map[string]interface{}{})
+		redaction.Redacts = vote
+		h.Dispatch(redaction)
+		assert.DeepEqual(t, tally(t, polls, 1), []int{2, 0})
+	})
+}
+
+func TestNativePollVoting(t *testing.T) {
+	databasetest.Migrated(t, withModules("polls"), func(t *testing.T, db *database.DB) {
+		h, polls := newPollHarness(t, db)
+
+		h.Send(bottest.Room, alice, `jarvis poll native "Movie night?" yes | no`)
+		pollEvent := h.Client.Messages()[0].EventID
+		respond := func(sender id.UserID, answer string) {
+			h.Dispatch(h.Event(bottest.Room, sender, EventPollResponse, nil, map[string]interface{}{
+				"m.relates_to":         map[string]interface{}{"rel_type": "m.reference", "event_id": pollEvent},
+				EventPollResponse.Type: map[string]interface{}{"answers": []string{answer}},
+			}))
+		}
+
+		respond(alice, "0")
+		respond(bob, "0")
+		assert.DeepEqual(t, tally(t, polls, 1), []int{2, 0})
+
+		// a new response replaces the previous one
+		respond(bob, "1")
+		assert.DeepEqual(t, tally(t, polls, 1), []int{1, 1})
+	})
+}
+
+// slowClient holds back the callbacks of sent events, like a homeserver that is slow to answer.
+type slowClient struct {
+	*bottest.Client
+	callbacks []func()
+}
+
+func (c *slowClient) SendMessageEvent(roomID id.RoomID, eventType event.Type, content interface{}, sent func(id.EventID, error)) {
+	c.Client.SendMessageEvent(roomID, eventType, content, func(eventID id.EventID, err error) {
+		if sent != nil {
+			c.callbacks = append(c.callbacks, func() { sent(eventID, err) })
+		}
+	})
+}
+
+func TestEarlyPollVotes(t *testing.T) {
+	databasetest.Migrated(t, withModules("polls"), func(t *testing.T, db *database.DB) {
+		h, _ := newPollHarness(t, db)
+		client := &slowClient{Client: h.Client}
+		h.Bot = bot.NewBotWithClient(bot.BotConfiguration{}, h.Storage, client, bottest.BotID)
+		reactions := bot.NewReactionRegistry(db)
+		polls, err := NewPolls(context.Background(), h.Bot, cron.New(), db, reactions)
+		assert.NilError(t, err)
+		assert.NilError(t, AddPollHandlers(context.Background(), h.Bot, polls))
+
+		h.Send(bottest.Room, alice, `jarvis poll "Dinner?" pizza | sushi`)
+		pollEvent := h.Client.Messages()[0].EventID
+
+		// votes arrive before we know which event the poll is
+		h.React(bottest.Room, alice, pollEvent, "2️⃣")
+		h.React(bottest.Room, bob, "$unrelated", "1️⃣")
+		assert.DeepEqual(t, tally(t, polls, 1), []int{0, 0})
+
+		for _, callback := range client.callbacks {
+			callback()
+		}
+		assert.DeepEqual(t, tally(t, polls, 1), []int{0, 1})
+		assert.Equal(t, len(polls.held), 0)
+	})
+}
+
+func TestPollClosesOnce(t *testing.T) {
+	databasetest.Migrated(t, withModules("polls"), func(t *testing.T, db *database.DB) {
+		h, polls := newPollHarness(t, db)
+		h.Send(bottest.Room, alice, `jarvis poll "Dinner?" pizza | sushi`)
+
+		// the deadline and a manual close each loaded the poll before either closed it
+		first, err := polls.FindByID(context.Background(), 1)
+		assert.NilError(t, err)
+		second, err := polls.FindByID(context.Background(), 1)
+		assert.NilError(t, err)
+
+		h.Client.Reset()
+		assert.NilError(t, polls.Close(context.Background(), first))
+		err = polls.Close(context.Background(), second)
+		assert.Assert(t, errors.Is(err, ErrPollClosed), err)
+		assert.Equal(t, len(h.Bodies(bottest.Room)), 1)
+	})
+}
+
+// failingClient refuses to send events, like a homeserver that rejects them.
+type failingClient struct {
+	*bottest.Client
+}
+
+func (c *failingClient) SendMessageEvent(roomID id.RoomID, eventType event.Type, content interface{}, sent func(id.EventID, error)) {
+	if sent != nil {
+		sent("", errors.New("M_FORBIDDEN"))
+	}
+}
+
+func TestUnpostedPoll(t *testing.T) {
+	databasetest.Migrated(t, withModules("polls"), func(t *testing.T, db *database.DB) {
+		h, _ := newPollHarness(t, db)
+		client := &failingClient{Client: h.Client}
+		h.Bot = bot.NewBotWithClient(bot.BotConfiguration{}, h.Storage, client, bottest.BotID)
+		reactions := bot.NewReactionRegistry(db)
+		bot.AddReactionHandlers(h.Bot, reactions)
+		c := cron.New()
+		polls, err := NewPolls(context.Background(), h.Bot, c, db, reactions)
+		assert.NilError(t, err)
+		assert.NilError(t, AddPollHandlers(context.Background(), h.Bot, polls))
+
+		h.Send(bottest.Room, alice, `jarvis poll "Dinner?" pizza | sushi for 1h`)
+		poll, err := polls.FindByID(context.Background(), 1)
+		assert.NilError(t, err)
+		assert.Assert(t, poll == nil)
+		assert.Equal(t, len(c.Entries()), 0)
+
+		// votes are no longer held for the poll that never made it
+		h.React(bottest.Room, bob, "$unrelated", "1️⃣")
+		assert.Equal(t, len(polls.held), 0)
+	})
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"github.com/ilikeorangutans/jarvis/pkg/database"
 	"github.com/ilikeorangutans/jarvis/pkg/predicates"
 	"github.com/jmoiron/sqlx"
 	"github.com/robfig/cron/v3"
@@ -24,21 +25,27 @@ var (
 	cancelRegex        = regexp.MustCompile(`(?i)\A\s*cancel\s+reminder\s+([0-9]+)`)
 	listRegex          = regexp.MustCompile(`(?i)\A\s*reminders`)
 	messageRegex       = regexp.MustCompile(`(?i)\A\s*remind\s+me\s+(.*)`)
+	sunSpecifierRegex  = regexp.MustCompile(`(?i)\A(this|next|on|every)?\s*(today|tomorrow|day|monday|tuesday|wednesday|thursday|friday|saturday|sunday|weekday)?\s*(([0-9]+)\s*(minutes?|mins?|hours?|h)\s+(before|after)|at)\s+(sunrise|sunset|dawn|dusk)(\s+.*)?\z`)
 	timeSpecifierRegex = regexp.MustCompile(`(?i)(this|next|on|every)?\s*(today|tomorrow|day|monday|tuesday|wednesday|thursday|friday|saturday|sunday|weekday)?(\s*(at\s+([0-9]{1,2}):?([0-9]{2})?(am|pm)?|morning|noon|afternoon|evening|night))?(\s+.*)?`)
 )
 
-func NewReminders(ctx context.Context, b *bot.Bot, c *cron.Cron, db sqlx.Ext) (*Reminders, error) {
-	return &Reminders{
-		c:  c,
-		b:  b,
-		db: db,
-	}, nil
+func NewReminders(ctx context.Context, b *bot.Bot, c *cron.Cron, db sqlx.Ext, locations *Locations) (*Reminders, error) {
+	r := &Reminders{
+		c:         c,
+		b:         b,
+		db:        db,
+		locations: locations,
+	}
+	// sun reminders are scheduled for the location at the time, so they move with the user
+	locations.OnSave(r.rescheduleSunReminders)
+	return r, nil
 }
 
 type Reminders struct {
-	c  *cron.Cron
-	b  *bot.Bot
-	db sqlx.Ext
+	c         *cron.Cron
+	b         *bot.Bot
+	db        sqlx.Ext
+	locations *Locations
 }
 
 func (r *Reminders) Start(ctx context.Context) error {
@@ -67,20 +74,15 @@ func (r *Reminders) Start(ctx context.Context) error {
 
 func (r *Reminders) Add(ctx context.Context, reminder *Reminder) error {
 	log.Info().Msgf("adding reminder %s, %s", reminder.EffectiveDay(), reminder.Day)
-	result, err := sq.
+	// resolve "today" and "tomorrow" now, the schedule only understands weekdays
+	reminder.Day = reminder.EffectiveDay()
+	id, err := database.InsertReturningID(ctx, r.db, sq.
 		Insert("reminders").
-		Columns("recurring", "minute", "hour", "day", "message", "room", "user", "created_at").
-		Values(reminder.Recurring, reminder.Minute, reminder.Hour, reminder.EffectiveDay(), reminder.Message, reminder.Room, reminder.User, reminder.CreatedAt).
-		RunWith(r.db).
-		ExecContext(ctx)
+		Columns("recurring", "minute", "hour", "day", "message", "room", `"user"`, "created_at", "sun_event", "sun_offset").
+		Values(reminder.Recurring, reminder.Minute, reminder.Hour, reminder.Day, reminder.Message, reminder.Room, reminder.User, reminder.CreatedAt, reminder.SunEvent, reminder.SunOffset))
 	if err != nil {
 		return fmt.Errorf("could not insert record: %w", err)
 	}
-
-	id, err := result.LastInsertId()
-	if err != nil {
-		return fmt.Errorf("could not get last inserted id: %w", err)
-	}
 	reminder.ID = id
 
 	r.schedule(ctx, reminder)
@@ -107,13 +109,27 @@ func (r *Reminders) Update(ctx context.Context, reminder *Reminder) error {
 	return err
 }
 func (r *Reminders) schedule(ctx context.Context, reminder *Reminder) {
-	spec := reminder.ToSpec()
-	log.Info().Str("spec", spec).Send()
-	entryID, err := r.c.AddFunc(spec, func() {
-		r.sendReminder(reminder)
-	})
-	if err != nil {
-		log.Error().Err(err).Msg("could not schedule")
+	var entryID cron.EntryID
+	if reminder.SunEvent != "" {
+		location, err := r.locations.ForUser(ctx, reminder.User)
+		if err != nil {
+			log.Error().Err(err).Int64("id", reminder.ID).Msg("could not schedule, no location")
+			return
+		}
+		log.Info().Str("sun-event", reminder.SunEvent).Int("offset", reminder.SunOffset).Stringer("location", location).Send()
+		entryID = r.c.Schedule(&SunSchedule{Reminder: reminder, Location: location}, cron.FuncJob(func() {
+			r.sendReminder(reminder)
+		}))
+	} else {
+		spec := reminder.ToSpec()
+		log.Info().Str("spec", spec).Send()
+		var err error
+		entryID, err = r.c.AddFunc(spec, func() {
+			r.sendReminder(reminder)
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("could not schedule")
+		}
 	}
 
 	reminder.EntryID = &entryID
@@ -122,13 +138,34 @@ func (r *Reminders) schedule(ctx context.Context, reminder *Reminder) {
 	}
 }
 
+// rescheduleSunReminders schedules the user's sun reminders again, for the user's current location.
+func (r *Reminders) rescheduleSunReminders(ctx context.Context, userID id.UserID) {
+	reminders, err := r.List(userID)
+	if err != nil {
+		log.Error().Err(err).Str("user-id", userID.String()).Msg("could not load reminders to reschedule")
+		return
+	}
+	for _, reminder := range reminders {
+		if reminder.SunEvent == "" {
+			continue
+		}
+		if reminder.EntryID != nil {
+			r.c.Remove(*reminder.EntryID)
+		}
+		r.schedule(ctx, reminder)
+	}
+}
+
 func (r *Reminders) sendReminder(reminder *Reminder) {
 	log.Info().Str("user-id", reminder.User.String()).Str("reminder", reminder.Message).Msg("sending reminder")
 	user, _, _ := reminder.User.Parse()
 	r.b.Client().SendText(reminder.Room, fmt.Sprintf("🗓️ %s, reminding you %s", user, reminder.Message))
 
+	// removing it as part of the job means stopping cron waits for it
 	if !reminder.Recurring {
-		go r.Remove(context.Background(), reminder.ID)
+		if err := r.Remove(context.Background(), reminder.ID); err != nil {
+			log.Error().Err(err).Int64("id", reminder.ID).Msg("could not remove reminder")
+		}
 	}
 }
 
@@ -161,7 +198,7 @@ func (r *Reminders) List(userID id.UserID) ([]*Reminder, error) {
 	var reminders []*Reminder
 	sql, args, err := sq.Select("*").
 		From("reminders").
-		Where(sq.Eq{"user": userID}).
+		Where(sq.Eq{`"user"`: userID}).
 		ToSql()
 	if err != nil {
 		return nil, fmt.Errorf("could not build query: %w", err)
@@ -185,7 +222,26 @@ func AddReminderHandlers(ctx context.Context, b *bot.Bot, reminders *Reminders)
 				return nil
 			}
 			command := parts[1]
-			if timeSpecifierRegex.MatchString(command) {
+			if sunSpecifierRegex.MatchString(command) {
+				reminder, err := SunReminderFromParts(sunSpecifierRegex.FindStringSubmatch(command))
+				if err != nil {
+					return err
+				}
+				reminder.User = evt.Sender
+				reminder.Room = evt.RoomID
+				reminder.CreatedAt = time.Now()
+
+				if _, err := reminders.locations.ForUser(ctx, evt.Sender); err != nil {
+					client.SendHTML(evt.RoomID, locationHelp(err))
+					return nil
+				}
+
+				if err := reminders.Add(ctx, reminder); err != nil {
+					return err
+				}
+
+				client.SendText(evt.RoomID, fmt.Sprintf("🗓️ New reminder (%d) %s", reminder.ID, reminder))
+			} else if timeSpecifierRegex.MatchString(command) {
 				parsed := timeSpecifierRegex.FindStringSubmatch(command)
 
 				reminder, err := ReminderFromParts(parsed)
@@ -255,12 +311,8 @@ func AddReminderHandlers(ctx context.Context, b *bot.Bot, reminders *Reminders)
 				}
 
 				sb.WriteString(reminder.Day)
-				sb.WriteString(" at ")
-				sb.WriteString(reminder.Hour)
-				if reminder.Minute != "" {
-					sb.WriteString(":")
-					sb.WriteString(reminder.Minute)
-				}
+				sb.WriteString(" ")
+				sb.WriteString(reminder.TimeOfDay())
 				sb.WriteString(": ")
 				sb.WriteString(reminder.Message)
 
@@ -334,6 +386,39 @@ func ReminderFromParts(parsed []string) (*Reminder, error) {
 	}, nil
 }
 
+// SunReminderFromParts builds a reminder relative to a sun event from a sunSpecifierRegex match. Reminders without
+// a day fire at the next occurrence of the event.
+func SunReminderFromParts(parsed []string) (*Reminder, error) {
+	recurring := strings.EqualFold(parsed[1], "every")
+	day := strings.ToLower(strings.TrimSpace(parsed[2]))
+	if day == "" {
+		day = "day"
+	}
+
+	offset := 0
+	if parsed[4] != "" {
+		n, err := strconv.Atoi(parsed[4])
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(strings.ToLower(parsed[5]), "h") {
+			n *= 60
+		}
+		if strings.EqualFold(parsed[6], "before") {
+			n = -n
+		}
+		offset = n
+	}
+
+	return &Reminder{
+		Recurring: recurring,
+		Day:       day,
+		SunEvent:  strings.ToLower(parsed[7]),
+		SunOffset: offset,
+		Message:   strings.TrimSpace(parsed[8]),
+	}, nil
+}
+
 type Reminder struct {
 	ID        int64
 	CreatedAt time.Time `db:"created_at"`
@@ -345,6 +430,71 @@ type Reminder struct {
 	Room      id.RoomID
 	User      id.UserID
 	EntryID   *cron.EntryID `db:"entry_id"`
+	// SunEvent is one of sunrise, sunset, dawn or dusk for reminders relative to the sun, in which case Hour and
+	// Minute are unused.
+	SunEvent string `db:"sun_event"`
+	// SunOffset is the offset from SunEvent in minutes, negative for before the event.
+	SunOffset int `db:"sun_offset"`
+}
+
+// TimeOfDay describes when on a day the reminder fires, e.g. "at 08:00" or "30 minutes before sunset".
+func (r *Reminder) TimeOfDay() string {
+	if r.SunEvent == "" {
+		if r.Minute == "" {
+			return "at " + r.Hour
+		}
+		return fmt.Sprintf("at %s:%s", r.Hour, r.Minute)
+	}
+
+	offset := r.SunOffset
+	direction := "after"
+	if offset < 0 {
+		offset = -offset
+		direction = "before"
+	}
+	switch {
+	case offset == 0:
+		return "at " + r.SunEvent
+	case offset%60 == 0:
+		return fmt.Sprintf("%s %s %s", humanizeCount(offset/60, "hour"), direction, r.SunEvent)
+	default:
+		return fmt.Sprintf("%s %s %s", humanizeCount(offset, "minute"), direction, r.SunEvent)
+	}
+}
+
+func humanizeCount(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// SunSchedule is a cron schedule firing at a reminder's sun event. The event time is recomputed for every
+// occurrence, so the schedule follows the sun as it drifts through the year.
+type SunSchedule struct {
+	Reminder *Reminder
+	Location Location
+}
+
+// Next returns the first occurrence after t, or the zero time if the event doesn't happen within a year.
+func (s *SunSchedule) Next(t time.Time) time.Time {
+	local := t.In(s.Location.TimeZone)
+	for i := 0; i < 366; i++ {
+		day := local.AddDate(0, 0, i)
+		if !s.Reminder.OccursOn(day) {
+			continue
+		}
+		event := ComputeSunTimes(s.Location, day).Event(s.Reminder.SunEvent)
+		if event.IsZero() {
+			continue
+		}
+		at := event.Add(time.Duration(s.Reminder.SunOffset) * time.Minute).Truncate(time.Minute)
+		if at.After(t) {
+			return at
+		}
+	}
+
+	return time.Time{}
 }
 
 // ResolveDay takes relative day specifiers, like "tomorrow" and resolves them to a specific day of the week.
@@ -382,6 +532,9 @@ func tomorrow(t time.Time) string {
 }
 
 func (r *Reminder) EffectiveDay() string {
+	if r.SunEvent != "" && r.Day == "" {
+		return "day"
+	}
 	location, _ := time.LoadLocation("EST")
 	now := time.Now().In(location)
 	resolved := r.ResolveRelativeDay(now)
@@ -393,6 +546,18 @@ func (r *Reminder) EffectiveDay() string {
 	}
 }
 
+// OccursOn reports whether the reminder fires on the weekday of t.
+func (r *Reminder) OccursOn(t time.Time) bool {
+	switch r.Day {
+	case "day":
+		return true
+	case "weekday":
+		return t.Weekday() != time.Saturday && t.Weekday() != time.Sunday
+	default:
+		return r.Day == today(t)
+	}
+}
+
 func (r *Reminder) ToSpecDay() string {
 	effective := r.EffectiveDay()
 	switch effective {
@@ -422,8 +587,12 @@ func (r *Reminder) String() string {
 		parts = append(parts, "every")
 	}
 	parts = append(parts, r.EffectiveDay())
-	parts = append(parts, "at")
-	parts = append(parts, fmt.Sprintf("%s:%s:", r.Hour, r.Minute))
+	if r.SunEvent != "" {
+		parts = append(parts, r.TimeOfDay()+":")
+	} else {
+		parts = append(parts, "at")
+		parts = append(parts, fmt.Sprintf("%s:%s:", r.Hour, r.Minute))
+	}
 	parts = append(parts, r.Message)
 
 	return strings.Join(parts, " ")
@@ -1,10 +1,18 @@
 package jarvis
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"github.com/ilikeorangutans/jarvis/pkg/bot/bottest"
+	"github.com/ilikeorangutans/jarvis/pkg/database"
+	"github.com/ilikeorangutans/jarvis/pkg/database/databasetest"
+	"github.com/robfig/cron/v3"
 	"gotest.tools/assert"
 )
 
@@ -63,3 +71,141 @@ func TestResolveRelativeDay(t *testing.T) {
 	}
 
 }
+
+func TestReminderOccursOn(t *testing.T) {
+	friday := time.Date(2021, time.January, 8, 7, 0, 0, 0, time.UTC)
+	saturday := friday.AddDate(0, 0, 1)
+
+	assert.Assert(t, (&Reminder{Day: "day"}).OccursOn(saturday))
+	assert.Assert(t, (&Reminder{Day: "weekday"}).OccursOn(friday))
+	assert.Assert(t, !(&Reminder{Day: "weekday"}).OccursOn(saturday))
+	assert.Assert(t, (&Reminder{Day: "friday"}).OccursOn(friday))
+	assert.Assert(t, !(&Reminder{Day: "friday"}).OccursOn(saturday))
+}
+
+func TestSunReminderFromParts(t *testing.T) {
+	data := []struct {
+		input     string
+		recurring bool
+		day       string
+		event     string
+		offset    int
+		message   string
+		timeOfDay string
+	}{
+		{"every day 30 minutes before sunset to close the blinds", true, "day", "sunset", -30, "to close the blinds", "30 minutes before sunset"},
+		{"at sunrise to water the plants", false, "day", "sunrise", 0, "to water the plants", "at sunrise"},
+		{"tomorrow 1 hour after dusk to walk the dog", false, "tomorrow", "dusk", 60, "to walk the dog", "1 hour after dusk"},
+		{"every weekday 2 hours before sunset to leave work", true, "weekday", "sunset", -120, "to leave work", "2 hours before sunset"},
+	}
+
+	for _, d := range data {
+		assert.Assert(t, sunSpecifierRegex.MatchString(d.input), d.input)
+		reminder, err := SunReminderFromParts(sunSpecifierRegex.FindStringSubmatch(d.input))
+		assert.NilError(t, err)
+		assert.Equal(t, reminder.Recurring, d.recurring, d.input)
+		assert.Equal(t, reminder.Day, d.day, d.input)
+		assert.Equal(t, reminder.SunEvent, d.event, d.input)
+		assert.Equal(t, reminder.SunOffset, d.offset, d.input)
+		assert.Equal(t, reminder.Message, d.message, d.input)
+		assert.Equal(t, reminder.TimeOfDay(), d.timeOfDay, d.input)
+	}
+
+	assert.Assert(t, !sunSpecifierRegex.MatchString("every day at 8am to do foo"))
+}
+
+func TestSunSchedule(t *testing.T) {
+	tz, err := time.LoadLocation("America/Toronto")
+	assert.NilError(t, err)
+	location := Location{Latitude: 43.65, Longitude: -79.38, TimeZone: tz}
+	schedule := &SunSchedule{
+		Reminder: &Reminder{Recurring: true, Day: "day", SunEvent: "sunset", SunOffset: -30},
+		Location: location,
+	}
+
+	now := time.Date(2021, time.January, 8, 12, 0, 0, 0, tz)
+	next := schedule.Next(now)
+	sunset := ComputeSunTimes(location, now).Sunset
+	assert.Equal(t, next, sunset.Add(-30*time.Minute).Truncate(time.Minute))
+
+	// after today's occurrence, the next one is tomorrow's, computed for tomorrow's sunset
+	following := schedule.Next(next)
+	assert.Equal(t, following.Day(), 9)
+	assert.Assert(t, following.Sub(next) > 24*time.Hour, "sunsets get later in January")
+
+	schedule.Reminder.Day = "monday"
+	assert.Equal(t, schedule.Next(now).Weekday(), time.Monday)
+}
+
+func TestAddSunReminder(t *testing.T) {
+	databasetest.Migrated(t, withModules("locations"), func(t *testing.T, db *database.DB) {
+		ctx := context.Background()
+		tz, err := time.LoadLocation("America/Toronto")
+		assert.NilError(t, err)
+		location := &Location{Latitude: 43.65, Longitude: -79.38, TimeZone: tz}
+		c := cron.New()
+		reminders, err := NewReminders(ctx, bottest.New(t, bot.BotConfiguration{}).Bot, c, db, NewLocations(db, location))
+		assert.NilError(t, err)
+
+		for _, day := range []string{"today", "tomorrow"} {
+			reminder := &Reminder{Day: day, SunEvent: "sunset", Message: "to water the plants", Room: bottest.Room, User: "@alice:example.com"}
+			assert.NilError(t, reminders.Add(ctx, reminder))
+			assert.Assert(t, reminder.Day != day, "relative day is resolved")
+
+			now := time.Now()
+			next := c.Entry(*reminder.EntryID).Schedule.Next(now)
+			assert.Assert(t, !next.IsZero(), "%s at sunset never fires", day)
+			assert.Assert(t, next.Sub(now) < 8*24*time.Hour)
+		}
+
+		// moving reschedules pending sun reminders for the new location
+		reminder, err := reminders.FindByID(ctx, 1)
+		assert.NilError(t, err)
+		vancouver, err := time.LoadLocation("America/Vancouver")
+		assert.NilError(t, err)
+		assert.NilError(t, reminders.locations.Save(ctx, "@alice:example.com", Location{Latitude: 49.28, Longitude: -123.12, TimeZone: vancouver}))
+		moved, err := reminders.FindByID(ctx, 1)
+		assert.NilError(t, err)
+		assert.Assert(t, *moved.EntryID != *reminder.EntryID)
+		assert.Equal(t, len(c.Entries()), 2)
+		schedule := c.Entry(*moved.EntryID).Schedule.(*SunSchedule)
+		assert.Equal(t, schedule.Location.Latitude, 49.28)
+	})
+}
+
+func TestReminderHandlers(t *testing.T) {
+	databasetest.Migrated(t, databasetest.Core, func(t *testing.T, db *database.DB) {
+		ctx := context.Background()
+		h := bottest.New(t, bot.BotConfiguration{})
+		c := cron.New()
+		reminders, err := NewReminders(ctx, h.Bot, c, db, NewLocations(db, nil))
+		assert.NilError(t, err)
+		assert.NilError(t, AddReminderHandlers(ctx, h.Bot, reminders))
+
+		h.Send(bottest.Room, "@alice:example.com", "remind me every day at 9am to call mom")
+		assert.DeepEqual(t, h.Bodies(bottest.Room), []string{"🗓️ New reminder (1) every day at 9:00: to call mom"})
+
+		reminder, err := reminders.FindByID(ctx, 1)
+		assert.NilError(t, err)
+		h.Client.Reset()
+		c.Entry(*reminder.EntryID).Job.Run()
+		assert.DeepEqual(t, h.Bodies(bottest.Room), []string{"🗓️ alice, reminding you to call mom"})
+
+		// one-off reminders are gone once sent
+		h.Send(bottest.Room, "@alice:example.com", "remind me tomorrow at 9am to buy milk")
+		reminder, err = reminders.FindByID(ctx, 2)
+		assert.NilError(t, err)
+		c.Entry(*reminder.EntryID).Job.Run()
+		_, err = reminders.FindByID(ctx, 2)
+		assert.Assert(t, errors.Is(err, sql.ErrNoRows), err)
+		assert.Equal(t, len(c.Entries()), 1)
+
+		h.Client.Reset()
+		h.Send(bottest.Room, "@alice:example.com", "cancel reminder 1")
+		h.Send(bottest.Room, "@alice:example.com", "reminders")
+		assert.DeepEqual(t, h.Bodies(bottest.Room), []string{
+			"✅ Very good, I've cancelled your reminder 1.",
+			"🗓️ I have no reminders for you, alice",
+		})
+	})
+}
@@ -2,10 +2,11 @@ package jarvis
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
+	"math"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/ilikeorangutans/jarvis/pkg/bot"
@@ -15,53 +16,243 @@ import (
 	"maunium.net/go/mautrix/event"
 )
 
-type geolocationResp struct {
-	CountryName string  `json:"country_name"`
-	City        string  `json:"city"`
-	TimeZone    string  `json:"time_zone"`
-	Latitude    float64 `json:"latitude"`
-	Longitude   float64 `json:"longitude"`
+const (
+	// Elevations of the sun's center for the respective events, in degrees. Sunrise and sunset account for
+	// refraction and the sun's apparent radius.
+	elevationSunrise  = -0.833
+	elevationCivil    = -6.0
+	elevationNautical = -12.0
+
+	synodicMonth = 29.530588853
+)
+
+var (
+	sunRegex = regexp.MustCompile(`(?i)\A\s*(sunrise|sunset|sun)(\s+(on\s+)?(today|tomorrow|monday|tuesday|wednesday|thursday|friday|saturday|sunday))?\s*\z`)
+
+	// A known new moon, used as the epoch for moon phase calculations.
+	knownNewMoon = time.Date(2000, time.January, 6, 18, 14, 0, 0, time.UTC)
+)
+
+// SunTimes holds the sun events for a single day. Events that don't occur, e.g. during polar day or night, are
+// the zero time.
+type SunTimes struct {
+	Date         time.Time
+	Sunrise      time.Time
+	Sunset       time.Time
+	CivilDawn    time.Time
+	CivilDusk    time.Time
+	NauticalDawn time.Time
+	NauticalDusk time.Time
+	DayLength    time.Duration
 }
 
-func AddSunriseHandlers(ctx context.Context, b *bot.Bot) error {
-	b.On(
-		func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+// Event returns the time of the named event: sunrise, sunset, dawn (civil) or dusk (civil).
+func (s SunTimes) Event(name string) time.Time {
+	switch name {
+	case "sunrise":
+		return s.Sunrise
+	case "sunset":
+		return s.Sunset
+	case "dawn":
+		return s.CivilDawn
+	case "dusk":
+		return s.CivilDusk
+	default:
+		return time.Time{}
+	}
+}
 
-			url := "https://freegeoip.app/json/"
+// ComputeSunTimes calculates the sun events at the location on the calendar day of date in the location's time zone.
+func ComputeSunTimes(location Location, date time.Time) SunTimes {
+	date = date.In(location.TimeZone)
+	year, month, day := date.Date()
 
-			req, err := http.NewRequest("GET", url, nil)
-			if err != nil {
-				return fmt.Errorf("could not create geolocation request: %w", err)
-			}
-			req.Header.Add("accept", "application/json")
-			req.Header.Add("content-type", "application/json")
-			res, err := http.DefaultClient.Do(req)
-			if err != nil {
-				return fmt.Errorf("could not make geolocation request: %w", err)
-			}
-			defer res.Body.Close()
-			decoder := json.NewDecoder(res.Body)
-			var geolocation geolocationResp
-			err = decoder.Decode(&geolocation)
-			if err != nil {
-				return fmt.Errorf("error decoding json: %w", err)
-			}
+	times := SunTimes{
+		Date: time.Date(year, month, day, 0, 0, 0, 0, location.TimeZone),
+	}
+	times.Sunrise, times.Sunset = timeOfElevation(location, elevationSunrise, year, month, day)
+	times.CivilDawn, times.CivilDusk = timeOfElevation(location, elevationCivil, year, month, day)
+	times.NauticalDawn, times.NauticalDusk = timeOfElevation(location, elevationNautical, year, month, day)
+	if !times.Sunrise.IsZero() {
+		times.DayLength = times.Sunset.Sub(times.Sunrise)
+	} else if sunAlwaysUp(location, year, month, day) {
+		times.DayLength = 24 * time.Hour
+	}
+
+	return times
+}
+
+// timeOfElevation returns when the sun passes the given elevation in the morning and evening. This is the same
+// calculation as sunrise.SunriseSunset with a configurable elevation.
+func timeOfElevation(location Location, elevation float64, year int, month time.Month, day int) (time.Time, time.Time) {
+	hourAngle := hourAngleAt(location, elevation, year, month, day)
+	if math.IsNaN(hourAngle) {
+		return time.Time{}, time.Time{}
+	}
+
+	transit := solarTransit(location, year, month, day)
+	frac := hourAngle / 360
+	return sunrise.JulianDayToTime(transit - frac).In(location.TimeZone), sunrise.JulianDayToTime(transit + frac).In(location.TimeZone)
+}
+
+func solarTransit(location Location, year int, month time.Month, day int) float64 {
+	var (
+		d                 = sunrise.MeanSolarNoon(location.Longitude, year, month, day)
+		solarAnomaly      = sunrise.SolarMeanAnomaly(d)
+		equationOfCenter  = sunrise.EquationOfCenter(solarAnomaly)
+		eclipticLongitude = sunrise.EclipticLongitude(solarAnomaly, equationOfCenter, d)
+	)
+	return sunrise.SolarTransit(d, solarAnomaly, eclipticLongitude)
+}
+
+func cosHourAngle(location Location, elevation float64, year int, month time.Month, day int) float64 {
+	var (
+		d                 = sunrise.MeanSolarNoon(location.Longitude, year, month, day)
+		solarAnomaly      = sunrise.SolarMeanAnomaly(d)
+		equationOfCenter  = sunrise.EquationOfCenter(solarAnomaly)
+		eclipticLongitude = sunrise.EclipticLongitude(solarAnomaly, equationOfCenter, d)
+		declination       = sunrise.Declination(eclipticLongitude) * sunrise.Degree
+		latitude          = location.Latitude * sunrise.Degree
+	)
+	return (math.Sin(elevation*sunrise.Degree) - math.Sin(latitude)*math.Sin(declination)) / (math.Cos(latitude) * math.Cos(declination))
+}
 
-			location, err := time.LoadLocation(geolocation.TimeZone)
+// hourAngleAt returns the hour angle in degrees, or NaN if the sun never reaches the elevation that day.
+func hourAngleAt(location Location, elevation float64, year int, month time.Month, day int) float64 {
+	c := cosHourAngle(location, elevation, year, month, day)
+	if c > 1 || c < -1 {
+		return math.NaN()
+	}
+	return math.Acos(c) / sunrise.Degree
+}
+
+func sunAlwaysUp(location Location, year int, month time.Month, day int) bool {
+	return cosHourAngle(location, elevationSunrise, year, month, day) < -1
+}
+
+// MoonPhase describes the moon at a point in time.
+type MoonPhase struct {
+	// Age is the number of days since the last new moon.
+	Age float64
+	// Illumination is the illuminated fraction of the disc, from 0 to 1.
+	Illumination float64
+	Name         string
+	Emoji        string
+}
+
+func (m MoonPhase) String() string {
+	return fmt.Sprintf("%s %s (%.0f%%)", m.Emoji, m.Name, m.Illumination*100)
+}
+
+func ComputeMoonPhase(t time.Time) MoonPhase {
+	age := math.Mod(t.Sub(knownNewMoon).Hours()/24, synodicMonth)
+	if age < 0 {
+		age += synodicMonth
+	}
+	phase := age / synodicMonth
+
+	names := []struct {
+		name  string
+		emoji string
+	}{
+		{"new moon", "🌑"},
+		{"waxing crescent", "🌒"},
+		{"first quarter", "🌓"},
+		{"waxing gibbous", "🌔"},
+		{"full moon", "🌕"},
+		{"waning gibbous", "🌖"},
+		{"last quarter", "🌗"},
+		{"waning crescent", "🌘"},
+	}
+	i := int(math.Floor(phase*8+0.5)) % 8
+
+	return MoonPhase{
+		Age:          age,
+		Illumination: (1 - math.Cos(2*math.Pi*phase)) / 2,
+		Name:         names[i].name,
+		Emoji:        names[i].emoji,
+	}
+}
+
+// ResolveDay returns the date referred to by "today", "tomorrow" or a weekday name, relative to now. Weekdays
+// refer to the next occurrence, including today.
+func ResolveDay(now time.Time, day string) time.Time {
+	switch strings.ToLower(day) {
+	case "", "today":
+		return now
+	case "tomorrow":
+		return now.AddDate(0, 0, 1)
+	}
+
+	for i := 0; i < 7; i++ {
+		candidate := now.AddDate(0, 0, i)
+		if strings.EqualFold(candidate.Weekday().String(), day) {
+			return candidate
+		}
+	}
+	return now
+}
+
+func formatClock(t time.Time) string {
+	if t.IsZero() {
+		return "—"
+	}
+	return t.Format("15:04")
+}
+
+func formatDayLength(d time.Duration) string {
+	d = d.Round(time.Minute)
+	return fmt.Sprintf("%dh %02dm", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// FormatSunTimes renders the sun events for a day as HTML.
+func FormatSunTimes(times SunTimes, moon MoonPhase) string {
+	var builder strings.Builder
+	if times.Sunrise.IsZero() {
+		if times.DayLength > 0 {
+			builder.WriteString("☀️ the sun doesn't set")
+		} else {
+			builder.WriteString("🌑 the sun doesn't rise")
+		}
+	} else {
+		builder.WriteString(fmt.Sprintf("🌄 sunrise at %s, 🌇 sunset at %s", formatClock(times.Sunrise), formatClock(times.Sunset)))
+	}
+	builder.WriteString(" on ")
+	builder.WriteString(times.Date.Format("Monday, January 2"))
+	builder.WriteString("<br/>")
+	builder.WriteString(fmt.Sprintf("civil twilight %s–%s, nautical twilight %s–%s<br/>",
+		formatClock(times.CivilDawn), formatClock(times.CivilDusk),
+		formatClock(times.NauticalDawn), formatClock(times.NauticalDusk),
+	))
+	builder.WriteString(fmt.Sprintf("day length %s, moon: %s", formatDayLength(times.DayLength), moon))
+
+	return builder.String()
+}
+
+func locationHelp(err error) string {
+	if errors.Is(err, ErrNoLocation) {
+		return "I don't know where you are. Tell me like so: <tt>set my location to 43.65, -79.38 in America/Toronto</tt>"
+	}
+	return fmt.Sprintf("I couldn't determine your location: %s", err)
+}
+
+func AddSunriseHandlers(ctx context.Context, b *bot.Bot, locations *Locations) error {
+	b.On(
+		func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			parts := sunRegex.FindStringSubmatch(evt.Content.AsMessage().Body)
+			location, err := locations.ForUser(ctx, evt.Sender)
 			if err != nil {
-				return fmt.Errorf("could not load location: %w", err)
+				client.SendHTML(evt.RoomID, locationHelp(err))
+				return nil
 			}
-			now := time.Now()
-			rise, set := sunrise.SunriseSunset(
-				geolocation.Latitude, geolocation.Longitude,
-				now.Year(), now.Local().Month(), now.Day(),
-			)
 
-			client.SendHTML(evt.RoomID, fmt.Sprintf("🌄 sunrise at %s, 🌇 sunset at %s", rise.In(location).Format("15:04"), set.In(location).Format("15:04")))
+			date := ResolveDay(time.Now().In(location.TimeZone), parts[4])
+			times := ComputeSunTimes(location, date)
+			client.SendHTML(evt.RoomID, FormatSunTimes(times, ComputeMoonPhase(times.Date.Add(12*time.Hour))))
 			return nil
 		},
 		predicates.All(
-			predicates.MessageMatching(regexp.MustCompile(`(?i)\A\s*(sunrise|sunset)`)),
+			predicates.MessageMatching(sunRegex),
 		),
 	)
 
@@ -0,0 +1,93 @@
+package jarvis
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nathan-osman/go-sunrise"
+	"gotest.tools/assert"
+)
+
+func toronto(t *testing.T) Location {
+	tz, err := time.LoadLocation("America/Toronto")
+	assert.NilError(t, err)
+	return Location{Latitude: 43.65, Longitude: -79.38, TimeZone: tz}
+}
+
+func TestComputeSunTimes(t *testing.T) {
+	location := toronto(t)
+	date := time.Date(2021, time.January, 8, 14, 30, 0, 0, location.TimeZone)
+
+	times := ComputeSunTimes(location, date)
+	rise, set := sunrise.SunriseSunset(location.Latitude, location.Longitude, 2021, time.January, 8)
+
+	assert.Assert(t, times.Sunrise.Sub(rise) < time.Minute && rise.Sub(times.Sunrise) < time.Minute)
+	assert.Assert(t, times.Sunset.Sub(set) < time.Minute && set.Sub(times.Sunset) < time.Minute)
+	assert.Equal(t, times.Sunrise.Location(), location.TimeZone)
+	assert.Equal(t, times.Sunrise.Format("15:04"), "07:50")
+
+	assert.Assert(t, times.NauticalDawn.Before(times.CivilDawn))
+	assert.Assert(t, times.CivilDawn.Before(times.Sunrise))
+	assert.Assert(t, times.Sunset.Before(times.CivilDusk))
+	assert.Assert(t, times.CivilDusk.Before(times.NauticalDusk))
+	assert.Equal(t, times.DayLength, times.Sunset.Sub(times.Sunrise))
+}
+
+func TestComputeSunTimesPolar(t *testing.T) {
+	location := Location{Latitude: 78.22, Longitude: 15.65, TimeZone: time.UTC}
+
+	winter := ComputeSunTimes(location, time.Date(2021, time.January, 8, 12, 0, 0, 0, time.UTC))
+	assert.Assert(t, winter.Sunrise.IsZero())
+	assert.Equal(t, winter.DayLength, time.Duration(0))
+	assert.Assert(t, strings.Contains(FormatSunTimes(winter, ComputeMoonPhase(winter.Date)), "doesn't rise"))
+
+	summer := ComputeSunTimes(location, time.Date(2021, time.June, 21, 12, 0, 0, 0, time.UTC))
+	assert.Assert(t, summer.Sunrise.IsZero())
+	assert.Equal(t, summer.DayLength, 24*time.Hour)
+	assert.Assert(t, strings.Contains(FormatSunTimes(summer, ComputeMoonPhase(summer.Date)), "doesn't set"))
+}
+
+func TestComputeMoonPhase(t *testing.T) {
+	full := ComputeMoonPhase(time.Date(2021, time.January, 28, 19, 16, 0, 0, time.UTC))
+	assert.Equal(t, full.Name, "full moon")
+	assert.Assert(t, full.Illumination > 0.99)
+
+	new := ComputeMoonPhase(time.Date(2021, time.January, 13, 5, 0, 0, 0, time.UTC))
+	assert.Equal(t, new.Name, "new moon")
+	assert.Assert(t, new.Illumination < 0.01)
+
+	assert.Equal(t, ComputeMoonPhase(time.Date(2021, time.January, 20, 21, 0, 0, 0, time.UTC)).Name, "first quarter")
+}
+
+func TestResolveDay(t *testing.T) {
+	friday := time.Date(2021, time.January, 8, 14, 30, 0, 0, time.UTC)
+
+	assert.Equal(t, ResolveDay(friday, "").Day(), 8)
+	assert.Equal(t, ResolveDay(friday, "today").Day(), 8)
+	assert.Equal(t, ResolveDay(friday, "tomorrow").Day(), 9)
+	assert.Equal(t, ResolveDay(friday, "friday").Day(), 8)
+	assert.Equal(t, ResolveDay(friday, "Monday").Day(), 11)
+}
+
+func TestSunRegex(t *testing.T) {
+	assert.Equal(t, sunRegex.FindStringSubmatch("sunset on friday")[4], "friday")
+	assert.Equal(t, sunRegex.FindStringSubmatch("sunrise tomorrow")[4], "tomorrow")
+	assert.Equal(t, sunRegex.FindStringSubmatch("sun")[1], "sun")
+	assert.Assert(t, !sunRegex.MatchString("sunday"))
+}
+
+func TestLocationFromParts(t *testing.T) {
+	location, err := LocationFromParts(setLocationRegex.FindStringSubmatch("set my location to 43.65, -79.38 in America/Toronto"), time.UTC)
+	assert.NilError(t, err)
+	assert.Equal(t, location.Latitude, 43.65)
+	assert.Equal(t, location.Longitude, -79.38)
+	assert.Equal(t, location.TimeZone.String(), "America/Toronto")
+
+	location, err = LocationFromParts(setLocationRegex.FindStringSubmatch("set location 51.5,-0.12"), time.UTC)
+	assert.NilError(t, err)
+	assert.Equal(t, location.TimeZone, time.UTC)
+
+	_, err = LocationFromParts(setLocationRegex.FindStringSubmatch("set location 95 10"), time.UTC)
+	assert.ErrorContains(t, err, "out of range")
+}
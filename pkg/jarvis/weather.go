@@ -3,26 +3,49 @@ package jarvis
 import (
 	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"github.com/ilikeorangutans/jarvis/pkg/httpcache"
 	"github.com/ilikeorangutans/jarvis/pkg/predicates"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
 )
 
-func AddWeatherHandler(ctx context.Context, b *bot.Bot) {
-	cityCode := "on-143"
+const (
+	CategoryWarnings          = "Warnings and Watches"
+	CategoryCurrentConditions = "Current Conditions"
+	CategoryForecasts         = "Weather Forecasts"
+)
+
+var (
+	ErrNoCurrentConditions = errors.New("feed has no current conditions")
+	ErrEmptyFeed           = errors.New("feed has no entries")
+
+	summaryFieldRegex = regexp.MustCompile(`<b>([^<]+):</b>\s*([^<]*)`)
+	temperatureRegex  = regexp.MustCompile(`(?i)\b(high|low|steady near|rising to|falling to)\s+(minus|plus)?\s*(zero|[0-9]+)`)
+	popRegex          = regexp.MustCompile(`(?i)\bPOP\s+([0-9]+)%`)
+	celsiusRegex      = regexp.MustCompile(`(-?[0-9]+(\.[0-9]+)?)`)
+)
+
+const (
+	noWarningsPrefix   = "no watches or warnings"
+	maxForecastsListed = 4
+)
+
+func AddWeatherHandler(ctx context.Context, b *bot.Bot, httpClient *httpcache.Client) {
+	cityCode := defaultCityCode
 	r := regexp.MustCompile(`(?i)\Aweather`)
 
 	b.On(
 		func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
 			client.SendText(evt.RoomID, "🌦️ Fetching the forecast for you...")
-			forecast, err := WeatherForecast(ctx, cityCode, FormatFeed)
+			forecast, err := WeatherForecast(ctx, httpClient, cityCode, FormatFeed)
 			if err != nil {
 				client.SendText(evt.RoomID, fmt.Sprintf("I'm unable to retrieve the forecast. 😔 (%s)", err.Error()))
 				return nil
@@ -39,52 +62,75 @@ func AddWeatherHandler(ctx context.Context, b *bot.Bot) {
 	)
 }
 
-func WeatherForecast(ctx context.Context, cityCode string, formatWeather func(Feed) (string, error)) (string, error) {
-	resp, err := http.Get(fmt.Sprintf("https://weather.gc.ca/rss/city/%s_e.xml", cityCode))
+func WeatherForecast(ctx context.Context, httpClient *httpcache.Client, cityCode string, formatWeather func(Feed) (string, error)) (string, error) {
+	feed, err := FetchFeed(ctx, httpClient, cityCode)
 	if err != nil {
-		return "", fmt.Errorf("HTTP GET failed: %w", err)
+		return "", err
 	}
-	defer resp.Body.Close()
 
-	var feed Feed
-	data, err := ioutil.ReadAll(resp.Body)
+	return formatWeather(feed)
+}
+
+// FetchFeed retrieves and parses the Environment Canada city feed for the given city code, e.g. "on-143".
+func FetchFeed(ctx context.Context, httpClient *httpcache.Client, cityCode string) (Feed, error) {
+	data, err := httpClient.Get(ctx, fmt.Sprintf("https://weather.gc.ca/rss/city/%s_e.xml", cityCode))
 	if err != nil {
-		return "", fmt.Errorf("unable to read response: %w", err)
+		return Feed{}, err
 	}
-	// TODO error handle
+
+	return ParseFeed(data)
+}
+
+// ParseFeed parses an Environment Canada Atom feed.
+func ParseFeed(data []byte) (Feed, error) {
+	var feed Feed
 	if err := xml.Unmarshal(data, &feed); err != nil {
-		return "", fmt.Errorf("unable to parse XML: %w", err)
+		return feed, fmt.Errorf("unable to parse XML: %w", err)
+	}
+	if len(feed.Entries) == 0 {
+		return feed, ErrEmptyFeed
 	}
 
-	return formatWeather(feed)
+	return feed, nil
 }
 
 func FormatFeed(feed Feed) (string, error) {
-	// TODO build html
+	if len(feed.Entries) == 0 {
+		return "", ErrEmptyFeed
+	}
+
 	var builder strings.Builder
 	builder.WriteString("<h2>Weather for ")
 	builder.WriteString(feed.Title)
 	builder.WriteString("</h2>")
-	if feed.HasWarnings() {
-		warnings := feed.Warnings()
+	for _, warning := range feed.Warnings() {
 		builder.WriteString("<p><strong>⚠️ ")
-		builder.WriteString(warnings.Title)
+		builder.WriteString(warning.Title)
 		builder.WriteString("</strong></p>")
 		builder.WriteString("<p>")
-		builder.WriteString(warnings.Summary)
+		builder.WriteString(warning.Summary)
 		builder.WriteString("</p>")
 	}
-	builder.WriteString("<p><strong>🌦️ ")
-	builder.WriteString(feed.CurrentCondition())
-	builder.WriteString("</p></strong>")
 
-	builder.WriteString("<ul>")
-	for i := 2; i < 6; i++ {
-		builder.WriteString("<li>")
-		builder.WriteString(feed.Entries[i].Title)
-		builder.WriteString("</li>")
+	if current, err := feed.CurrentConditions(); err == nil {
+		builder.WriteString("<p><strong>🌦️ ")
+		builder.WriteString(current.String())
+		builder.WriteString("</strong></p>")
+	}
+
+	forecasts := feed.Forecasts()
+	if len(forecasts) > maxForecastsListed {
+		forecasts = forecasts[:maxForecastsListed]
+	}
+	if len(forecasts) > 0 {
+		builder.WriteString("<ul>")
+		for _, forecast := range forecasts {
+			builder.WriteString("<li>")
+			builder.WriteString(forecast.Title)
+			builder.WriteString("</li>")
+		}
+		builder.WriteString("</ul>")
 	}
-	builder.WriteString("</ul>")
 
 	return builder.String(), nil
 }
@@ -94,24 +140,178 @@ type Feed struct {
 	Entries []Entry `xml:"entry"`
 }
 
+// EntriesInCategory returns all entries with the given category term, in feed order.
+func (f Feed) EntriesInCategory(term string) []Entry {
+	var entries []Entry
+	for _, e := range f.Entries {
+		if strings.EqualFold(strings.TrimSpace(e.Category.Term), term) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
 func (f Feed) HasWarnings() bool {
-	return !strings.HasPrefix(strings.ToLower(f.Entries[0].Title), "no watches or warnings")
+	return len(f.Warnings()) > 0
 }
 
-func (f Feed) Warnings() Entry {
-	return f.Entries[0]
+// Warnings returns all active watches and warnings. The "no watches or warnings in effect" placeholder entry is
+// not considered a warning.
+func (f Feed) Warnings() []Entry {
+	var warnings []Entry
+	for _, e := range f.EntriesInCategory(CategoryWarnings) {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(e.Title)), noWarningsPrefix) {
+			continue
+		}
+		warnings = append(warnings, e)
+	}
+	return warnings
+}
+
+func (f Feed) CurrentConditions() (CurrentConditions, error) {
+	entries := f.EntriesInCategory(CategoryCurrentConditions)
+	if len(entries) == 0 {
+		return CurrentConditions{}, ErrNoCurrentConditions
+	}
+
+	return ParseCurrentConditions(entries[0])
 }
 
-func (f Feed) CurrentCondition() string {
-	return f.Entries[1].Title
+// Forecasts returns the parsed forecast periods in feed order.
+func (f Feed) Forecasts() []Forecast {
+	var forecasts []Forecast
+	for _, e := range f.EntriesInCategory(CategoryForecasts) {
+		forecasts = append(forecasts, ParseForecast(e))
+	}
+	return forecasts
 }
 
 type Entry struct {
-	Title    string   `xml:"title"`
-	Category Category `xml:"category"`
-	Summary  string   `xml:"summary"`
+	ID       string    `xml:"id"`
+	Title    string    `xml:"title"`
+	Link     Link      `xml:"link"`
+	Updated  time.Time `xml:"updated"`
+	Category Category  `xml:"category"`
+	Summary  string    `xml:"summary"`
+}
+
+type Link struct {
+	Href string `xml:"href,attr"`
 }
 
 type Category struct {
 	Term string `xml:"term,attr"`
 }
+
+// CurrentConditions holds the observation from the "Current Conditions" entry.
+type CurrentConditions struct {
+	Condition   string
+	Temperature float64
+	ObservedAt  string
+	Humidity    string
+	Wind        string
+	WindChill   string
+	Fields      map[string]string
+}
+
+func (c CurrentConditions) String() string {
+	return fmt.Sprintf("%s, %.1f°C", c.Condition, c.Temperature)
+}
+
+func ParseCurrentConditions(entry Entry) (CurrentConditions, error) {
+	fields := make(map[string]string)
+	for _, match := range summaryFieldRegex.FindAllStringSubmatch(entry.Summary, -1) {
+		fields[strings.TrimSpace(match[1])] = strings.TrimSpace(strings.ReplaceAll(match[2], "&deg;", "°"))
+	}
+
+	conditions := CurrentConditions{
+		Condition:  fields["Condition"],
+		ObservedAt: fields["Observed at"],
+		Humidity:   fields["Humidity"],
+		Wind:       fields["Wind"],
+		WindChill:  fields["Wind Chill"],
+		Fields:     fields,
+	}
+
+	temperature, ok := fields["Temperature"]
+	if !ok {
+		// Some stations only report in the title, e.g. "Current Conditions: Light Snow, -2.7°C"
+		title := strings.TrimPrefix(entry.Title, CategoryCurrentConditions+":")
+		parts := strings.Split(title, ",")
+		temperature = parts[len(parts)-1]
+		if conditions.Condition == "" && len(parts) > 1 {
+			conditions.Condition = strings.TrimSpace(strings.Join(parts[:len(parts)-1], ","))
+		}
+	}
+
+	match := celsiusRegex.FindString(temperature)
+	if match == "" {
+		return conditions, fmt.Errorf("no temperature in current conditions %q", entry.Title)
+	}
+	t, err := strconv.ParseFloat(match, 64)
+	if err != nil {
+		return conditions, fmt.Errorf("could not parse temperature %q: %w", match, err)
+	}
+	conditions.Temperature = t
+
+	return conditions, nil
+}
+
+// Forecast is a single forecast period like "Friday night".
+type Forecast struct {
+	Title       string
+	Period      string
+	Condition   string
+	Summary     string
+	Temperature *Temperature
+	// POP is the probability of precipitation in percent, or zero if not given.
+	POP int
+}
+
+// Temperature is a forecast temperature like "High minus 1" or "Temperature steady near minus 4".
+type Temperature struct {
+	Kind    string
+	Celsius int
+}
+
+func (t Temperature) String() string {
+	return fmt.Sprintf("%s %d°C", t.Kind, t.Celsius)
+}
+
+func ParseForecast(entry Entry) Forecast {
+	forecast := Forecast{
+		Title:   entry.Title,
+		Summary: entry.Summary,
+	}
+
+	rest := entry.Title
+	if i := strings.Index(rest, ":"); i >= 0 {
+		forecast.Period = strings.TrimSpace(rest[:i])
+		rest = strings.TrimSpace(rest[i+1:])
+	}
+	if i := strings.Index(rest, "."); i >= 0 {
+		forecast.Condition = strings.TrimSpace(rest[:i])
+	} else {
+		forecast.Condition = rest
+	}
+
+	if match := temperatureRegex.FindStringSubmatch(entry.Title); match != nil {
+		celsius := 0
+		if match[3] != "zero" {
+			celsius, _ = strconv.Atoi(match[3])
+		}
+		if strings.EqualFold(match[2], "minus") {
+			celsius = -celsius
+		}
+		forecast.Temperature = &Temperature{
+			Kind:    strings.ToLower(match[1]),
+			Celsius: celsius,
+		}
+	}
+
+	if match := popRegex.FindStringSubmatch(entry.Title); match != nil {
+		forecast.POP, _ = strconv.Atoi(match[1])
+	}
+
+	return forecast
+}
@@ -0,0 +1,356 @@
+package jarvis
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"github.com/ilikeorangutans/jarvis/pkg/database"
+	"github.com/ilikeorangutans/jarvis/pkg/httpcache"
+	"github.com/ilikeorangutans/jarvis/pkg/predicates"
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	defaultCityCode            = "on-143"
+	defaultWeatherPollInterval = 15 * time.Minute
+)
+
+var (
+	subscribeWeatherAlertsRegex   = regexp.MustCompile(`(?i)\A\s*subscribe\s+weather\s+alerts(\s+(for\s+)?([a-z]{2}-[0-9]+))?\s*\z`)
+	unsubscribeWeatherAlertsRegex = regexp.MustCompile(`(?i)\A\s*unsubscribe\s+weather\s+alerts(\s+(for\s+)?([a-z]{2}-[0-9]+))?\s*\z`)
+)
+
+// WeatherAlert is a warning or watch we have already announced for a city.
+type WeatherAlert struct {
+	CityCode  string    `db:"city_code"`
+	Title     string    `db:"title"`
+	Summary   string    `db:"summary"`
+	Link      string    `db:"link"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+type WeatherAlertSubscription struct {
+	ID        int64
+	Room      id.RoomID
+	CityCode  string    `db:"city_code"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// WeatherAlertDiff describes how the active warnings of a city changed between two polls.
+type WeatherAlertDiff struct {
+	New     []Entry
+	Updated []Entry
+	Ended   []WeatherAlert
+}
+
+func (d WeatherAlertDiff) Empty() bool {
+	return len(d.New) == 0 && len(d.Updated) == 0 && len(d.Ended) == 0
+}
+
+// DiffWeatherAlerts compares the previously announced alerts with the warnings currently in the feed. Warnings are
+// identified by their title, as the entry IDs change with every issuance.
+func DiffWeatherAlerts(known []WeatherAlert, current []Entry) WeatherAlertDiff {
+	var diff WeatherAlertDiff
+	byTitle := make(map[string]WeatherAlert)
+	for _, alert := range known {
+		byTitle[alert.Title] = alert
+	}
+
+	seen := make(map[string]struct{})
+	for _, entry := range current {
+		seen[entry.Title] = struct{}{}
+		alert, ok := byTitle[entry.Title]
+		if !ok {
+			diff.New = append(diff.New, entry)
+		} else if !alert.UpdatedAt.Equal(entry.Updated) || alert.Summary != entry.Summary {
+			diff.Updated = append(diff.Updated, entry)
+		}
+	}
+
+	for _, alert := range known {
+		if _, ok := seen[alert.Title]; !ok {
+			diff.Ended = append(diff.Ended, alert)
+		}
+	}
+
+	return diff
+}
+
+func NewWeatherAlerts(ctx context.Context, b *bot.Bot, db *database.DB, httpClient *httpcache.Client) (*WeatherAlerts, error) {
+	return &WeatherAlerts{
+		b:        b,
+		db:       db,
+		interval: defaultWeatherPollInterval,
+		fetchFeed: func(ctx context.Context, cityCode string) (Feed, error) {
+			return FetchFeed(ctx, httpClient, cityCode)
+		},
+	}, nil
+}
+
+type WeatherAlerts struct {
+	b         *bot.Bot
+	db        *database.DB
+	interval  time.Duration
+	fetchFeed func(context.Context, string) (Feed, error)
+}
+
+func (w *WeatherAlerts) Start(ctx context.Context) error {
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		w.Poll(ctx)
+		for {
+			select {
+			case <-ctx.Done():
+				log.Info().Msg("stopping weather alert poller")
+				return
+			case <-ticker.C:
+				w.Poll(ctx)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Poll fetches the feed for every subscribed city and announces changes to the subscribed rooms.
+func (w *WeatherAlerts) Poll(ctx context.Context) {
+	subscriptions, err := w.Subscriptions(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("could not load weather alert subscriptions")
+		return
+	}
+
+	rooms := make(map[string][]id.RoomID)
+	for _, s := range subscriptions {
+		rooms[s.CityCode] = append(rooms[s.CityCode], s.Room)
+	}
+
+	for cityCode, roomIDs := range rooms {
+		if _, err := w.pollCity(ctx, cityCode, roomIDs); err != nil {
+			log.Error().Err(err).Str("city-code", cityCode).Msg("could not poll weather alerts")
+		}
+	}
+}
+
+// pollCity fetches the feed for the city, stores its warnings and announces the changes to the given rooms. Changes are
+// stored in one transaction and only announced once it committed, so a failing write neither repeats announcements on
+// every poll nor swallows them.
+func (w *WeatherAlerts) pollCity(ctx context.Context, cityCode string, roomIDs []id.RoomID) (Feed, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	feed, err := w.fetchFeed(ctx, cityCode)
+	if err != nil {
+		return Feed{}, fmt.Errorf("could not fetch feed: %w", err)
+	}
+
+	var known []WeatherAlert
+	sql, args := sq.Select("*").From("weather_alerts").Where(sq.Eq{"city_code": cityCode}).MustSql()
+	if err := w.db.SelectContext(ctx, &known, sql, args...); err != nil {
+		return Feed{}, fmt.Errorf("could not load known alerts: %w", err)
+	}
+
+	diff := DiffWeatherAlerts(known, feed.Warnings())
+	if diff.Empty() {
+		return feed, nil
+	}
+	log.Info().Str("city-code", cityCode).Int("new", len(diff.New)).Int("updated", len(diff.Updated)).Int("ended", len(diff.Ended)).Msg("weather alerts changed")
+
+	if err := w.store(ctx, cityCode, diff); err != nil {
+		return Feed{}, err
+	}
+
+	message := FormatWeatherAlertDiff(feed.Title, diff)
+	for _, roomID := range roomIDs {
+		w.b.Client().SendHTML(roomID, message)
+	}
+
+	return feed, nil
+}
+
+// store saves new and updated alerts and removes ended ones, all or nothing.
+func (w *WeatherAlerts) store(ctx context.Context, cityCode string, diff WeatherAlertDiff) error {
+	tx, err := w.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, entry := range append(diff.New, diff.Updated...) {
+		_, err := sq.
+			Insert("weather_alerts").
+			Columns("city_code", "title", "summary", "link", "updated_at").
+			Values(cityCode, entry.Title, entry.Summary, entry.Link.Href, entry.Updated).
+			Suffix("on conflict (city_code, title) do update set summary = ?, link = ?, updated_at = ?", entry.Summary, entry.Link.Href, entry.Updated).
+			RunWith(tx).
+			ExecContext(ctx)
+		if err != nil {
+			return fmt.Errorf("could not store alert: %w", err)
+		}
+	}
+	for _, alert := range diff.Ended {
+		_, err := sq.
+			Delete("weather_alerts").
+			Where(sq.Eq{"city_code": cityCode, "title": alert.Title}).
+			RunWith(tx).
+			ExecContext(ctx)
+		if err != nil {
+			return fmt.Errorf("could not remove alert: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit alerts: %w", err)
+	}
+	return nil
+}
+
+// Announce sends the warnings currently active for the city to a room that just subscribed. Alerts are tracked per
+// city, so without this a room would only hear about warnings issued after it subscribed. Changes since the last poll
+// are announced to the other subscribed rooms on the way.
+func (w *WeatherAlerts) Announce(ctx context.Context, roomID id.RoomID, cityCode string) error {
+	subscriptions, err := w.Subscriptions(ctx)
+	if err != nil {
+		return fmt.Errorf("could not load subscriptions: %w", err)
+	}
+	var others []id.RoomID
+	for _, s := range subscriptions {
+		if s.CityCode == cityCode && s.Room != roomID {
+			others = append(others, s.Room)
+		}
+	}
+
+	feed, err := w.pollCity(ctx, cityCode, others)
+	if err != nil {
+		return err
+	}
+	if warnings := feed.Warnings(); len(warnings) > 0 {
+		w.b.Client().SendHTML(roomID, FormatWeatherAlertDiff(feed.Title, WeatherAlertDiff{New: warnings}))
+	}
+	return nil
+}
+
+func FormatWeatherAlertDiff(title string, diff WeatherAlertDiff) string {
+	var builder strings.Builder
+	builder.WriteString("<p><strong>")
+	builder.WriteString(title)
+	builder.WriteString("</strong></p>")
+	for _, entry := range diff.New {
+		builder.WriteString("<p>⚠️ <strong>New: ")
+		builder.WriteString(entry.Title)
+		builder.WriteString("</strong><br/>")
+		builder.WriteString(entry.Summary)
+		builder.WriteString("</p>")
+	}
+	for _, entry := range diff.Updated {
+		builder.WriteString("<p>⚠️ <strong>Updated: ")
+		builder.WriteString(entry.Title)
+		builder.WriteString("</strong><br/>")
+		builder.WriteString(entry.Summary)
+		builder.WriteString("</p>")
+	}
+	for _, alert := range diff.Ended {
+		builder.WriteString("<p>✅ <strong>Ended: ")
+		builder.WriteString(alert.Title)
+		builder.WriteString("</strong></p>")
+	}
+
+	return builder.String()
+}
+
+func (w *WeatherAlerts) Subscriptions(ctx context.Context) ([]*WeatherAlertSubscription, error) {
+	var subscriptions []*WeatherAlertSubscription
+	if err := w.db.SelectContext(ctx, &subscriptions, "select * from weather_alert_subscriptions"); err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+func (w *WeatherAlerts) Subscribe(ctx context.Context, roomID id.RoomID, cityCode string) error {
+	_, err := sq.
+		Insert("weather_alert_subscriptions").
+		Columns("room", "city_code", "created_at").
+		Values(roomID, cityCode, time.Now()).
+		Suffix("on conflict (room, city_code) do nothing").
+		RunWith(w.db).
+		ExecContext(ctx)
+	if err != nil {
+		return fmt.Errorf("could not insert subscription: %w", err)
+	}
+	return nil
+}
+
+// Unsubscribe removes the subscription and reports whether there was one.
+func (w *WeatherAlerts) Unsubscribe(ctx context.Context, roomID id.RoomID, cityCode string) (bool, error) {
+	res, err := sq.
+		Delete("weather_alert_subscriptions").
+		Where(sq.Eq{"room": roomID, "city_code": cityCode}).
+		RunWith(w.db).
+		ExecContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("could not delete subscription: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func cityCodeFromParts(parts []string) string {
+	if len(parts) < 4 || parts[3] == "" {
+		return defaultCityCode
+	}
+	return strings.ToLower(parts[3])
+}
+
+func AddWeatherAlertHandlers(ctx context.Context, b *bot.Bot, alerts *WeatherAlerts) error {
+	b.On(
+		func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			cityCode := cityCodeFromParts(subscribeWeatherAlertsRegex.FindStringSubmatch(evt.Content.AsMessage().Body))
+			if err := alerts.Subscribe(ctx, evt.RoomID, cityCode); err != nil {
+				client.SendText(evt.RoomID, fmt.Sprintf("I'm unable to subscribe this room to weather alerts. 😔 (%s)", err))
+				return err
+			}
+			client.SendHTML(evt.RoomID, fmt.Sprintf("⚠️ Very good, I'll let this room know about weather alerts for <code>%s</code>.", cityCode))
+			if err := alerts.Announce(ctx, evt.RoomID, cityCode); err != nil {
+				log.Error().Err(err).Str("city-code", cityCode).Msg("could not announce current weather alerts")
+			}
+			return nil
+		},
+		predicates.All(
+			predicates.MessageMatching(subscribeWeatherAlertsRegex),
+		),
+	)
+	b.On(
+		func(ctx context.Context, client bot.MatrixClient, source mautrix.EventSource, evt *event.Event) error {
+			cityCode := cityCodeFromParts(unsubscribeWeatherAlertsRegex.FindStringSubmatch(evt.Content.AsMessage().Body))
+			removed, err := alerts.Unsubscribe(ctx, evt.RoomID, cityCode)
+			if err != nil {
+				client.SendText(evt.RoomID, fmt.Sprintf("Terribly sorry, but I couldn't unsubscribe this room: %s", err))
+				return err
+			}
+			if !removed {
+				client.SendHTML(evt.RoomID, fmt.Sprintf("This room isn't subscribed to weather alerts for <code>%s</code>.", cityCode))
+				return nil
+			}
+			client.SendHTML(evt.RoomID, fmt.Sprintf("✅ I'll no longer post weather alerts for <code>%s</code> here.", cityCode))
+			return nil
+		},
+		predicates.All(
+			predicates.MessageMatching(unsubscribeWeatherAlertsRegex),
+		),
+	)
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package jarvis
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"github.com/ilikeorangutans/jarvis/pkg/bot/bottest"
+	"github.com/ilikeorangutans/jarvis/pkg/database"
+	"github.com/ilikeorangutans/jarvis/pkg/database/databasetest"
+	"gotest.tools/assert"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestDiffWeatherAlerts(t *testing.T) {
+	feed := loadFeedFixture(t)
+	warnings := feed.Warnings()
+
+	diff := DiffWeatherAlerts(nil, warnings)
+	assert.Equal(t, len(diff.New), 1)
+	assert.Equal(t, len(diff.Updated), 0)
+	assert.Equal(t, len(diff.Ended), 0)
+
+	known := []WeatherAlert{
+		{CityCode: "on-143", Title: warnings[0].Title, Summary: warnings[0].Summary, UpdatedAt: warnings[0].Updated},
+	}
+	assert.Assert(t, DiffWeatherAlerts(known, warnings).Empty())
+
+	known[0].UpdatedAt = warnings[0].Updated.Add(-time.Hour)
+	diff = DiffWeatherAlerts(known, warnings)
+	assert.Equal(t, len(diff.New), 0)
+	assert.Equal(t, len(diff.Updated), 1)
+
+	diff = DiffWeatherAlerts(known, nil)
+	assert.Equal(t, len(diff.Ended), 1)
+	assert.Equal(t, diff.Ended[0].Title, "WEATHER ADVISORY , Toronto")
+}
+
+func TestWeatherAlertCommands(t *testing.T) {
+	assert.Equal(t, cityCodeFromParts(subscribeWeatherAlertsRegex.FindStringSubmatch("subscribe weather alerts")), "on-143")
+	assert.Equal(t, cityCodeFromParts(subscribeWeatherAlertsRegex.FindStringSubmatch("subscribe weather alerts for BC-74")), "bc-74")
+	assert.Equal(t, cityCodeFromParts(unsubscribeWeatherAlertsRegex.FindStringSubmatch("unsubscribe weather alerts qc-147")), "qc-147")
+	assert.Assert(t, !subscribeWeatherAlertsRegex.MatchString("unsubscribe weather alerts"))
+}
+
+// failAlert makes storing the alert with the title fail, until the returned function is called.
+func failAlert(db *database.DB, title string) func() {
+	if db.Dialect == database.Postgres {
+		db.MustExec(`create function fail_alert() returns trigger language plpgsql as $$ begin raise exception 'disk full'; end $$`)
+		db.MustExec(`create trigger fail_alert before insert on weather_alerts for each row when (new.title = '` + title + `') execute procedure fail_alert()`)
+		return func() {
+			db.MustExec("drop trigger fail_alert on weather_alerts")
+			db.MustExec("drop function fail_alert")
+		}
+	}
+	db.MustExec(`create trigger fail_alert before insert on weather_alerts when new.title = '` + title + `' begin select raise(abort, 'disk full'); end`)
+	return func() { db.MustExec("drop trigger fail_alert") }
+}
+
+func TestWeatherAlertPolling(t *testing.T) {
+	databasetest.Migrated(t, withModules("alerts"), func(t *testing.T, db *database.DB) {
+		h := bottest.New(t, bot.BotConfiguration{})
+		feed := loadFeedFixture(t)
+		snowfall := feed.Warnings()[0]
+		snowfall.Title = "SNOWFALL WARNING , Toronto"
+		feed.Entries = append(feed.Entries, snowfall)
+		alerts := &WeatherAlerts{
+			b:  h.Bot,
+			db: db,
+			fetchFeed: func(ctx context.Context, cityCode string) (Feed, error) {
+				return feed, nil
+			},
+		}
+		assert.NilError(t, AddWeatherAlertHandlers(context.Background(), h.Bot, alerts))
+		other := id.RoomID("!other:example.com")
+		assert.NilError(t, alerts.Subscribe(context.Background(), other, defaultCityCode))
+
+		// alerts are stored all or nothing before they're announced, so a failing write neither repeats nor loses
+		// announcements
+		fixed := failAlert(db, snowfall.Title)
+		alerts.Poll(context.Background())
+		assert.Equal(t, len(h.Bodies(other)), 0)
+		var stored int
+		assert.NilError(t, db.Get(&stored, "select count(*) from weather_alerts"))
+		assert.Equal(t, stored, 0)
+
+		fixed()
+		alerts.Poll(context.Background())
+		bodies := h.Bodies(other)
+		assert.Equal(t, len(bodies), 1)
+		assert.Assert(t, strings.Contains(bodies[0], "New: WEATHER ADVISORY , Toronto"), bodies[0])
+		assert.Assert(t, strings.Contains(bodies[0], "New: SNOWFALL WARNING , Toronto"), bodies[0])
+		alerts.Poll(context.Background())
+		assert.Equal(t, len(h.Bodies(other)), 1)
+
+		// a room subscribing while a warning is active hears about it right away, and only once
+		h.Client.Reset()
+		h.Send(bottest.Room, "@alice:example.com", "subscribe weather alerts")
+		bodies = h.Bodies(bottest.Room)
+		assert.Equal(t, len(bodies), 2)
+		assert.Assert(t, strings.Contains(bodies[1], "New: SNOWFALL WARNING , Toronto"), bodies[1])
+		assert.Equal(t, len(h.Bodies(other)), 0)
+		alerts.Poll(context.Background())
+		assert.Equal(t, len(h.Bodies(bottest.Room)), 2)
+	})
+}
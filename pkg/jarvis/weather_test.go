@@ -0,0 +1,127 @@
+package jarvis
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"github.com/ilikeorangutans/jarvis/pkg/bot/bottest"
+	"github.com/ilikeorangutans/jarvis/pkg/httpcache"
+	"gotest.tools/assert"
+)
+
+func loadFeedFixture(t *testing.T) Feed {
+	data, err := ioutil.ReadFile("testdata/weather.xml")
+	assert.NilError(t, err)
+	feed, err := ParseFeed(data)
+	assert.NilError(t, err)
+	return feed
+}
+
+func TestFeedClassification(t *testing.T) {
+	feed := loadFeedFixture(t)
+
+	assert.Equal(t, feed.Title, "Toronto - Weather - Environment Canada")
+	assert.Assert(t, feed.HasWarnings())
+	assert.Equal(t, len(feed.Warnings()), 1)
+	assert.Equal(t, feed.Warnings()[0].Title, "WEATHER ADVISORY , Toronto")
+	assert.Equal(t, len(feed.Forecasts()), 12)
+}
+
+func TestCurrentConditions(t *testing.T) {
+	feed := loadFeedFixture(t)
+
+	current, err := feed.CurrentConditions()
+	assert.NilError(t, err)
+	assert.Equal(t, current.Condition, "Light Snow")
+	assert.Equal(t, current.Temperature, -2.7)
+	assert.Equal(t, current.Humidity, "94 %")
+	assert.Equal(t, current.Wind, "NNW 21 km/h")
+	assert.Equal(t, current.String(), "Light Snow, -2.7°C")
+}
+
+func TestParseForecast(t *testing.T) {
+	data := []struct {
+		title       string
+		period      string
+		condition   string
+		temperature *Temperature
+		pop         int
+	}{
+		{"Thursday night: Snow. Low minus 2.", "Thursday night", "Snow", &Temperature{"low", -2}, 0},
+		{"Friday: Chance of flurries. High minus 1. POP 60%", "Friday", "Chance of flurries", &Temperature{"high", -1}, 60},
+		{"Friday night: Chance of flurries. Temperature steady near minus 4. POP 60%", "Friday night", "Chance of flurries", &Temperature{"steady near", -4}, 60},
+		{"Sunday: Chance of flurries. High plus 1. POP 40%", "Sunday", "Chance of flurries", &Temperature{"high", 1}, 40},
+		{"Wednesday: Chance of flurries. High zero. POP 60%", "Wednesday", "Chance of flurries", &Temperature{"high", 0}, 60},
+		{"Monday: Sunny. High 24.", "Monday", "Sunny", &Temperature{"high", 24}, 0},
+		{"Tuesday: Sunny", "Tuesday", "Sunny", nil, 0},
+	}
+
+	for _, d := range data {
+		forecast := ParseForecast(Entry{Title: d.title})
+		assert.Equal(t, forecast.Period, d.period, d.title)
+		assert.Equal(t, forecast.Condition, d.condition, d.title)
+		assert.DeepEqual(t, forecast.Temperature, d.temperature)
+		assert.Equal(t, forecast.POP, d.pop, d.title)
+	}
+}
+
+func TestFormatFeed(t *testing.T) {
+	feed := loadFeedFixture(t)
+
+	html, err := FormatFeed(feed)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(html, "⚠️ WEATHER ADVISORY , Toronto"))
+	assert.Assert(t, strings.Contains(html, "Light Snow, -2.7°C"))
+	assert.Equal(t, strings.Count(html, "<li>"), maxForecastsListed)
+}
+
+func TestFormatFeedShortFeed(t *testing.T) {
+	feed := Feed{
+		Title: "Nowhere",
+		Entries: []Entry{
+			{Title: "No watches or warnings in effect, Nowhere", Category: Category{Term: CategoryWarnings}},
+			{Title: "Friday: Sunny. High 3.", Category: Category{Term: CategoryForecasts}},
+		},
+	}
+
+	assert.Assert(t, !feed.HasWarnings())
+	_, err := feed.CurrentConditions()
+	assert.Equal(t, err, ErrNoCurrentConditions)
+
+	html, err := FormatFeed(feed)
+	assert.NilError(t, err)
+	assert.Equal(t, strings.Count(html, "<li>"), 1)
+
+	_, err = FormatFeed(Feed{})
+	assert.Equal(t, err, ErrEmptyFeed)
+
+	_, err = ParseFeed([]byte("<feed></feed>"))
+	assert.Equal(t, err, ErrEmptyFeed)
+}
+
+func TestWeatherHandler(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/weather.xml")
+	assert.NilError(t, err)
+	store := httpcache.NewMemoryStore()
+	assert.NilError(t, store.Set(context.Background(), &httpcache.Entry{
+		URL:        "https://weather.gc.ca/rss/city/on-143_e.xml",
+		StatusCode: 200,
+		Body:       data,
+		FetchedAt:  time.Now(),
+		ExpiresAt:  time.Now().Add(time.Hour),
+	}))
+
+	h := bottest.New(t, bot.BotConfiguration{})
+	AddWeatherHandler(context.Background(), h.Bot, httpcache.NewClient(store, httpcache.DefaultTTL))
+	h.Send(bottest.Room, "@alice:example.com", "weather")
+
+	bodies := h.Bodies(bottest.Room)
+	assert.Equal(t, len(bodies), 2)
+	assert.Equal(t, bodies[0], "🌦️ Fetching the forecast for you...")
+	assert.Assert(t, strings.HasPrefix(bodies[1], "<h2>Weather for Toronto - Weather - Environment Canada</h2>"), bodies[1])
+	assert.Assert(t, strings.Contains(bodies[1], "Light Snow, -2.7°C"), bodies[1])
+}
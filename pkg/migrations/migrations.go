@@ -0,0 +1,172 @@
+// Package migrations applies database migrations embedded into the binary. Migrations are grouped into sets, e.g.
+// the core tables and one set per module, and each set tracks its version in its own table. Postgres migrations
+// mirror the SQLite ones in a postgres directory next to them.
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+
+	"github.com/golang-migrate/migrate/v4"
+	migratedb "github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/database/sqlite3"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/httpfs"
+	"github.com/ilikeorangutans/jarvis/db"
+	"github.com/ilikeorangutans/jarvis/pkg/database"
+)
+
+// CoreName is the name of the set of core migrations.
+const CoreName = "core"
+
+// defaultTable is where golang-migrate tracks versions by default.
+const defaultTable = "schema_migrations"
+
+// Set is a group of migrations with its own version tracking.
+type Set struct {
+	Name string
+	// Table records the applied version.
+	Table   string
+	FS      fs.FS
+	Dialect database.Dialect
+}
+
+// forDialect returns the migrations for the dialect from a directory of SQLite migrations.
+func forDialect(fsys fs.FS, dialect database.Dialect) fs.FS {
+	if dialect != database.Postgres {
+		return fsys
+	}
+	sub, err := fs.Sub(fsys, "postgres")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// Core returns the migrations of the bot's own tables. They keep the default version table, so databases created
+// before migrations were split up carry on where they left off.
+func Core(dialect database.Dialect) Set {
+	sub, err := fs.Sub(db.Migrations, "migrations")
+	if err != nil {
+		panic(err)
+	}
+	return Set{Name: CoreName, Table: defaultTable, FS: forDialect(sub, dialect), Dialect: dialect}
+}
+
+// ForModule returns the migrations of a module.
+func ForModule(name string, fsys fs.FS, dialect database.Dialect) Set {
+	return Set{Name: name, Table: fmt.Sprintf("%s_%s", defaultTable, name), FS: forDialect(fsys, dialect), Dialect: dialect}
+}
+
+// Status is how far the migrations of a set were applied.
+type Status struct {
+	Name string
+	// Version is the applied version, 0 if none.
+	Version uint
+	// Latest is the version of the last migration in the set.
+	Latest uint
+	// Pending is the number of migrations not applied yet.
+	Pending int
+	// Dirty is true if a migration failed halfway and needs fixing by hand.
+	Dirty bool
+}
+
+func (s Set) sources() (source.Driver, error) {
+	src, err := httpfs.New(http.FS(s.FS), "/")
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s migrations: %w", s.Name, err)
+	}
+	return src, nil
+}
+
+func (s Set) migrator(db *database.DB) (*migrate.Migrate, error) {
+	src, err := s.sources()
+	if err != nil {
+		return nil, err
+	}
+	var driver migratedb.Driver
+	switch db.Dialect {
+	case database.Postgres:
+		driver, err = postgres.WithInstance(db.DB.DB, &postgres.Config{MigrationsTable: s.Table})
+	default:
+		driver, err = sqlite3.WithInstance(db.DB.DB, &sqlite3.Config{MigrationsTable: s.Table})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not create migration driver: %w", err)
+	}
+	m, err := migrate.NewWithInstance("httpfs", src, string(db.Dialect), driver)
+	if err != nil {
+		return nil, fmt.Errorf("could not create migrator for %s: %w", s.Name, err)
+	}
+	return m, nil
+}
+
+// Up applies all pending migrations.
+func (s Set) Up(db *database.DB) error {
+	m, err := s.migrator(db)
+	if err != nil {
+		return err
+	}
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("could not migrate %s: %w", s.Name, err)
+	}
+	return nil
+}
+
+// Down reverts the last applied migration.
+func (s Set) Down(db *database.DB) error {
+	m, err := s.migrator(db)
+	if err != nil {
+		return err
+	}
+	if err := m.Steps(-1); err != nil {
+		return fmt.Errorf("could not revert %s: %w", s.Name, err)
+	}
+	return nil
+}
+
+// Status returns the applied and available versions.
+func (s Set) Status(db *database.DB) (Status, error) {
+	status := Status{Name: s.Name}
+	m, err := s.migrator(db)
+	if err != nil {
+		return status, err
+	}
+	version, dirty, err := m.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return status, fmt.Errorf("could not read %s version: %w", s.Name, err)
+	}
+	status.Version = version
+	status.Dirty = dirty
+
+	src, err := s.sources()
+	if err != nil {
+		return status, err
+	}
+	v, err := src.First()
+	for err == nil {
+		status.Latest = v
+		if v > status.Version {
+			status.Pending++
+		}
+		v, err = src.Next(v)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return status, fmt.Errorf("could not list %s migrations: %w", s.Name, err)
+	}
+	return status, nil
+}
+
+// Up applies all pending migrations of the sets in order.
+func Up(db *database.DB, sets ...Set) error {
+	for _, s := range sets {
+		if err := s.Up(db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package migrations_test
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/ilikeorangutans/jarvis/pkg/bot"
+	"github.com/ilikeorangutans/jarvis/pkg/database"
+	"github.com/ilikeorangutans/jarvis/pkg/database/databasetest"
+	"github.com/ilikeorangutans/jarvis/pkg/jarvis"
+	"github.com/ilikeorangutans/jarvis/pkg/migrations"
+	"gotest.tools/assert"
+)
+
+func sets(dialect database.Dialect) []migrations.Set {
+	modules := bot.NewModuleRegistry(jarvis.Modules(nil, nil, nil, nil, nil)...)
+	return append([]migrations.Set{migrations.Core(dialect)}, modules.Migrations(dialect)...)
+}
+
+func findSet(t *testing.T, dialect database.Dialect, name string) migrations.Set {
+	for _, set := range sets(dialect) {
+		if set.Name == name {
+			return set
+		}
+	}
+	t.Fatalf("no migrations named %s", name)
+	return migrations.Set{}
+}
+
+func tableExists(t *testing.T, db *database.DB, table string) bool {
+	query := "select count(*) from sqlite_master where type = 'table' and name = ?"
+	if db.Dialect == database.Postgres {
+		query = "select count(*) from information_schema.tables where table_schema = current_schema() and table_name = ?"
+	}
+	var count int
+	assert.NilError(t, db.Get(&count, query, table))
+	return count > 0
+}
+
+func TestUpCreatesAllTables(t *testing.T) {
+	databasetest.Each(t, func(t *testing.T, db *database.DB) {
+		assert.NilError(t, migrations.Up(db, sets(db.Dialect)...))
+		// running again is a no-op
+		assert.NilError(t, migrations.Up(db, sets(db.Dialect)...))
+
+		for _, table := range []string{"bot_batch", "settings", "reminders", "polls", "poll_votes", "saved_rolls", "user_locations", "agenda_subscriptions", "weather_alerts"} {
+			assert.Assert(t, tableExists(t, db, table), table)
+		}
+		db.MustExec(`insert into reminders (message, "user", sun_event) values ('hello', '@alice:example.com', 'sunrise')`)
+
+		for _, set := range sets(db.Dialect) {
+			status, err := set.Status(db)
+			assert.NilError(t, err)
+			assert.Equal(t, status.Pending, 0, set.Name)
+			assert.Equal(t, status.Version, status.Latest, set.Name)
+			assert.Assert(t, !status.Dirty)
+		}
+	})
+}
+
+func TestModulesAdoptExistingTables(t *testing.T) {
+	db := databasetest.SQLite(t)
+	// SQLite databases from before the split have the tables, but no module versions
+	db.MustExec("create table polls (id integer, primary key(id))")
+	db.MustExec("insert into polls (id) values (1)")
+
+	assert.NilError(t, migrations.Up(db, sets(db.Dialect)...))
+	var count int
+	assert.NilError(t, db.Get(&count, "select count(*) from polls"))
+	assert.Equal(t, count, 1)
+}
+
+func TestDown(t *testing.T) {
+	databasetest.Each(t, func(t *testing.T, db *database.DB) {
+		assert.NilError(t, migrations.Up(db, sets(db.Dialect)...))
+
+		polls := findSet(t, db.Dialect, "polls")
+		assert.NilError(t, polls.Down(db))
+		assert.Assert(t, !tableExists(t, db, "polls"))
+		assert.Assert(t, tableExists(t, db, "reminders"))
+
+		status, err := polls.Status(db)
+		assert.NilError(t, err)
+		assert.Equal(t, status.Version, uint(0))
+		assert.Equal(t, status.Pending, 1)
+
+		assert.NilError(t, polls.Up(db))
+		assert.Assert(t, tableExists(t, db, "polls"))
+	})
+}
+
+func TestPostgresMirrorsSQLite(t *testing.T) {
+	for _, set := range sets(database.SQLite) {
+		postgres := findSet(t, database.Postgres, set.Name)
+		sqliteFiles, err := fs.Glob(set.FS, "*.sql")
+		assert.NilError(t, err)
+		postgresFiles, err := fs.Glob(postgres.FS, "*.sql")
+		assert.NilError(t, err)
+
+		mirrored := make(map[string]bool)
+		for _, name := range postgresFiles {
+			mirrored[name] = true
+		}
+		for _, name := range sqliteFiles {
+			if mirrored[name] {
+				delete(mirrored, name)
+				continue
+			}
+			// only the core versions that moved tables into modules have no Postgres version
+			content, err := fs.ReadFile(set.FS, name)
+			assert.NilError(t, err)
+			assert.Assert(t, strings.HasPrefix(string(content), "-- moved to the"), "%s/%s has no Postgres version", set.Name, name)
+		}
+		assert.Equal(t, len(mirrored), 0, "%s: Postgres migrations without SQLite version: %v", set.Name, mirrored)
+	}
+}
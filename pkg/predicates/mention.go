@@ -0,0 +1,93 @@
+package predicates
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Addressee detects messages addressed to a user, e.g. the bot. A message is addressed to the user if it starts
+// with the command prefix, lists the user in m.mentions, contains a pill for the user, or names the user by MXID,
+// display name or localpart as a whole word.
+type Addressee struct {
+	UserID      id.UserID
+	DisplayName string
+	// Prefix marks commands without naming the user, e.g. "!".
+	Prefix string
+
+	anywhere *regexp.Regexp
+	leading  *regexp.Regexp
+	trailing *regexp.Regexp
+	pill     *regexp.Regexp
+}
+
+func NewAddressee(userID id.UserID, displayName, prefix string) *Addressee {
+	names := []string{userID.String()}
+	if localpart, _, err := userID.Parse(); err == nil && localpart != "" {
+		names = append(names, localpart)
+	}
+	if displayName = strings.TrimSpace(displayName); displayName != "" {
+		names = append(names, displayName)
+	}
+	// longest first, so the MXID wins over the localpart it contains
+	sort.SliceStable(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+	for i, name := range names {
+		names[i] = regexp.QuoteMeta(name)
+	}
+	alternatives := strings.Join(names, "|")
+
+	// A name ends at the end of the text or a character that can't continue it. A colon only ends a name if it is
+	// followed by whitespace, so "@jarvis:other.server" doesn't count as "jarvis".
+	end := `(?:\z|:\s|:\z|[^\p{L}\p{N}_:])`
+	escaped := strings.NewReplacer("@", "%40", ":", "%3A").Replace(userID.String())
+	return &Addressee{
+		UserID:      userID,
+		DisplayName: displayName,
+		Prefix:      prefix,
+		anywhere:    regexp.MustCompile(fmt.Sprintf(`(?i)(?:\A|[^\p{L}\p{N}_@])@?(?:%s)%s`, alternatives, end)),
+		leading:     regexp.MustCompile(fmt.Sprintf(`(?i)\A\s*@?(?:%s)(?:[:,]\s+|[:,]?\z|\s+)`, alternatives)),
+		trailing:    regexp.MustCompile(fmt.Sprintf(`(?i)[\s,]+@?(?:%s)\s*([?!.]*)\s*\z`, alternatives)),
+		pill:        regexp.MustCompile(fmt.Sprintf(`(?i)\A\s*<a\s+href="https://matrix\.to/#/(?:%s|%s)"[^>]*>([^<]*)</a>`, regexp.QuoteMeta(userID.String()), regexp.QuoteMeta(escaped))),
+	}
+}
+
+// Match returns whether the message is addressed to the user, and the body with the prefix or a leading or
+// trailing mention removed.
+func (a *Addressee) Match(evt *event.Event) (string, bool) {
+	if evt.Type != event.EventMessage {
+		return "", false
+	}
+
+	msg := evt.Content.AsMessage()
+	body := strings.TrimSpace(msg.Body)
+	if a.Prefix != "" && strings.HasPrefix(body, a.Prefix) {
+		return strings.TrimSpace(strings.TrimPrefix(body, a.Prefix)), true
+	}
+
+	stripped := body
+	// pills show whatever name the client chose, e.g. a room specific nickname
+	if parts := a.pill.FindStringSubmatch(msg.FormattedBody); parts != nil && parts[1] != "" && strings.HasPrefix(body, parts[1]) {
+		stripped = strings.TrimLeft(strings.TrimPrefix(body, parts[1]), ":, ")
+	}
+	stripped = a.leading.ReplaceAllString(stripped, "")
+	stripped = a.trailing.ReplaceAllString(stripped, "$1")
+	stripped = strings.TrimSpace(stripped)
+
+	if stripped != body || a.anywhere.MatchString(body) || MentionsBot(a.UserID)(mautrix.EventSourceTimeline, evt) {
+		return stripped, true
+	}
+
+	return body, false
+}
+
+func (a *Addressee) Predicate() EventPredicate {
+	return func(source mautrix.EventSource, evt *event.Event) bool {
+		_, ok := a.Match(evt)
+		return ok
+	}
+}
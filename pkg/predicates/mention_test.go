@@ -0,0 +1,72 @@
+package predicates
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestAddresseeMatch(t *testing.T) {
+	a := NewAddressee("@jarvis:example.com", "Jarvis Bot", "!")
+
+	data := []struct {
+		body      string
+		addressed bool
+		stripped  string
+	}{
+		{"jarvis status", true, "status"},
+		{"Jarvis: status", true, "status"},
+		{"jarvis, weather", true, "weather"},
+		{"@jarvis:example.com status", true, "status"},
+		{"@jarvis status", true, "status"},
+		{"Jarvis Bot: roll 2d6", true, "roll 2d6"},
+		{"!status", true, "status"},
+		{"what's the weather, jarvis?", true, "what's the weather?"},
+		{"I asked jarvis about it", true, "I asked jarvis about it"},
+		{"jarvis", true, ""},
+		{"jarvisfan status", false, "jarvisfan status"},
+		{"ask @jarvis:other.server", false, "ask @jarvis:other.server"},
+		{"weather", false, "weather"},
+	}
+
+	for _, d := range data {
+		stripped, addressed := a.Match(textEvent(d.body))
+		assert.Equal(t, addressed, d.addressed, d.body)
+		assert.Equal(t, stripped, d.stripped, d.body)
+	}
+}
+
+func TestAddresseeMatchMentions(t *testing.T) {
+	a := NewAddressee("@jarvis:example.com", "", "")
+
+	pill := &event.Event{
+		Type: event.EventMessage,
+		Content: event.Content{Parsed: &event.MessageEventContent{
+			MsgType:       event.MsgText,
+			Body:          "J: status",
+			Format:        event.FormatHTML,
+			FormattedBody: `<a href="https://matrix.to/#/@jarvis:example.com">J</a>: status`,
+		}},
+	}
+	stripped, addressed := a.Match(pill)
+	assert.Assert(t, addressed)
+	assert.Equal(t, stripped, "status")
+
+	mentions := textEvent("status")
+	mentions.Content.Raw = map[string]interface{}{
+		"m.mentions": map[string]interface{}{"user_ids": []interface{}{"@jarvis:example.com"}},
+	}
+	stripped, addressed = a.Match(mentions)
+	assert.Assert(t, addressed)
+	assert.Equal(t, stripped, "status")
+
+	_, addressed = a.Match(reactionEvent("$a", "👍"))
+	assert.Assert(t, !addressed)
+}
+
+func TestAtUser(t *testing.T) {
+	p := AtUser("@jarvis:example.com")
+	assert.Assert(t, p(0, textEvent("jarvis: status")))
+	assert.Assert(t, !p(0, textEvent("jarvisfan: status")))
+}
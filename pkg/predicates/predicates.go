@@ -1,11 +1,11 @@
 package predicates
 
 import (
-	"fmt"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/rs/zerolog/log"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
@@ -25,15 +25,86 @@ func All(predicates ...EventPredicate) EventPredicate {
 	}
 }
 
+func Any(predicates ...EventPredicate) EventPredicate {
+	return func(source mautrix.EventSource, evt *event.Event) bool {
+		for _, p := range predicates {
+			if p(source, evt) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+func Not(predicate EventPredicate) EventPredicate {
+	return func(source mautrix.EventSource, evt *event.Event) bool {
+		return !predicate(source, evt)
+	}
+}
+
+// Reaction matches any reaction.
 func Reaction() EventPredicate {
 	return func(source mautrix.EventSource, evt *event.Event) bool {
-		if evt.Type != event.EventReaction {
+		return evt.Type.Type == event.EventReaction.Type
+	}
+}
+
+// ReactionKey normalizes a reaction key. Clients don't agree on whether to include the emoji variation selector, so
+// it is removed.
+func ReactionKey(key string) string {
+	return strings.ReplaceAll(key, "\ufe0f", "")
+}
+
+// ReactionWithKey matches reactions with any of the given keys.
+func ReactionWithKey(keys ...string) EventPredicate {
+	return func(source mautrix.EventSource, evt *event.Event) bool {
+		if !Reaction()(source, evt) {
 			return false
 		}
 
-		reaction := evt.Content.AsReaction()
+		key := ReactionKey(evt.Content.AsReaction().RelatesTo.Key)
+		for _, k := range keys {
+			if ReactionKey(k) == key {
+				return true
+			}
+		}
 
-		log.Info().Str("reaction", fmt.Sprintf("%v", reaction)).Str("key", reaction.RelatesTo.Key).Msg("Got reaction")
+		return false
+	}
+}
+
+// ReactionTo matches reactions to any of the given events.
+func ReactionTo(eventIDs ...id.EventID) EventPredicate {
+	return ReactionToEvents(func(eventID id.EventID) bool {
+		for _, e := range eventIDs {
+			if e == eventID {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// ReactionToEvents matches reactions to events accepted by the given function.
+func ReactionToEvents(match func(id.EventID) bool) EventPredicate {
+	return func(source mautrix.EventSource, evt *event.Event) bool {
+		if !Reaction()(source, evt) {
+			return false
+		}
+
+		return match(evt.Content.AsReaction().RelatesTo.EventID)
+	}
+}
+
+// OfType matches events of any of the given types. Only the type name is compared, not the class.
+func OfType(types ...event.Type) EventPredicate {
+	return func(source mautrix.EventSource, evt *event.Event) bool {
+		for _, t := range types {
+			if evt.Type.Type == t.Type {
+				return true
+			}
+		}
 
 		return false
 	}
@@ -53,21 +124,161 @@ func MessageMatching(r *regexp.Regexp) EventPredicate {
 
 func NotFromUser(userID id.UserID) EventPredicate {
 	return func(source mautrix.EventSource, evt *event.Event) bool {
-		log.Info().Str("evt.Sender", evt.Sender.String()).Str("userID", userID.String()).Msg("comparing")
 		return evt.Sender != userID
 	}
 }
 
+// AtUser matches messages addressed to the user, see Addressee.
 func AtUser(userID id.UserID) EventPredicate {
+	return NewAddressee(userID, "", "").Predicate()
+}
+
+func InRoom(roomIDs ...id.RoomID) EventPredicate {
+	return func(source mautrix.EventSource, evt *event.Event) bool {
+		for _, roomID := range roomIDs {
+			if evt.RoomID == roomID {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+func FromUser(userIDs ...id.UserID) EventPredicate {
+	return func(source mautrix.EventSource, evt *event.Event) bool {
+		for _, userID := range userIDs {
+			if evt.Sender == userID {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// IsDirectMessage matches events in rooms the given function considers direct chats, and invites flagged as direct.
+func IsDirectMessage(isDirect func(id.RoomID) bool) EventPredicate {
+	return func(source mautrix.EventSource, evt *event.Event) bool {
+		if evt.Type.Type == event.StateMember.Type {
+			if member, ok := evt.Content.Parsed.(*event.MemberEventContent); ok && member.IsDirect {
+				return true
+			}
+		}
+
+		return isDirect(evt.RoomID)
+	}
+}
+
+// MessageType matches messages of any of the given types, e.g. event.MsgText or event.MsgImage.
+func MessageType(types ...event.MessageType) EventPredicate {
+	return func(source mautrix.EventSource, evt *event.Event) bool {
+		if evt.Type != event.EventMessage {
+			return false
+		}
+
+		msgType := evt.Content.AsMessage().MsgType
+		for _, t := range types {
+			if msgType == t {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// HasAttachment matches messages carrying media, encrypted or not.
+func HasAttachment() EventPredicate {
 	return func(source mautrix.EventSource, evt *event.Event) bool {
 		if evt.Type != event.EventMessage {
 			return false
 		}
 
 		msg := evt.Content.AsMessage()
+		return msg.URL != "" || (msg.File != nil && msg.File.URL != "")
+	}
+}
+
+// MentionsBot matches messages mentioning the user, either through m.mentions or a pill in the formatted body.
+func MentionsBot(userID id.UserID) EventPredicate {
+	escaped := strings.NewReplacer("@", "%40", ":", "%3A").Replace(userID.String())
+	return func(source mautrix.EventSource, evt *event.Event) bool {
+		if evt.Type != event.EventMessage {
+			return false
+		}
+
+		if mentions, ok := evt.Content.Raw["m.mentions"].(map[string]interface{}); ok {
+			userIDs, _ := mentions["user_ids"].([]interface{})
+			for _, u := range userIDs {
+				if u == userID.String() {
+					return true
+				}
+			}
+		}
+
+		formatted := evt.Content.AsMessage().FormattedBody
+		return strings.Contains(formatted, "matrix.to/#/"+userID.String()) || strings.Contains(formatted, "matrix.to/#/"+escaped)
+	}
+}
+
+// IsEdit matches messages replacing an earlier message.
+func IsEdit() EventPredicate {
+	return func(source mautrix.EventSource, evt *event.Event) bool {
+		return hasRelation(evt, event.RelReplace)
+	}
+}
+
+// InThread matches messages sent in a thread.
+func InThread() EventPredicate {
+	return func(source mautrix.EventSource, evt *event.Event) bool {
+		return hasRelation(evt, "m.thread")
+	}
+}
+
+func hasRelation(evt *event.Event, relationType event.RelationType) bool {
+	if evt.Type != event.EventMessage {
+		return false
+	}
+
+	relatesTo := evt.Content.AsMessage().RelatesTo
+	return relatesTo != nil && relatesTo.Type == relationType
+}
 
-		user, _, _ := userID.Parse()
-		return strings.HasPrefix(strings.TrimSpace(msg.Body), user)
+// RateLimited matches as long as the sender sent no more than n events within the duration. Only evaluated events
+// count, so it should come last in All.
+func RateLimited(n int, per time.Duration) EventPredicate {
+	return rateLimited(n, per, time.Now)
+}
+
+func rateLimited(n int, per time.Duration, now func() time.Time) EventPredicate {
+	var lock sync.Mutex
+	seen := make(map[id.UserID][]time.Time)
+	return func(source mautrix.EventSource, evt *event.Event) bool {
+		lock.Lock()
+		defer lock.Unlock()
+
+		t := now()
+		var recent []time.Time
+		for _, s := range seen[evt.Sender] {
+			if t.Sub(s) < per {
+				recent = append(recent, s)
+			}
+		}
+		if len(recent) >= n {
+			seen[evt.Sender] = recent
+			return false
+		}
+		seen[evt.Sender] = append(recent, t)
+
+		return true
+	}
+}
+
+// PowerLevelAtLeast matches events whose sender has at least the threshold power level in the event's room.
+func PowerLevelAtLeast(threshold int, powerLevel func(id.RoomID, id.UserID) int) EventPredicate {
+	return func(source mautrix.EventSource, evt *event.Event) bool {
+		return powerLevel(evt.RoomID, evt.Sender) >= threshold
 	}
 }
 
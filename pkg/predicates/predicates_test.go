@@ -0,0 +1,191 @@
+package predicates
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func reactionEvent(eventID id.EventID, key string) *event.Event {
+	return &event.Event{
+		Type: event.EventReaction,
+		Content: event.Content{Parsed: &event.ReactionEventContent{
+			RelatesTo: event.RelatesTo{Type: event.RelAnnotation, EventID: eventID, Key: key},
+		}},
+	}
+}
+
+func textEvent(body string) *event.Event {
+	return &event.Event{
+		Type:    event.EventMessage,
+		Content: event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: body}},
+	}
+}
+
+func TestReaction(t *testing.T) {
+	assert.Assert(t, Reaction()(mautrix.EventSourceTimeline, reactionEvent("$a", "👍")))
+	assert.Assert(t, !Reaction()(mautrix.EventSourceTimeline, textEvent("hi")))
+}
+
+func TestReactionWithKey(t *testing.T) {
+	p := ReactionWithKey("✅", "1️⃣")
+	assert.Assert(t, p(mautrix.EventSourceTimeline, reactionEvent("$a", "✅")))
+	assert.Assert(t, p(mautrix.EventSourceTimeline, reactionEvent("$a", "1⃣")))
+	assert.Assert(t, !p(mautrix.EventSourceTimeline, reactionEvent("$a", "👍")))
+	assert.Assert(t, !p(mautrix.EventSourceTimeline, textEvent("✅")))
+}
+
+func TestReactionTo(t *testing.T) {
+	p := ReactionTo("$a", "$b")
+	assert.Assert(t, p(mautrix.EventSourceTimeline, reactionEvent("$b", "👍")))
+	assert.Assert(t, !p(mautrix.EventSourceTimeline, reactionEvent("$c", "👍")))
+
+	sent := map[id.EventID]bool{"$mine": true}
+	p = ReactionToEvents(func(eventID id.EventID) bool { return sent[eventID] })
+	assert.Assert(t, p(mautrix.EventSourceTimeline, reactionEvent("$mine", "👍")))
+	assert.Assert(t, !p(mautrix.EventSourceTimeline, reactionEvent("$theirs", "👍")))
+}
+
+func TestCombinators(t *testing.T) {
+	yes := func(mautrix.EventSource, *event.Event) bool { return true }
+	no := func(mautrix.EventSource, *event.Event) bool { return false }
+	evt := textEvent("hi")
+
+	assert.Assert(t, All(yes, yes)(mautrix.EventSourceTimeline, evt))
+	assert.Assert(t, !All(yes, no)(mautrix.EventSourceTimeline, evt))
+	assert.Assert(t, Any(no, yes)(mautrix.EventSourceTimeline, evt))
+	assert.Assert(t, !Any(no, no)(mautrix.EventSourceTimeline, evt))
+	assert.Assert(t, !Any()(mautrix.EventSourceTimeline, evt))
+	assert.Assert(t, Not(no)(mautrix.EventSourceTimeline, evt))
+	assert.Assert(t, !Not(yes)(mautrix.EventSourceTimeline, evt))
+}
+
+func TestInRoomFromUser(t *testing.T) {
+	evt := textEvent("hi")
+	evt.RoomID = "!room:example.com"
+	evt.Sender = "@alice:example.com"
+
+	assert.Assert(t, InRoom("!other:example.com", "!room:example.com")(mautrix.EventSourceTimeline, evt))
+	assert.Assert(t, !InRoom("!other:example.com")(mautrix.EventSourceTimeline, evt))
+	assert.Assert(t, FromUser("@alice:example.com")(mautrix.EventSourceTimeline, evt))
+	assert.Assert(t, !FromUser("@bob:example.com")(mautrix.EventSourceTimeline, evt))
+}
+
+func TestIsDirectMessage(t *testing.T) {
+	direct := IsDirectMessage(func(roomID id.RoomID) bool { return roomID == "!dm:example.com" })
+
+	evt := textEvent("hi")
+	evt.RoomID = "!dm:example.com"
+	assert.Assert(t, direct(mautrix.EventSourceTimeline, evt))
+	evt.RoomID = "!group:example.com"
+	assert.Assert(t, !direct(mautrix.EventSourceTimeline, evt))
+
+	invite := &event.Event{
+		Type:    event.StateMember,
+		RoomID:  "!new:example.com",
+		Content: event.Content{Parsed: &event.MemberEventContent{Membership: event.MembershipInvite, IsDirect: true}},
+	}
+	assert.Assert(t, direct(mautrix.EventSourceInvite, invite))
+}
+
+func TestMessageTypeAndAttachment(t *testing.T) {
+	image := &event.Event{
+		Type:    event.EventMessage,
+		Content: event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgImage, Body: "cat.png", URL: "mxc://example.com/cat"}},
+	}
+	encrypted := &event.Event{
+		Type: event.EventMessage,
+		Content: event.Content{Parsed: &event.MessageEventContent{
+			MsgType: event.MsgFile,
+			Body:    "notes.txt",
+			File:    &event.EncryptedFileInfo{URL: "mxc://example.com/notes"},
+		}},
+	}
+	text := textEvent("hi")
+
+	assert.Assert(t, MessageType(event.MsgImage, event.MsgFile)(mautrix.EventSourceTimeline, image))
+	assert.Assert(t, !MessageType(event.MsgNotice)(mautrix.EventSourceTimeline, text))
+	assert.Assert(t, MessageType(event.MsgText)(mautrix.EventSourceTimeline, text))
+	assert.Assert(t, !MessageType(event.MsgText)(mautrix.EventSourceTimeline, reactionEvent("$a", "👍")))
+
+	assert.Assert(t, HasAttachment()(mautrix.EventSourceTimeline, image))
+	assert.Assert(t, HasAttachment()(mautrix.EventSourceTimeline, encrypted))
+	assert.Assert(t, !HasAttachment()(mautrix.EventSourceTimeline, text))
+}
+
+func TestMentionsBot(t *testing.T) {
+	p := MentionsBot("@jarvis:example.com")
+
+	mentions := textEvent("jarvis: hi")
+	mentions.Content.Raw = map[string]interface{}{
+		"m.mentions": map[string]interface{}{"user_ids": []interface{}{"@jarvis:example.com"}},
+	}
+	assert.Assert(t, p(mautrix.EventSourceTimeline, mentions))
+
+	pill := &event.Event{
+		Type: event.EventMessage,
+		Content: event.Content{Parsed: &event.MessageEventContent{
+			MsgType:       event.MsgText,
+			Body:          "jarvis: hi",
+			Format:        event.FormatHTML,
+			FormattedBody: `<a href="https://matrix.to/#/@jarvis:example.com">jarvis</a>: hi`,
+		}},
+	}
+	assert.Assert(t, p(mautrix.EventSourceTimeline, pill))
+
+	pill.Content.AsMessage().FormattedBody = `<a href="https://matrix.to/#/%40jarvis%3Aexample.com">jarvis</a>: hi`
+	assert.Assert(t, p(mautrix.EventSourceTimeline, pill))
+
+	pill.Content.AsMessage().FormattedBody = `<a href="https://matrix.to/#/@alice:example.com">alice</a>: hi`
+	assert.Assert(t, !p(mautrix.EventSourceTimeline, pill))
+	assert.Assert(t, !p(mautrix.EventSourceTimeline, textEvent("hi")))
+}
+
+func TestRelations(t *testing.T) {
+	edit := textEvent("* fixed")
+	edit.Content.AsMessage().RelatesTo = &event.RelatesTo{Type: event.RelReplace, EventID: "$original"}
+	thread := textEvent("in a thread")
+	thread.Content.AsMessage().RelatesTo = &event.RelatesTo{Type: "m.thread", EventID: "$root"}
+	plain := textEvent("hi")
+
+	assert.Assert(t, IsEdit()(mautrix.EventSourceTimeline, edit))
+	assert.Assert(t, !IsEdit()(mautrix.EventSourceTimeline, thread))
+	assert.Assert(t, !IsEdit()(mautrix.EventSourceTimeline, plain))
+	assert.Assert(t, InThread()(mautrix.EventSourceTimeline, thread))
+	assert.Assert(t, !InThread()(mautrix.EventSourceTimeline, edit))
+}
+
+func TestRateLimited(t *testing.T) {
+	now := time.Date(2021, time.December, 1, 12, 0, 0, 0, time.UTC)
+	p := rateLimited(2, time.Minute, func() time.Time { return now })
+
+	alice := textEvent("hi")
+	alice.Sender = "@alice:example.com"
+	bob := textEvent("hi")
+	bob.Sender = "@bob:example.com"
+
+	assert.Assert(t, p(mautrix.EventSourceTimeline, alice))
+	assert.Assert(t, p(mautrix.EventSourceTimeline, alice))
+	assert.Assert(t, !p(mautrix.EventSourceTimeline, alice))
+	assert.Assert(t, p(mautrix.EventSourceTimeline, bob))
+
+	now = now.Add(time.Minute)
+	assert.Assert(t, p(mautrix.EventSourceTimeline, alice))
+}
+
+func TestPowerLevelAtLeast(t *testing.T) {
+	levels := map[id.UserID]int{"@mod:example.com": 50, "@admin:example.com": 100}
+	p := PowerLevelAtLeast(50, func(roomID id.RoomID, userID id.UserID) int { return levels[userID] })
+
+	evt := textEvent("leave")
+	evt.Sender = "@mod:example.com"
+	assert.Assert(t, p(mautrix.EventSourceTimeline, evt))
+	evt.Sender = "@admin:example.com"
+	assert.Assert(t, p(mautrix.EventSourceTimeline, evt))
+	evt.Sender = "@alice:example.com"
+	assert.Assert(t, !p(mautrix.EventSourceTimeline, evt))
+}